@@ -18,15 +18,25 @@ var (
 	num          int
 	clientHandle tcp.Handler
 	clientParser tcp.PacketParser
+	handshake    bool
 )
 
 func main() {
 	flag.StringVar(&addr, "addr", "127.0.0.1:20000", "IP:Port address of chatroom to join.")
 	flag.IntVar(&num, "num", 100, "benchmark client num.")
+	flag.BoolVar(&handshake, "handshake", true, "negotiate protocol version with server, must match server.")
 	flag.Parse()
 
 	fmt.Println("connect chatroom on:", addr)
-	opt := tcp.NewTCPOption(clientHandle, clientParser, tcp.WithRecvChanLimit(1024), tcp.WithSendChanLimit(256))
+	opts := []tcp.TCPOptionFn{
+		tcp.WithRecvChanLimit(1024),
+		tcp.WithSendChanLimit(256),
+		tcp.WithAutoPong(&proto.SMPing{}, &proto.CMPong{}),
+	}
+	if handshake {
+		opts = append(opts, tcp.WithHandshake(proto.NewHandshake(tcp.Codec{Name: "gob", Parser: clientParser})))
+	}
+	opt := tcp.NewTCPOption(clientHandle, clientParser, opts...)
 	conn := tcp.NewTCPClient(addr, num, opt)
 	conn.Start()
 	defer conn.Close()
@@ -43,16 +53,19 @@ func init() {
 	protGob := protocol.NewGobProtocol()
 
 	proto.RegAllClientMsg(protGob)
-	protGob.RegisterAndHandle(&proto.SMRespLogin{}, handler.SMRespLoginBench)
-	protGob.RegisterAndHandle(&proto.SMRespEnter{}, handler.SMRespEnterBench)
-	protGob.RegisterAndHandle(&proto.SMRespLeave{}, handler.SMRespLeaveBench)
-	protGob.RegisterAndHandle(&proto.SMUserEnter{}, handler.SMUserEnterBench)
-	protGob.RegisterAndHandle(&proto.SMUserLeave{}, handler.SMUserLeaveBench)
+	protGob.Handle(handler.SMRespLoginBench)
+	protGob.Handle(handler.SMRespEnterBench)
+	protGob.Handle(handler.SMRespLeaveBench)
+	protGob.Handle(handler.SMUserEnterBench)
+	protGob.Handle(handler.SMUserLeaveBench)
+	// 心跳由 WithAutoPong 直接回复, 只需注册
+	protGob.Register(&proto.SMPing{})
 	// client reg chat msg
-	protGob.RegisterAndHandle(&proto.SMChatContent{}, handler.SMChatContentBench)
+	protGob.Handle(handler.SMChatContentBench)
 	// client reg GM cmd
-	protGob.RegisterAndHandle(&proto.SMUserStats{}, handler.SMUserStatsBench)
-	protGob.RegisterAndHandle(&proto.SMPopularWord{}, handler.SMPopularWordBench)
+	protGob.Handle(handler.SMUserStatsBench)
+	protGob.Handle(handler.SMPopularWordBench)
+	protGob.Handle(handler.SMServerNotice)
 
 	clientHandle = handler.NewClientBenchHandle(protGob)
 	clientParser = tcp.NewHeaderPacketParser(protGob)
@@ -1,30 +1,105 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"log"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/jinnblue/chatroom-test/internal/handler"
 	"github.com/jinnblue/chatroom-test/internal/proto"
 	"github.com/jinnblue/chatroom-test/pkg/tcp"
 	"github.com/jinnblue/chatroom-test/pkg/tcp/protocol"
+	"github.com/jinnblue/chatroom-test/pkg/websocket"
 )
 
 var (
-	addr         string
-	clientHandle *handler.ClientHandle
-	clientParser tcp.PacketParser
+	addr      string
+	useTLS    bool
+	insecure  bool
+	certFile  string
+	keyFile   string
+	caFile    string
+	wsURL     string
+	idle      time.Duration
+	reconnect bool
+	frame     string
+	maxFrame  int
+	compress  bool
+	compMin   int
+	codec     string
+	handshake bool
 )
 
 func main() {
 	flag.StringVar(&addr, "addr", "127.0.0.1:20000", "IP:Port address of chatroom to join.")
+	flag.BoolVar(&useTLS, "tls", false, "connect chatroom over TLS.")
+	flag.BoolVar(&insecure, "insecure", false, "skip verifying server certificate.")
+	flag.StringVar(&caFile, "ca", "", "CA file to verify server certificate.")
+	flag.StringVar(&certFile, "cert", "", "client certificate file for mutual TLS.")
+	flag.StringVar(&keyFile, "key", "", "client private key file for mutual TLS.")
+	flag.StringVar(&wsURL, "ws", "", "ws:// or wss:// url of chatroom, override addr when set.")
+	flag.DurationVar(&idle, "idle", 0, "close connection when server is silent for this long, 0 to disable.")
+	flag.BoolVar(&reconnect, "reconnect", true, "reconnect and resume session when connection lost.")
+	flag.StringVar(&frame, "frame", "uint16", "frame length header: uint16, uint32 or varint, must match server.")
+	flag.IntVar(&maxFrame, "maxframe", 0, "max frame size in bytes, 0 for header default.")
+	flag.BoolVar(&compress, "compress", false, "negotiate frame compression, server must enable it too.")
+	flag.IntVar(&compMin, "compressmin", tcp.DEFAULT_COMPRESS_THRESHOLD, "min payload size in bytes to compress.")
+	flag.StringVar(&codec, "codec", "gob", "message codec: gob, gobstream, json or binary, must match the server endpoint.")
+	flag.BoolVar(&handshake, "handshake", true, "negotiate protocol version, codec and compression with server over tcp, disable for jsonaddr or old servers.")
 	flag.Parse()
 
+	clientHandle, clientParser, err := newClientCodec(codec)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	header, err := tcp.ParseFrameHeader(frame)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	opts := []tcp.TCPOptionFn{
+		tcp.WithIdleTimeout(idle),
+		tcp.WithFrameHeader(header),
+		tcp.WithMaxFrameSize(maxFrame),
+		// 心跳由读取协程直接回复, 等待用户输入时不会被判定空闲
+		tcp.WithAutoPong(&proto.SMPing{}, &proto.CMPong{}),
+	}
+	if compress {
+		opts = append(opts, tcp.WithCompression(tcp.DEFAULT_COMPRESS_LEVEL, compMin))
+	}
+	// websocket 端点不握手
+	if handshake && wsURL == "" {
+		opts = append(opts, tcp.WithHandshake(proto.NewHandshake(tcp.Codec{Name: codec, Parser: clientParser})))
+	}
+	if reconnect {
+		opts = append(opts, tcp.WithReconnect(tcp.DEFAULT_RECONNECT_MIN, tcp.DEFAULT_RECONNECT_MAX))
+	}
+	var tlsCfg *tls.Config
+	if useTLS || caFile != "" || certFile != "" {
+		tlsCfg, err = tcp.NewClientTLSConfig(caFile, certFile, keyFile, insecure)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if wsURL != "" {
+		// wss 的 TLS 由 websocket 拨号处理
+		addr = wsURL
+		opts = append(opts, tcp.WithDialer(func(u string) (net.Conn, error) {
+			return websocket.Dial(u, tlsCfg)
+		}))
+	} else if tlsCfg != nil {
+		opts = append(opts, tcp.WithTLSConfig(tlsCfg))
+	}
+
 	fmt.Println("connect chatroom on:", addr)
-	opt := tcp.NewTCPOption(clientHandle, clientParser)
+	opt := tcp.NewTCPOption(clientHandle, clientParser, opts...)
 	conn := tcp.NewTCPClient(addr, 1, opt)
 	conn.Start()
 	defer conn.Close()
@@ -34,21 +109,27 @@ func main() {
 	fmt.Println("Signal: ", <-sigChan)
 }
 
-func init() {
-	protGob := protocol.NewGobProtocol()
+// newClientCodec 创建指定编码格式的协议并注册客户端消息与处理函数
+func newClientCodec(codec string) (*handler.ClientHandle, tcp.PacketParser, error) {
+	prot, err := protocol.New(codec)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	proto.RegAllClientMsg(protGob)
-	protGob.RegisterAndHandle(&proto.SMRespLogin{}, handler.SMRespLogin)
-	protGob.RegisterAndHandle(&proto.SMRespEnter{}, handler.SMRespEnter)
-	protGob.RegisterAndHandle(&proto.SMRespLeave{}, handler.SMRespLeave)
-	protGob.RegisterAndHandle(&proto.SMUserEnter{}, handler.SMUserEnter)
-	protGob.RegisterAndHandle(&proto.SMUserLeave{}, handler.SMUserLeave)
+	proto.RegAllClientMsg(prot)
+	prot.Handle(handler.SMRespLogin)
+	prot.Handle(handler.SMRespEnter)
+	prot.Handle(handler.SMRespLeave)
+	prot.Handle(handler.SMUserEnter)
+	prot.Handle(handler.SMUserLeave)
+	// 心跳由 WithAutoPong 直接回复, 只需注册
+	prot.Register(&proto.SMPing{})
 	// client reg chat msg
-	protGob.RegisterAndHandle(&proto.SMChatContent{}, handler.SMChatContent)
+	prot.Handle(handler.SMChatContent)
 	// client reg GM cmd
-	protGob.RegisterAndHandle(&proto.SMUserStats{}, handler.SMUserStats)
-	protGob.RegisterAndHandle(&proto.SMPopularWord{}, handler.SMPopularWord)
+	prot.Handle(handler.SMUserStats)
+	prot.Handle(handler.SMPopularWord)
+	prot.Handle(handler.SMServerNotice)
 
-	clientHandle = handler.NewClientHandle(protGob)
-	clientParser = tcp.NewHeaderPacketParser(protGob)
+	return handler.NewClientHandle(prot), tcp.NewHeaderPacketParser(prot), nil
 }
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"strings"
+
+	"github.com/jinnblue/chatroom-test/internal/proto"
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+	"github.com/jinnblue/chatroom-test/pkg/tcp/protocol"
+)
+
+// protodoc 遍历 GobProtocol 中注册的消息, 生成 JSON 协议描述与 Markdown 文档, 供非 Go 客户端对接
+//
+//	go run ./cmd/protodoc -json doc/protocol.json -md doc/protocol.md
+
+var (
+	jsonFile string
+	mdFile   string
+)
+
+// Schema 协议描述
+type Schema struct {
+	Version    uint16    `json:"version"`
+	MinVersion uint16    `json:"minVersion"`
+	Codecs     []string  `json:"codecs"`
+	Messages   []Message `json:"messages"`
+	Enums      []Enum    `json:"enums"`
+}
+
+// Message 一种消息, ID 为各编码格式使用的线上标识, BinaryID 为 binary 格式的编号
+type Message struct {
+	ID        string  `json:"id"`
+	BinaryID  uint16  `json:"binaryId"`
+	GoType    string  `json:"goType"`
+	Direction string  `json:"direction"`
+	Fields    []Field `json:"fields"`
+}
+
+// Field 消息字段, Name 为 JSON 格式使用的字段名; 取值为枚举时 Enum 为枚举名
+type Field struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Enum     string `json:"enum,omitempty"`
+	Optional bool   `json:"optional,omitempty"`
+}
+
+// Enum 枚举类型及全部取值
+type Enum struct {
+	Name   string      `json:"name"`
+	Type   string      `json:"type"`
+	Values []EnumValue `json:"values"`
+}
+
+type EnumValue struct {
+	Name  string `json:"name"`
+	Value int    `json:"value"`
+	Desc  string `json:"desc,omitempty"`
+}
+
+// enumValue 枚举值需实现的方法
+type enumValue interface {
+	fmt.Stringer
+	Desc() string
+}
+
+const (
+	DIR_CLIENT_TO_SERVER = "client_to_server"
+	DIR_SERVER_TO_CLIENT = "server_to_client"
+)
+
+func main() {
+	flag.StringVar(&jsonFile, "json", "", "Write JSON schema to file, empty for stdout.")
+	flag.StringVar(&mdFile, "md", "", "Write Markdown document to file, skipped if empty.")
+	flag.Parse()
+
+	s := buildSchema()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	data = append(data, '\n')
+	if jsonFile == "" {
+		fmt.Print(string(data))
+	} else if err := ioutil.WriteFile(jsonFile, data, 0644); err != nil {
+		log.Fatal(err)
+	}
+	if mdFile != "" {
+		if err := ioutil.WriteFile(mdFile, markdown(s), 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func buildSchema() *Schema {
+	var enums []Enum
+	enumOf := make(map[reflect.Type]string)
+	addEnum := func(values ...enumValue) {
+		t := reflect.TypeOf(values[0])
+		e := Enum{Name: t.Name(), Type: typeName(t)}
+		for _, v := range values {
+			e.Values = append(e.Values, EnumValue{
+				Name:  v.String(),
+				Value: int(reflect.ValueOf(v).Int()),
+				Desc:  v.Desc(),
+			})
+		}
+		enums = append(enums, e)
+		enumOf[t] = e.Name
+	}
+	var errCodes, cmds []enumValue
+	for _, c := range proto.ErrCodes() {
+		errCodes = append(errCodes, c)
+	}
+	for _, c := range proto.CommandTypes() {
+		cmds = append(cmds, c)
+	}
+	addEnum(errCodes...)
+	addEnum(cmds...)
+
+	s := &Schema{
+		Version:    proto.PROTO_VERSION,
+		MinVersion: proto.PROTO_MIN_VERSION,
+		Codecs:     protocol.Codecs,
+		Enums:      enums,
+	}
+	// 两端各自只注册一个方向的消息, 分别注册即可得到方向
+	for _, dir := range []struct {
+		name string
+		reg  func(protocol.Protocol)
+	}{
+		{DIR_CLIENT_TO_SERVER, proto.RegAllClientMsg},
+		{DIR_SERVER_TO_CLIENT, proto.RegAllServerMsg},
+	} {
+		prot := protocol.NewGobProtocol()
+		dir.reg(prot)
+		for _, m := range prot.Messages() {
+			s.Messages = append(s.Messages, Message{
+				ID:        m.WireID,
+				BinaryID:  protocol.BinaryMsgNum(m.WireID),
+				GoType:    m.Type.Name(),
+				Direction: dir.name,
+				Fields:    fields(m.Type, enumOf),
+			})
+		}
+	}
+	return s
+}
+
+// fields 按 encoding/json 的规则列出导出字段, 嵌入的结构体(如 tcp.Message)展开
+func fields(t reflect.Type, enumOf map[reflect.Type]string) []Field {
+	var fs []Field
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			fs = append(fs, fields(f.Type, enumOf)...)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		name, opts := f.Name, ""
+		if tag, ok := f.Tag.Lookup("json"); ok {
+			if tag == "-" {
+				continue
+			}
+			parts := strings.SplitN(tag, ",", 2)
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			if len(parts) > 1 {
+				opts = parts[1]
+			}
+		}
+		fs = append(fs, Field{
+			Name:     name,
+			Type:     typeName(f.Type),
+			Enum:     enumOf[f.Type],
+			Optional: strings.Contains(opts, "omitempty"),
+		})
+	}
+	return fs
+}
+
+// typeName 与语言无关的字段类型名
+func typeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int:
+		return "int64"
+	case reflect.Uint:
+		return "uint64"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "bytes"
+		}
+		return "[]" + typeName(t.Elem())
+	case reflect.Map:
+		return "map[" + typeName(t.Key()) + "]" + typeName(t.Elem())
+	case reflect.Ptr:
+		return typeName(t.Elem())
+	case reflect.Struct:
+		return t.Name()
+	}
+	return t.Kind().String()
+}
+
+var dirTitle = map[string]string{
+	DIR_CLIENT_TO_SERVER: "客户端 → 服务端",
+	DIR_SERVER_TO_CLIENT: "服务端 → 客户端",
+}
+
+func markdown(s *Schema) []byte {
+	var b bytes.Buffer
+	b.WriteString("# 聊天室协议\n\n")
+	b.WriteString("本文档由 `go run ./cmd/protodoc` 生成, 请勿手工修改.\n\n")
+	fmt.Fprintf(&b, "协议版本 %d, 兼容最低版本 %d; 编码格式: %s.\n\n", s.Version, s.MinVersion, strings.Join(s.Codecs, ", "))
+	b.WriteString("消息类型以线上标识区分: json 格式 `{\"type\":线上标识,\"data\":{字段}}`, gob 格式名称头为线上标识、数据为按上表字段组成的无名结构体, binary 格式使用编号.\n")
+	b.WriteString("json 格式中值为零的可选字段可省略; 枚举按整数编码.\n")
+	fmt.Fprintf(&b, "ReqSeq 非 0 时为请求序号, 响应带回请求序号并置最高位(%#x).\n\n", tcp.REQ_SEQ_RESPONSE)
+
+	for _, dir := range []string{DIR_CLIENT_TO_SERVER, DIR_SERVER_TO_CLIENT} {
+		fmt.Fprintf(&b, "## %s\n\n", dirTitle[dir])
+		b.WriteString("| 线上标识 | binary 编号 | Go 类型 |\n|---|---|---|\n")
+		for _, m := range s.Messages {
+			if m.Direction == dir {
+				fmt.Fprintf(&b, "| [`%s`](#%s) | 0x%04x | %s |\n", m.ID, anchor(m.ID), m.BinaryID, m.GoType)
+			}
+		}
+		b.WriteString("\n")
+		for _, m := range s.Messages {
+			if m.Direction != dir {
+				continue
+			}
+			fmt.Fprintf(&b, "### %s\n\n", m.ID)
+			fmt.Fprintf(&b, "%s, Go 类型 `%s`, binary 编号 0x%04x.\n\n", dirTitle[dir], m.GoType, m.BinaryID)
+			b.WriteString("| 字段 | 类型 | 说明 |\n|---|---|---|\n")
+			for _, f := range m.Fields {
+				var notes []string
+				if f.Enum != "" {
+					notes = append(notes, fmt.Sprintf("取值见 [%s](#%s)", f.Enum, anchor(f.Enum)))
+				}
+				if f.Optional {
+					notes = append(notes, "可选")
+				}
+				fmt.Fprintf(&b, "| %s | %s | %s |\n", f.Name, f.Type, strings.Join(notes, ", "))
+			}
+			b.WriteString("\n")
+		}
+	}
+
+	b.WriteString("## 枚举\n\n")
+	for _, e := range s.Enums {
+		fmt.Fprintf(&b, "### %s\n\n类型 %s.\n\n", e.Name, e.Type)
+		b.WriteString("| 名称 | 值 | 说明 |\n|---|---|---|\n")
+		for _, v := range e.Values {
+			fmt.Fprintf(&b, "| %s | %d | %s |\n", v.Name, v.Value, v.Desc)
+		}
+		b.WriteString("\n")
+	}
+	return b.Bytes()
+}
+
+// anchor Markdown 标题对应的锚点
+func anchor(title string) string {
+	return strings.ToLower(strings.NewReplacer(".", "", " ", "-").Replace(title))
+}
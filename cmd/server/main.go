@@ -1,33 +1,116 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"runtime/pprof"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/jinnblue/chatroom-test/internal/handler"
 	"github.com/jinnblue/chatroom-test/internal/logic"
 	"github.com/jinnblue/chatroom-test/internal/proto"
 	"github.com/jinnblue/chatroom-test/pkg/tcp"
 	"github.com/jinnblue/chatroom-test/pkg/tcp/protocol"
+	"github.com/jinnblue/chatroom-test/pkg/websocket"
 )
 
 var (
 	addr      string
 	cfgPath   string
-	srvHandle tcp.Handler
-	srvParser tcp.PacketParser
+	certFile  string
+	keyFile   string
+	caFile    string
+	wsAddr    string
+	wsPath    string
+	wsOrigins string
+	heartbeat time.Duration
+	idle      time.Duration
+	drain     time.Duration
+	frame     string
+	maxFrame  int
+	rate      float64
+	burst     int
+	byteRate  float64
+	byteBurst int
+	throttle  string
+	overflow  string
+	blockWait time.Duration
+	maxConns  int
+	maxPerIP  int
+	allowlist string
+	flushWait time.Duration
+	pollers   int
+	proxyOn   bool
+	proxyFrom string
+	compress  bool
+	compMin   int
+	codec     string
+	jsonAddr  string
+	handshake bool
 )
 
 func main() {
 	flag.StringVar(&addr, "addr", "0.0.0.0:20000", "IP:Port address of chatrooms listen on.")
 	flag.StringVar(&cfgPath, "config", "", "config path of blackwords.")
+	flag.StringVar(&certFile, "cert", "", "TLS certificate file, enable TLS when set.")
+	flag.StringVar(&keyFile, "key", "", "TLS private key file.")
+	flag.StringVar(&caFile, "ca", "", "CA file to verify client certificates (mutual TLS).")
+	flag.StringVar(&wsAddr, "ws", "", "IP:Port address of websocket endpoint, disabled when empty.")
+	flag.StringVar(&wsPath, "wspath", "/chat", "http path of websocket endpoint.")
+	flag.StringVar(&wsOrigins, "wsorigin", "", "comma separated origins allowed to open websocket besides same-origin, e.g. https://chat.example.com, * for any.")
+	flag.DurationVar(&heartbeat, "heartbeat", 15*time.Second, "interval of heartbeat ping, 0 to disable.")
+	flag.DurationVar(&idle, "idle", 45*time.Second, "close connection when peer is silent for this long, 0 to disable.")
+	flag.DurationVar(&drain, "drain", 5*time.Second, "graceful shutdown deadline to flush clients, 0 to close immediately.")
+	flag.StringVar(&frame, "frame", "uint16", "frame length header: uint16, uint32 or varint, must match clients.")
+	flag.IntVar(&maxFrame, "maxframe", 0, "max frame size in bytes, 0 for header default.")
+	flag.Float64Var(&rate, "rate", 0, "max packets per second per connection, 0 for unlimited.")
+	flag.IntVar(&burst, "burst", 0, "packet burst per connection, 0 for one second of rate.")
+	flag.Float64Var(&byteRate, "byterate", 0, "max bytes per second per connection, 0 for unlimited.")
+	flag.IntVar(&byteBurst, "byteburst", 0, "byte burst per connection, 0 for one second of byterate.")
+	flag.StringVar(&throttle, "throttle", "drop", "policy when rate exceeded: drop, delay or disconnect.")
+	flag.StringVar(&overflow, "overflow", "drop-newest", "policy when client send queue full: drop-newest, drop-oldest, block or disconnect.")
+	flag.DurationVar(&blockWait, "blockwait", tcp.DEFAULT_OVERFLOW_BLOCK_TIMEOUT, "max wait for send queue when overflow policy is block.")
+	flag.IntVar(&maxConns, "maxconns", 0, "max concurrent connections, 0 for unlimited.")
+	flag.IntVar(&maxPerIP, "maxperip", 0, "max concurrent connections per remote ip, 0 for unlimited.")
+	flag.StringVar(&allowlist, "allow", "", "comma separated ip or cidr list exempt from connection limits, e.g. benchmark hosts.")
+	flag.DurationVar(&flushWait, "flush", tcp.DEFAULT_FLUSH_LATENCY, "max latency to coalesce writes under load.")
+	flag.IntVar(&pollers, "epoll", 0, "number of epoll pollers serving tcp connections (linux only), 0 for goroutines per connection.")
+	flag.BoolVar(&proxyOn, "proxy", false, "expect PROXY protocol v1/v2 header from load balancer to recover client address.")
+	flag.StringVar(&proxyFrom, "proxytrust", "", "comma separated ip or cidr list of trusted proxies, required with -proxy.")
+	flag.BoolVar(&compress, "compress", false, "compress frames for clients that negotiate compression, old clients unaffected.")
+	flag.IntVar(&compMin, "compressmin", tcp.DEFAULT_COMPRESS_THRESHOLD, "min payload size in bytes to compress.")
+	flag.StringVar(&codec, "codec", "gob", "message codec of addr and websocket endpoint: gob, gobstream, json or binary.")
+	flag.StringVar(&jsonAddr, "jsonaddr", "", "IP:Port address of an extra tcp listener speaking json, disabled when empty.")
+	flag.BoolVar(&handshake, "handshake", true, "require version handshake on addr, clients choose any codec and negotiate compression; clients without handshake get a notice and are closed; jsonaddr and websocket endpoint unaffected.")
 	flag.Parse()
 
+	header, err := tcp.ParseFrameHeader(frame)
+	if err != nil {
+		log.Fatal(err)
+	}
+	policy, err := tcp.ParseThrottlePolicy(throttle)
+	if err != nil {
+		log.Fatal(err)
+	}
+	overflowPolicy, err := tcp.ParseOverflowPolicy(overflow)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	srvHandle, srvParser, err := newServerCodec(codec)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	logic.InitActrie(cfgPath)
 	fmt.Printf("chatrooms server start on:%s \n", addr)
 
@@ -36,33 +119,178 @@ func main() {
 	pprof.StartCPUProfile(f)
 	defer pprof.StopCPUProfile()
 
-	srv := tcp.NewTCPServer(addr, tcp.NewTCPOption(srvHandle, srvParser, tcp.WithSendChanLimit(100), tcp.WithRecvChanLimit(20)))
+	baseOpts := []tcp.TCPOptionFn{
+		tcp.WithSendChanLimit(100),
+		tcp.WithRecvChanLimit(20),
+		tcp.WithHeartbeat(heartbeat, &proto.SMPing{}),
+		tcp.WithIdleTimeout(idle),
+		tcp.WithFrameHeader(header),
+		tcp.WithMaxFrameSize(maxFrame),
+		tcp.WithRateLimit(tcp.RateLimit{
+			PacketsPerSec: rate,
+			PacketBurst:   burst,
+			BytesPerSec:   byteRate,
+			ByteBurst:     byteBurst,
+			Policy:        policy,
+		}),
+		tcp.WithSendOverflow(overflowPolicy, blockWait),
+		tcp.WithMaxConns(maxConns),
+		tcp.WithMaxConnsPerIP(maxPerIP),
+		tcp.WithFlush(flushWait, tcp.DEFAULT_FLUSH_THRESHOLD),
+		tcp.WithMiddleware(handler.LogSlow(100 * time.Millisecond)),
+	}
+	if compress {
+		baseOpts = append(baseOpts, tcp.WithCompression(tcp.DEFAULT_COMPRESS_LEVEL, compMin))
+	}
+	if allowlist != "" {
+		baseOpts = append(baseOpts, tcp.WithAllowlist(strings.Split(allowlist, ",")...))
+	}
+	opts := baseOpts
+	// 负载均衡在 tcp 连接开头写入 PROXY 头, websocket 端点不使用
+	if proxyOn {
+		if strings.TrimSpace(proxyFrom) == "" {
+			log.Fatal("-proxy requires -proxytrust, otherwise any client could forge its address")
+		}
+		opts = append(opts, tcp.WithProxyProtocol(strings.Split(proxyFrom, ",")...))
+	}
+	var tlsCfg *tls.Config
+	if certFile != "" {
+		tlsCfg, err = tcp.NewServerTLSConfig(certFile, keyFile, caFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, tcp.WithTLSConfig(tlsCfg))
+		fmt.Println("TLS enabled, verify client cert:", caFile != "")
+	}
+
+	if pollers > 0 {
+		opts = append(opts, tcp.WithEpoll(pollers))
+	}
+
+	srvOpts := opts
+	if handshake {
+		hs, err := newServerHandshake(codec, srvParser)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srvOpts = append(opts[:len(opts):len(opts)], tcp.WithHandshake(hs))
+	}
+
+	srv := tcp.NewTCPServer(addr, tcp.NewTCPOption(srvHandle, srvParser, srvOpts...))
+	servers := []*tcp.TCPServer{srv}
 	go func() {
 		err := srv.ListenAndServe()
-		if err != nil {
+		if err != nil && !errors.Is(err, net.ErrClosed) {
 			log.Fatal(err)
 		}
-		defer srv.Close()
 	}()
 
+	// json 端点与 tcp 共用处理函数和聊天室, 广播时按接收方格式编码
+	if jsonAddr != "" {
+		jsonHandle, jsonParser, err := newServerCodec("json")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("json endpoint start on:%s \n", jsonAddr)
+		jsonSrv := tcp.NewTCPServer(jsonAddr, tcp.NewTCPOption(jsonHandle, jsonParser, opts...))
+		servers = append(servers, jsonSrv)
+		go func() {
+			err := jsonSrv.ListenAndServe()
+			if err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// websocket 与 tcp 共用 handler, 用户进入同一批聊天室; TLS 由 http 层处理(wss)
+	if wsAddr != "" {
+		var origins []string
+		if wsOrigins != "" {
+			origins = strings.Split(wsOrigins, ",")
+		}
+		wsLn, err := websocket.Listen(wsAddr, wsPath, tlsCfg, origins...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("websocket endpoint start on:%s%s \n", wsAddr, wsPath)
+		wsSrv := tcp.NewTCPServer(wsAddr, tcp.NewTCPOption(srvHandle, srvParser, baseOpts...))
+		servers = append(servers, wsSrv)
+		go func() {
+			err := wsSrv.Serve(wsLn)
+			if err != nil && !errors.Is(err, websocket.ErrListenerClosed) {
+				log.Fatal(err)
+			}
+		}()
+	}
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	fmt.Println("Signal: ", <-sigChan)
-	logic.RoomAdmin().Close()
+
+	if drain <= 0 {
+		logic.RoomAdmin().Close()
+		for _, s := range servers {
+			s.Close()
+		}
+		return
+	}
+
+	// 优雅关闭: 停止接受连接 -> 广播停服通知 -> 写出所有连接的发送缓冲 -> 关闭
+	deadline := time.Now().Add(drain)
+	for _, s := range servers {
+		s.StopAccept()
+	}
+	logic.RoomAdmin().Shutdown("服务器即将关闭,请稍后重新连接")
+	// 各端点同时排空, 总耗时不超过 drain
+	remain := time.Until(deadline)
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *tcp.TCPServer) {
+			defer wg.Done()
+			if err := s.Shutdown(remain); err != nil {
+				log.Println("server shutdown:", err)
+			}
+		}(s)
+	}
+	wg.Wait()
+	fmt.Println("chatrooms server closed, panics recovered:", tcp.Panics())
 }
 
-func init() {
-	protGob := protocol.NewGobProtocol()
+// newServerCodec 创建指定编码格式的协议并注册服务端消息与处理函数
+func newServerCodec(codec string) (tcp.Handler, tcp.PacketParser, error) {
+	prot, err := protocol.New(codec)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	proto.RegAllServerMsg(protGob)
-	protGob.RegisterAndHandle(&proto.CMLogin{}, handler.CMLogin)
-	protGob.RegisterAndHandle(&proto.CMEnter{}, handler.CMEnter)
-	protGob.RegisterAndHandle(&proto.CMLeave{}, handler.CMLeave)
+	proto.RegAllServerMsg(prot)
+	prot.Handle(handler.CMLogin)
+	prot.Handle(handler.CMEnter)
+	prot.Handle(handler.CMLeave)
+	prot.Handle(handler.CMPong)
 	// server chat msg
-	protGob.RegisterAndHandle(&proto.CMChat{}, handler.CMChat)
+	prot.Handle(handler.CMChat)
 	// server GM cmd
-	protGob.RegisterAndHandle(&proto.CMCommandGM{}, handler.CMCommandGM)
+	prot.Handle(handler.CMCommandGM)
+	// route middleware
+	prot.Use(handler.RequireLogin)
+
+	return handler.NewServerHandle(prot), tcp.NewHeaderPacketParser(prot), nil
+}
 
-	srvHandle = handler.NewServerHandle(protGob)
-	srvParser = tcp.NewHeaderPacketParser(protGob)
+// newServerHandshake addr 端点的握手配置, codec 优先, 客户端也可选择其他编码
+func newServerHandshake(codec string, parser tcp.PacketParser) (tcp.Handshake, error) {
+	codecs := []tcp.Codec{{Name: codec, Parser: parser}}
+	for _, name := range protocol.Codecs {
+		if name == codec {
+			continue
+		}
+		_, p, err := newServerCodec(name)
+		if err != nil {
+			return tcp.Handshake{}, err
+		}
+		codecs = append(codecs, tcp.Codec{Name: name, Parser: p})
+	}
+	return proto.NewHandshake(codecs...), nil
 }
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -56,7 +57,7 @@ func (h *ClientBenchHandle) OnConnect(c *tcp.TCPConn) bool {
 	globalIdx = int64(c.OnlineIdx)
 	nickname := fmt.Sprintf("Client_%5.5d", c.OnlineIdx)
 	h.user = logic.NewClientUser(c, nickname)
-	c.SetExtraData(h.user)
+	logic.NewSession(c, h.user)
 
 	startPrint()
 
@@ -68,7 +69,7 @@ func (h *ClientBenchHandle) OnConnect(c *tcp.TCPConn) bool {
 }
 
 func (h *ClientBenchHandle) OnMessage(c *tcp.TCPConn, p tcp.Packet) bool {
-	err := h.prot.Route(p, c.GetExtraData()) // 0:msg 1:*user
+	err := h.prot.Route(p, logic.SessionOf(c))
 	if err != nil {
 		fmt.Printf("OnMessage error: %v\n", err)
 		return false
@@ -77,7 +78,7 @@ func (h *ClientBenchHandle) OnMessage(c *tcp.TCPConn, p tcp.Packet) bool {
 }
 
 func (h *ClientBenchHandle) OnClose(c *tcp.TCPConn) {
-	user := (c.GetExtraData()).(*logic.User)
+	user := logic.SessionOf(c).User()
 	fmt.Println("Disconnected: ", user)
 }
 
@@ -89,10 +90,8 @@ func (h *ClientBenchHandle) SendChatContent(c string) {
 	h.user.AsyncSendMessage(cm)
 }
 
-func SMRespLoginBench(param []interface{}) {
-	// 0:msg 1:*user
-	smsg := param[0].(*proto.SMRespLogin)
-	user := param[1].(*logic.User)
+func SMRespLoginBench(ctx context.Context, s *logic.Session, smsg *proto.SMRespLogin) {
+	user := s.User()
 	switch smsg.ErrCode {
 	case proto.LOGIN_OK:
 		{
@@ -115,10 +114,8 @@ func SMRespLoginBench(param []interface{}) {
 	}
 }
 
-func SMRespEnterBench(param []interface{}) {
-	// 0:msg 1:*user
-	smsg := param[0].(*proto.SMRespEnter)
-	user := param[1].(*logic.User)
+func SMRespEnterBench(ctx context.Context, s *logic.Session, smsg *proto.SMRespEnter) {
+	user := s.User()
 	switch smsg.ErrCode {
 	case proto.ENTER_OK:
 		{
@@ -138,7 +135,12 @@ func SMRespEnterBench(param []interface{}) {
 					}
 					u.AsyncSendMessage(cmsg)
 					tmp := time.Duration(rand.Int63n(500)) * time.Millisecond
-					time.Sleep(SendChatDuration + tmp)
+					select {
+					case <-time.After(SendChatDuration + tmp):
+					case <-ctx.Done():
+						// 连接已关闭
+						return
+					}
 				}
 			}(user)
 		}
@@ -154,10 +156,8 @@ func SMRespEnterBench(param []interface{}) {
 	}
 }
 
-func SMRespLeaveBench(param []interface{}) {
-	// 0:msg 1:*user
-	// smsg := param[0].(*proto.SMRespLeave)
-	// user := param[1].(*logic.User)
+func SMRespLeaveBench(ctx context.Context, s *logic.Session, smsg *proto.SMRespLeave) {
+
 }
 
 var (
@@ -167,38 +167,25 @@ var (
 	PrintCloseChan chan struct{}
 )
 
-func SMUserEnterBench(param []interface{}) {
-	// 0:msg 1:*user
-	// smsg := param[0].(*proto.SMUserEnter)
+func SMUserEnterBench(ctx context.Context, s *logic.Session, smsg *proto.SMUserEnter) {
 	// fmt.Printf("SYSTEM: 用户 %s 加入了聊天室\n", smsg.NickName)
 }
 
-func SMUserLeaveBench(param []interface{}) {
-	// 0:msg 1:*user
-	// smsg := param[0].(*proto.SMUserLeave)
+func SMUserLeaveBench(ctx context.Context, s *logic.Session, smsg *proto.SMUserLeave) {
 	// fmt.Printf("SYSTEM: 用户 %s 离开了聊天室\n", smsg.NickName)
 }
 
-func SMChatContentBench(param []interface{}) {
-	// 0:msg 1:*user
-	smsg := param[0].(*proto.SMChatContent)
-	// user := param[1].(*logic.User)
+func SMChatContentBench(ctx context.Context, s *logic.Session, smsg *proto.SMChatContent) {
 	asyncPrint(smsg)
 	// log.Printf("%s: %s\n", smsg.NickName, smsg.Content)
 }
 
-func SMUserStatsBench(param []interface{}) {
-	// 0:msg 1:*user
-	smsg := param[0].(*proto.SMUserStats)
-	// user := param[1].(*logic.User)
+func SMUserStatsBench(ctx context.Context, s *logic.Session, smsg *proto.SMUserStats) {
 	// fmt.Printf("%s: %s\n", smsg.NickName, smsg.Stats)
 	fmt.Printf("%s\n", smsg.Stats)
 }
 
-func SMPopularWordBench(param []interface{}) {
-	// 0:msg 1:*user
-	smsg := param[0].(*proto.SMPopularWord)
-	// user := param[1].(*logic.User)
+func SMPopularWordBench(ctx context.Context, s *logic.Session, smsg *proto.SMPopularWord) {
 	fmt.Printf("%s\n", smsg.TheWord)
 }
 
@@ -2,11 +2,15 @@ package handler
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jinnblue/chatroom-test/internal/logic"
@@ -24,27 +28,120 @@ func NewClientHandle(prot tcp.Protocol) *ClientHandle {
 }
 
 func (h *ClientHandle) OnConnect(c *tcp.TCPConn) bool {
-	fmt.Println("connect chatroom successed")
-
-	nickname := getNickname()
-	h.user = logic.NewClientUser(c, nickname)
-	c.SetExtraData(h.user)
+	prev := h.user
+	if prev != nil && prev.ResumeToken != "" {
+		// 断线重连, 沿用昵称与聊天室并凭 token 恢复会话
+		fmt.Println("reconnect chatroom successed")
+		h.user = logic.NewClientUser(c, prev.Nickname)
+		h.user.ResumeToken = prev.ResumeToken
+		h.user.RoomId = prev.RoomId
+		h.user.LastSeq = prev.LastSeq
+	} else {
+		fmt.Println("connect chatroom successed")
+		h.user = logic.NewClientUser(c, "")
+	}
+	logic.NewSession(c, h.user)
+	activeUser.Store(h.user)
 
+	if h.user.ResumeToken == "" {
+		promptNickname(h.user)
+		return true
+	}
 	err := c.AsyncSendPacket(&proto.CMLogin{
-		NickName: nickname,
-		SendTime: time.Now().Unix(),
+		NickName:    h.user.Nickname,
+		SendTime:    time.Now().Unix(),
+		ResumeToken: h.user.ResumeToken,
 	})
 	return err == nil
 }
 
-func getNickname() string {
-	var nickname string
-	for len(nickname) <= 0 {
-		fmt.Println("please enter your NickName：")
-		fmt.Scanln(&nickname)
-		// nickname = "jinnblue"
+var (
+	activeUser atomic.Value // *logic.User 当前连接对应的用户, 重连后替换
+	chatting   int32        // 已进入聊天室, 输入作为聊天内容或命令
+
+	inputOnce sync.Once
+	promptMu  sync.Mutex
+	pending   *inputPrompt // 等待输入的提示, 新提示替换旧提示
+)
+
+// inputPrompt 等待用户输入的提示, accept 返回 false 时重新提示
+type inputPrompt struct {
+	user   *logic.User
+	hint   string
+	accept func(text string) bool
+}
+
+func currentUser() *logic.User {
+	return activeUser.Load().(*logic.User)
+}
+
+// prompt 提示用户输入, 输入由 readInput 交给 accept, 不阻塞消息处理
+func prompt(usr *logic.User, hint string, accept func(text string) bool) {
+	atomic.StoreInt32(&chatting, 0)
+	promptMu.Lock()
+	pending = &inputPrompt{user: usr, hint: hint, accept: accept}
+	promptMu.Unlock()
+	fmt.Println(hint)
+	inputOnce.Do(func() { go readInput() })
+}
+
+// readInput 标准输入唯一的读取协程: 有等待中的提示时交给提示, 已进入聊天室时作为聊天内容或命令
+func readInput() {
+	scan := bufio.NewScanner(os.Stdin)
+	for scan.Scan() {
+		text := strings.TrimSpace(scan.Text())
+		promptMu.Lock()
+		p := pending
+		promptMu.Unlock()
+		if p == nil {
+			if atomic.LoadInt32(&chatting) == 1 {
+				procEnterText(text)
+			}
+			continue
+		}
+		if p.user != currentUser() {
+			// 提示所属的连接已断开, 等待重连后的新提示
+			fmt.Println("SYSTEM: 连接已断开,正在重连")
+			continue
+		}
+		if !p.accept(text) {
+			fmt.Println(p.hint)
+			continue
+		}
+		promptMu.Lock()
+		if pending == p {
+			pending = nil
+		}
+		promptMu.Unlock()
 	}
-	return nickname
+}
+
+func promptNickname(usr *logic.User) {
+	prompt(usr, "please enter your NickName：", func(text string) bool {
+		if text == "" || strings.ContainsAny(text, " \t") {
+			return false
+		}
+		usr.Nickname = text
+		usr.AsyncSendMessage(&proto.CMLogin{
+			NickName: usr.Nickname,
+			SendTime: time.Now().Unix(),
+		})
+		return true
+	})
+}
+
+func promptRoomId(usr *logic.User) {
+	prompt(usr, "please enter roomId：", func(text string) bool {
+		roomId, err := strconv.ParseUint(text, 10, 32)
+		if err != nil || roomId == 0 {
+			return false
+		}
+		usr.RoomId = uint32(roomId)
+		usr.AsyncSendMessage(&proto.CMEnter{
+			RoomId: usr.RoomId,
+		})
+		return true
+	})
 }
 
 const HELP_HINT = `命令列表:
@@ -54,6 +151,9 @@ const HELP_HINT = `命令列表:
 			/exit                退出
 			/help                显示命令`
 
+// CALL_TIMEOUT 命令等待服务端响应的最长时间
+const CALL_TIMEOUT = 5 * time.Second
+
 const (
 	CMD_POPULAR = "/popular"
 	CMD_STATS   = "/stats"
@@ -73,63 +173,80 @@ func parseCmd(text string) (cmd, param string) {
 	return strings.ToLower(text), ""
 }
 
-func procEnterText(usr *logic.User) {
-	var msgtext string
-	scan := bufio.NewScanner(os.Stdin)
-	for scan.Scan() {
-		var cmsg tcp.Packet
-		msgtext = scan.Text()
-		if strings.IndexByte(msgtext, '/') == 0 {
-			// client GM cmd
-			cmd, param := parseCmd(msgtext)
-			// fmt.Println("text:", msgtext, " cmd:", cmd, " param:", param)
-			switch cmd {
-			case CMD_POPULAR:
-				_, err := strconv.Atoi(param)
-				if err != nil {
-					fmt.Println("roomId 必须为数字,示例: /popular [roomId]")
-					continue
-				}
-				cmsg = &proto.CMCommandGM{
-					CmdType: proto.POPULAR,
-					Param:   param,
-				}
-				usr.AsyncSendMessage(cmsg)
-			case CMD_STATS:
-				if param == "" {
-					fmt.Println("nickname 不可为空,示例: /stats [nickname]")
-					continue
-				}
-				cmsg = &proto.CMCommandGM{
-					CmdType: proto.STATS,
-					Param:   param,
-				}
-				usr.AsyncSendMessage(cmsg)
-			case CMD_LEAVE:
-				cmsg = &proto.CMLeave{}
-				usr.AsyncSendMessage(cmsg)
+// call 发送命令并等待对应的响应, 失败时提示并返回 nil
+func call(usr *logic.User, req tcp.Packet) tcp.Packet {
+	ctx, cancel := context.WithTimeout(context.Background(), CALL_TIMEOUT)
+	defer cancel()
+	resp, err := usr.Call(ctx, req)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			fmt.Println("SYSTEM: 请求超时,请稍后重试")
+		} else {
+			fmt.Printf("SYSTEM: 请求失败: %v\n", err)
+		}
+		return nil
+	}
+	return resp
+}
+
+// procEnterText 把一行输入发送到当前连接
+func procEnterText(msgtext string) {
+	var cmsg tcp.Packet
+	usr := currentUser()
+	if strings.IndexByte(msgtext, '/') == 0 {
+		// client GM cmd
+		cmd, param := parseCmd(msgtext)
+		// fmt.Println("text:", msgtext, " cmd:", cmd, " param:", param)
+		switch cmd {
+		case CMD_POPULAR:
+			_, err := strconv.Atoi(param)
+			if err != nil {
+				fmt.Println("roomId 必须为数字,示例: /popular [roomId]")
 				return
-			case CMD_HELP:
-				fmt.Println(HELP_HINT)
-			case CMD_EXIT:
-				os.Exit(0)
-			default:
-				fmt.Println("不支持的指令")
 			}
-		} else {
-			// client chat msg
-			cmsg = &proto.CMChat{
-				Content:  msgtext,
-				SendTime: time.Now().Unix(),
+			cmsg = &proto.CMCommandGM{
+				CmdType: proto.POPULAR,
+				Param:   param,
+			}
+			if resp, ok := call(usr, cmsg).(*proto.SMPopularWord); ok {
+				fmt.Printf("%s\n", resp.TheWord)
+			}
+		case CMD_STATS:
+			if param == "" {
+				fmt.Println("nickname 不可为空,示例: /stats [nickname]")
+				return
+			}
+			cmsg = &proto.CMCommandGM{
+				CmdType: proto.STATS,
+				Param:   param,
 			}
+			if resp, ok := call(usr, cmsg).(*proto.SMUserStats); ok {
+				fmt.Printf("%s\n", resp.Stats)
+			}
+		case CMD_LEAVE:
+			atomic.StoreInt32(&chatting, 0)
+			cmsg = &proto.CMLeave{}
 			usr.AsyncSendMessage(cmsg)
-			// log.Printf("procEnterText text:%s msg:%v\n", msgtext, cmsg)
+		case CMD_HELP:
+			fmt.Println(HELP_HINT)
+		case CMD_EXIT:
+			os.Exit(0)
+		default:
+			fmt.Println("不支持的指令")
 		}
+	} else {
+		// client chat msg
+		cmsg = &proto.CMChat{
+			Content:  msgtext,
+			SendTime: time.Now().Unix(),
+		}
+		usr.AsyncSendMessage(cmsg)
+		// log.Printf("procEnterText text:%s msg:%v\n", msgtext, cmsg)
 	}
 }
 
 func (h *ClientHandle) OnMessage(c *tcp.TCPConn, p tcp.Packet) bool {
-	err := h.prot.Route(p, c.GetExtraData()) // 0:msg 1:*user
+	err := h.prot.Route(p, logic.SessionOf(c))
 	if err != nil {
 		log.Printf("OnMessage error: %v\n", err)
 		return false
@@ -138,10 +255,16 @@ func (h *ClientHandle) OnMessage(c *tcp.TCPConn, p tcp.Packet) bool {
 }
 
 func (h *ClientHandle) OnClose(c *tcp.TCPConn) {
-	user := (c.GetExtraData()).(*logic.User)
+	user := logic.SessionOf(c).User()
 	log.Println("Disconnected: ", user)
 }
 
+// OnHandshakeFail 服务端拒绝握手(如协议版本不兼容), 提示原因后退出
+func (h *ClientHandle) OnHandshakeFail(err *tcp.HandshakeError) {
+	fmt.Println("服务器拒绝连接:", err.Reason)
+	os.Exit(1)
+}
+
 func (h *ClientHandle) SendChatContent(c string) {
 	cm := &proto.CMChat{
 		Content:  c,
@@ -150,110 +273,92 @@ func (h *ClientHandle) SendChatContent(c string) {
 	h.user.AsyncSendMessage(cm)
 }
 
-func getRoomId() uint32 {
-	var roomId uint32
-	for roomId <= 0 {
-		fmt.Println("please enter roomId：")
-		fmt.Scanln(&roomId)
-	}
-	return roomId
-}
-
-func SMRespLogin(param []interface{}) {
-	// 0:msg 1:*user
-	smsg := param[0].(*proto.SMRespLogin)
-	user := param[1].(*logic.User)
+func SMRespLogin(ctx context.Context, s *logic.Session, smsg *proto.SMRespLogin) {
+	user := s.User()
 	switch smsg.ErrCode {
 	case proto.LOGIN_OK:
 		{
+			user.ResumeToken = smsg.ResumeToken
+			if user.RoomId != 0 {
+				// 重连后回到原聊天室, 只补发断线期间的消息
+				fmt.Printf("SYSTEM: %s 重新登录成功\n", user.Nickname)
+				user.AsyncSendMessage(&proto.CMEnter{
+					RoomId:  user.RoomId,
+					LastSeq: user.LastSeq,
+				})
+				return
+			}
 			fmt.Printf("SYSTEM: %s 登录成功\n", user.Nickname)
 			fmt.Println(HELP_HINT)
-			user.RoomId = getRoomId()
-			user.AsyncSendMessage(&proto.CMEnter{
-				RoomId: user.RoomId,
-			})
+			promptRoomId(user)
 		}
 	case proto.NICK_NAME_EXIST:
 		{
 			fmt.Println("SYSTEM: 昵称已存在,请重新输入")
 			//client reset nickname
-			user.Nickname = getNickname()
-			user.AsyncSendMessage(&proto.CMLogin{
-				NickName: user.Nickname,
-				SendTime: time.Now().Unix(),
-			})
+			user.ResumeToken = ""
+			user.RoomId = 0
+			user.LastSeq = 0
+			promptNickname(user)
 		}
 	}
 }
 
-func SMRespEnter(param []interface{}) {
-	// 0:msg 1:*user
-	smsg := param[0].(*proto.SMRespEnter)
-	user := param[1].(*logic.User)
+func SMRespEnter(ctx context.Context, s *logic.Session, smsg *proto.SMRespEnter) {
+	user := s.User()
 	switch smsg.ErrCode {
 	case proto.ENTER_OK:
 		{
 			fmt.Printf("SYSTEM: %s 欢迎进入聊天室[%d]\n", user.Nickname, user.RoomId)
-			go procEnterText(user)
+			atomic.StoreInt32(&chatting, 1)
 		}
 	case proto.INVALID_ROOM_ID:
 		{
 			fmt.Println("SYSTEM: 无效的RoomId,请重新输入")
 			//client reset roomId
-			user.RoomId = getRoomId()
-			user.AsyncSendMessage(&proto.CMEnter{
-				RoomId: user.RoomId,
-			})
+			user.LastSeq = 0
+			promptRoomId(user)
 		}
 	}
 }
 
-func SMRespLeave(param []interface{}) {
-	// 0:msg 1:*user
-	smsg := param[0].(*proto.SMRespLeave)
-	user := param[1].(*logic.User)
+func SMRespLeave(ctx context.Context, s *logic.Session, smsg *proto.SMRespLeave) {
+	user := s.User()
 	switch smsg.ErrCode {
 	case proto.LEAVE_OK, proto.INVALID_ROOM_ID:
 		{
 			fmt.Printf("SYSTEM: 已离开聊天室[%d],请选择要进入的聊天室\n", user.RoomId)
-			user.RoomId = getRoomId()
-			user.AsyncSendMessage(&proto.CMEnter{
-				RoomId: user.RoomId,
-			})
+			user.LastSeq = 0
+			promptRoomId(user)
 		}
 	}
 }
 
-func SMUserEnter(param []interface{}) {
-	// 0:msg 1:*user
-	smsg := param[0].(*proto.SMUserEnter)
+func SMUserEnter(ctx context.Context, s *logic.Session, smsg *proto.SMUserEnter) {
 	fmt.Printf("SYSTEM: 用户 %s 加入了聊天室\n", smsg.NickName)
 }
 
-func SMUserLeave(param []interface{}) {
-	// 0:msg 1:*user
-	smsg := param[0].(*proto.SMUserLeave)
+func SMUserLeave(ctx context.Context, s *logic.Session, smsg *proto.SMUserLeave) {
 	fmt.Printf("SYSTEM: 用户 %s 离开了聊天室\n", smsg.NickName)
 }
 
-func SMChatContent(param []interface{}) {
-	// 0:msg 1:*user
-	smsg := param[0].(*proto.SMChatContent)
-	// user := param[1].(*logic.User)
+func SMChatContent(ctx context.Context, s *logic.Session, smsg *proto.SMChatContent) {
+	user := s.User()
+	if smsg.Seq > user.LastSeq {
+		user.LastSeq = smsg.Seq
+	}
 	fmt.Printf("%s: %s\n", smsg.NickName, smsg.Content)
 }
 
-func SMUserStats(param []interface{}) {
-	// 0:msg 1:*user
-	smsg := param[0].(*proto.SMUserStats)
-	// user := param[1].(*logic.User)
+func SMUserStats(ctx context.Context, s *logic.Session, smsg *proto.SMUserStats) {
 	// fmt.Printf("%s: %s\n", smsg.NickName, smsg.Stats)
 	fmt.Printf("%s\n", smsg.Stats)
 }
 
-func SMPopularWord(param []interface{}) {
-	// 0:msg 1:*user
-	smsg := param[0].(*proto.SMPopularWord)
-	// user := param[1].(*logic.User)
+func SMServerNotice(ctx context.Context, s *logic.Session, smsg *proto.SMServerNotice) {
+	fmt.Printf("SYSTEM: %s\n", smsg.Content)
+}
+
+func SMPopularWord(ctx context.Context, s *logic.Session, smsg *proto.SMPopularWord) {
 	fmt.Printf("%s\n", smsg.TheWord)
 }
@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"log"
+	"time"
+
+	"github.com/jinnblue/chatroom-test/internal/logic"
+	"github.com/jinnblue/chatroom-test/internal/proto"
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+)
+
+// 未登录时允许处理的消息
+var anonymousMsgs = map[string]bool{
+	proto.ID_CM_LOGIN: true,
+	proto.ID_CM_PONG:  true,
+}
+
+// RequireLogin 路由中间件, 丢弃未登录用户除登录、心跳外的消息
+func RequireLogin(next tcp.RouteFunc) tcp.RouteFunc {
+	return func(msgID string, msg interface{}, userData interface{}) error {
+		s, ok := userData.(*logic.Session)
+		if ok && s.User().Nickname == "" && !anonymousMsgs[msgID] {
+			log.Printf("drop %s before login: %v\n", msgID, s)
+			return nil
+		}
+		return next(msgID, msg, userData)
+	}
+}
+
+// LogSlow 记录处理时间超过 threshold 的消息
+func LogSlow(threshold time.Duration) tcp.Middleware {
+	return func(next tcp.MessageHandler) tcp.MessageHandler {
+		return func(c *tcp.TCPConn, msgID string, p tcp.Packet) bool {
+			start := time.Now()
+			ok := next(c, msgID, p)
+			if cost := time.Since(start); cost > threshold {
+				log.Printf("client:%d slow %s cost %v\n", c.OnlineIdx, msgID, cost)
+			}
+			return ok
+		}
+	}
+}
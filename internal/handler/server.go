@@ -1,9 +1,13 @@
 package handler
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"strconv"
+	"time"
 
 	"github.com/jinnblue/chatroom-test/internal/logic"
 	"github.com/jinnblue/chatroom-test/internal/proto"
@@ -21,14 +25,17 @@ func NewServerHandle(prot tcp.Protocol) *ServerHandle {
 func (h *ServerHandle) OnConnect(c *tcp.TCPConn) bool {
 	// new user
 	user := logic.NewServerUser(c)
-	c.SetExtraData(user)
+	logic.NewSession(c, user)
 	fmt.Printf("client:%d OnConnect: init user: %v\n", c.OnlineIdx, user)
+	if n := c.Negotiated(); n != nil {
+		fmt.Printf("client:%d negotiated %v\n", c.OnlineIdx, n)
+	}
 	return true
 }
 
 func (h *ServerHandle) OnMessage(c *tcp.TCPConn, p tcp.Packet) bool {
 	// log.Println("OnMessage client:", c.OnlineIdx)
-	err := h.prot.Route(p, c.GetExtraData()) // 0:msg 1:*user
+	err := h.prot.Route(p, logic.SessionOf(c))
 	if err != nil {
 		log.Printf("client:%d OnMessage error: %v\n", c.OnlineIdx, err)
 		return false
@@ -37,54 +44,100 @@ func (h *ServerHandle) OnMessage(c *tcp.TCPConn, p tcp.Packet) bool {
 }
 
 func (h *ServerHandle) OnClose(c *tcp.TCPConn) {
-	user := (c.GetExtraData()).(*logic.User)
-	log.Printf("client:%d OnClose: %v\n", c.OnlineIdx, user)
+	user := logic.SessionOf(c).User()
+	log.Printf("client:%d OnClose: %v dropped:%d reason:%v\n", c.OnlineIdx, user, c.Dropped(), c.CloseReason())
+	if cs := c.CompressStats(); cs.Enabled {
+		log.Printf("client:%d compress %v\n", c.OnlineIdx, cs)
+	}
 	logic.RoomAdmin().Logout(user)
 }
 
-func CMLogin(param []interface{}) {
-	// 0:msg 1:*user
-	cmsg := param[0].(*proto.CMLogin)
-	user := param[1].(*logic.User)
+// OnReject 连接数超限或旧客户端未握手, 告知客户端后关闭
+func (h *ServerHandle) OnReject(conn net.Conn, reason error) tcp.Packet {
+	code, content := proto.CONN_LIMITED, "服务器连接已满,请稍后重试"
+	switch {
+	case errors.Is(reason, tcp.ErrTooManyConnsPerIP):
+		content = "同一IP连接过多,请稍后重试"
+	case errors.Is(reason, tcp.ErrNoHandshake):
+		code, content = proto.HANDSHAKE_REQUIRED, "服务器要求版本握手,请升级客户端"
+	}
+	return &proto.SMServerNotice{
+		Code:     code,
+		Content:  content,
+		SendTime: time.Now().Unix(),
+	}
+}
 
+// OnThrottle 用户发送过快时通知客户端
+func (h *ServerHandle) OnThrottle(c *tcp.TCPConn, policy tcp.ThrottlePolicy) {
+	user := logic.SessionOf(c).User()
+	log.Printf("client:%d throttled (%v): %v\n", c.OnlineIdx, policy, user)
+
+	content := "发送过快,部分消息已被丢弃"
+	switch policy {
+	case tcp.THROTTLE_DELAY:
+		content = "发送过快,消息将被延迟处理"
+	case tcp.THROTTLE_DISCONNECT:
+		content = "发送过快,连接已被断开"
+	}
+	user.AsyncSendMessage(&proto.SMServerNotice{
+		Code:     proto.RATE_LIMITED,
+		Content:  content,
+		SendTime: time.Now().Unix(),
+	})
+}
+
+func CMLogin(ctx context.Context, s *logic.Session, cmsg *proto.CMLogin) {
+	user := s.User()
+
+	resume := proto.Supports(s.Conn(), proto.FEATURE_RESUME)
 	resp := &proto.SMRespLogin{ErrCode: proto.NICK_NAME_EXIST}
-	if logic.RoomAdmin().Login(cmsg.NickName, user) {
-		user.Nickname = cmsg.NickName
-		resp.ErrCode = proto.LOGIN_OK
+	if resume && cmsg.ResumeToken != "" && logic.RoomAdmin().Resume(cmsg.NickName, cmsg.ResumeToken, user) {
+		resp.Resumed = true
+	} else if !logic.RoomAdmin().Login(cmsg.NickName, user) {
+		user.Reply(cmsg, resp)
+		return
+	}
+	user.Nickname = cmsg.NickName
+	resp.ErrCode = proto.LOGIN_OK
+	if resume {
+		resp.ResumeToken = user.ResumeToken
 	}
-	user.AsyncSendMessage(resp)
+	user.Reply(cmsg, resp)
 }
 
-func CMEnter(param []interface{}) {
-	// 0:msg 1:*user
-	cmsg := param[0].(*proto.CMEnter)
-	user := param[1].(*logic.User)
+func CMEnter(ctx context.Context, s *logic.Session, cmsg *proto.CMEnter) {
+	user := s.User()
 
+	lastSeq := cmsg.LastSeq
+	if !proto.Supports(s.Conn(), proto.FEATURE_HISTORY) {
+		lastSeq = 0
+	}
 	resp := &proto.SMRespEnter{ErrCode: proto.INVALID_ROOM_ID}
-	if logic.RoomAdmin().EnterRoom(cmsg.RoomId, user) {
+	if logic.RoomAdmin().EnterRoom(cmsg.RoomId, user, lastSeq) {
 		user.RoomId = cmsg.RoomId
 		resp.ErrCode = proto.ENTER_OK
 	}
-	user.AsyncSendMessage(resp)
+	user.Reply(cmsg, resp)
 }
 
-func CMLeave(param []interface{}) {
-	// 0:msg 1:*user
-	// cmsg := param[0].(*proto.CMLeave)
-	user := param[1].(*logic.User)
+func CMLeave(ctx context.Context, s *logic.Session, cmsg *proto.CMLeave) {
+	user := s.User()
 
 	resp := &proto.SMRespLeave{ErrCode: proto.NOT_IN_ROOM}
 	if logic.RoomAdmin().LeaveRoom(user) {
 		user.RoomId = 0
 		resp.ErrCode = proto.LEAVE_OK
 	}
-	user.AsyncSendMessage(resp)
+	user.Reply(cmsg, resp)
+}
+
+func CMPong(ctx context.Context, s *logic.Session, cmsg *proto.CMPong) {
+	// 收到数据即已刷新连接读超时, 无需处理
 }
 
-func CMChat(param []interface{}) {
-	// 0:msg 1:*user
-	cmsg := param[0].(*proto.CMChat)
-	user := param[1].(*logic.User)
+func CMChat(ctx context.Context, s *logic.Session, cmsg *proto.CMChat) {
+	user := s.User()
 
 	smsg := &proto.SMChatContent{
 		NickName: user.Nickname,
@@ -95,10 +148,8 @@ func CMChat(param []interface{}) {
 	logic.RoomAdmin().ChatInRoom(user, smsg)
 }
 
-func CMCommandGM(param []interface{}) {
-	// 0:msg 1:*user
-	cmsg := param[0].(*proto.CMCommandGM)
-	user := param[1].(*logic.User)
+func CMCommandGM(ctx context.Context, s *logic.Session, cmsg *proto.CMCommandGM) {
+	user := s.User()
 
 	switch cmsg.CmdType {
 	case proto.POPULAR:
@@ -111,7 +162,7 @@ func CMCommandGM(param []interface{}) {
 			smsg := &proto.SMPopularWord{
 				TheWord: word,
 			}
-			user.AsyncSendMessage(smsg)
+			user.Reply(cmsg, smsg)
 		}
 	case proto.STATS:
 		{
@@ -120,7 +171,7 @@ func CMCommandGM(param []interface{}) {
 				NickName: cmsg.Param,
 				Stats:    s,
 			}
-			user.AsyncSendMessage(smsg)
+			user.Reply(cmsg, smsg)
 		}
 	}
 }
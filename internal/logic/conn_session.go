@@ -0,0 +1,45 @@
+package logic
+
+import (
+	"context"
+
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+)
+
+// Session 连接会话, OnConnect 时创建并绑定到连接, 作为消息处理函数的参数;
+// Context 在连接关闭时取消
+type Session struct {
+	conn *tcp.TCPConn
+	user *User
+}
+
+// NewSession 创建会话并绑定到连接
+func NewSession(conn *tcp.TCPConn, user *User) *Session {
+	s := &Session{conn: conn, user: user}
+	conn.SetExtraData(s)
+	return s
+}
+
+// SessionOf 连接绑定的会话, 未绑定时为 nil
+func SessionOf(conn *tcp.TCPConn) *Session {
+	s, _ := conn.GetExtraData().(*Session)
+	return s
+}
+
+// Context 实现 protocol.Session
+func (s *Session) Context() context.Context {
+	return s.conn.Context()
+}
+
+// User 会话的用户
+func (s *Session) User() *User {
+	return s.user
+}
+
+func (s *Session) Conn() *tcp.TCPConn {
+	return s.conn
+}
+
+func (s *Session) String() string {
+	return s.user.String()
+}
@@ -22,9 +22,14 @@ func (o *OfflineMsg) Save(msg *proto.SMChatContent) {
 }
 
 func (o *OfflineMsg) Send(user *User) {
+	o.SendAfter(user, 0)
+}
+
+// SendAfter 发送序号大于 seq 的离线消息, 用于断线重连补发
+func (o *OfflineMsg) SendAfter(user *User, seq uint64) {
 	o.recentRing.Do(func(val interface{}) {
 		msg, ok := val.(*proto.SMChatContent)
-		if ok {
+		if ok && msg.Seq > seq {
 			user.AsyncSendMessage(msg)
 		}
 	})
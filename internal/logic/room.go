@@ -13,6 +13,7 @@ import (
 	"github.com/jinnblue/chatroom-test/pkg/acascii"
 	"github.com/jinnblue/chatroom-test/pkg/pathmap"
 	"github.com/jinnblue/chatroom-test/pkg/popular"
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
 )
 
 const (
@@ -21,12 +22,14 @@ const (
 	MAX_OFFLINE_MSG     = 50
 	MAX_POPULAR_DURA    = 10 * time.Minute
 	DEFAULT_FILTER_FILE = "internal/data/list.txt"
+	RESUME_LOGOUT_WAIT  = 3 * time.Second // 断线重连等待旧连接登出的最长时间
 )
 
 // RoomManager 聊天室管理器
 type RoomManager struct {
 	allUsersMap sync.Map // map[string]*User 所有用户
 	roomsMap    sync.Map // map[int]*Room 所有聊天室
+	sessions    *SessionManager
 }
 
 func (rm *RoomManager) CreateRoom(num int) {
@@ -39,27 +42,68 @@ func (rm *RoomManager) CreateRoom(num int) {
 	}
 }
 
-// Login 登录,昵称必须唯一
+// Login 登录,昵称必须唯一, 成功后签发断线续连 token
 func (rm *RoomManager) Login(nickname string, usr *User) bool {
+	usr.ResumeToken = rm.sessions.Create(nickname)
 	_, exist := rm.allUsersMap.LoadOrStore(nickname, usr)
-	return !exist
+	if exist {
+		rm.sessions.Remove(usr.ResumeToken)
+		usr.ResumeToken = ""
+		return false
+	}
+	return true
+}
+
+// Resume 断线重连, 凭 token 恢复昵称; 服务端尚未发现旧连接断开时踢掉旧连接
+func (rm *RoomManager) Resume(nickname, token string, usr *User) bool {
+	if !rm.sessions.Valid(token, nickname) {
+		return false
+	}
+
+	if val, has := rm.allUsersMap.Load(nickname); has {
+		if old, ok := val.(*User); ok && old != usr {
+			// 关闭连接时登出并释放昵称; 旧连接可能正由其他协程关闭, Kick 会立即返回, 需等待登出完成
+			old.Kick()
+			select {
+			case <-old.loggedOut:
+			case <-time.After(RESUME_LOGOUT_WAIT):
+				log.Printf("Resume %s: old user logout timeout\n", nickname)
+			}
+		}
+	}
+
+	usr.ResumeToken = token
+	if !rm.sessions.Attach(token, nickname) {
+		return false
+	}
+	_, exist := rm.allUsersMap.LoadOrStore(nickname, usr)
+	if exist {
+		rm.sessions.Detach(token)
+		return false
+	}
+	return true
 }
 
-// Logout 登出
+// Logout 登出, 未进入聊天室的用户同样需要释放昵称, 会话保留一段时间供重连
 func (rm *RoomManager) Logout(usr *User) bool {
-	if rm.LeaveRoom(usr) {
+	defer usr.markLoggedOut()
+	rm.LeaveRoom(usr)
+	val, has := rm.allUsersMap.Load(usr.Nickname)
+	if has && val == usr {
 		rm.allUsersMap.Delete(usr.Nickname)
+		rm.sessions.Detach(usr.ResumeToken)
+		return true
 	}
 	return false
 }
 
-// EnterRoom 进入聊天室
-func (rm *RoomManager) EnterRoom(roomid uint32, usr *User) bool {
+// EnterRoom 进入聊天室, lastSeq 非0时只补发该序号之后的离线消息
+func (rm *RoomManager) EnterRoom(roomid uint32, usr *User, lastSeq uint64) bool {
 	val, has := rm.roomsMap.Load(roomid)
 	if has {
 		room, ok := val.(*Room)
 		if ok {
-			room.UserEntering(usr)
+			room.UserEntering(usr, lastSeq)
 			return true
 		}
 	}
@@ -118,37 +162,70 @@ func (rm *RoomManager) GetUserStats(nickname string) string {
 		if ok {
 			diff := time.Now().UTC().Sub(usr.EnterAt)
 			secs := diff / time.Second
-			return fmt.Sprintf("LoginAt: %s  Online: %ds  RoomId: %d", usr.EnterAt, secs, usr.RoomId)
+			s := fmt.Sprintf("LoginAt: %s  Online: %ds  RoomId: %d", usr.EnterAt, secs, usr.RoomId)
+			if cs := usr.CompressStats(); cs.Enabled {
+				s += fmt.Sprintf("  Compress: %v", cs)
+			}
+			return s
 		}
 	}
 	return ""
 }
 
+// Close 停止所有聊天室
 func (rm *RoomManager) Close() {
+	rm.closeRooms(nil)
+}
+
+// Shutdown 向每个聊天室广播停服通知, 处理完已排队的消息后停止聊天室
+func (rm *RoomManager) Shutdown(content string) {
+	rm.closeRooms(&proto.SMServerNotice{
+		Code:     proto.SERVER_SHUTDOWN,
+		Content:  content,
+		SendTime: time.Now().Unix(),
+	})
+}
+
+func (rm *RoomManager) closeRooms(notice *proto.SMServerNotice) {
+	rooms := make([]*Room, 0, ROOM_NUM)
 	rm.roomsMap.Range(func(id, val interface{}) bool {
 		room, ok := val.(*Room)
 		if ok {
-			room.Close()
+			room.shutdown(notice)
+			rooms = append(rooms, room)
 		}
 		return true
 	})
+	for _, room := range rooms {
+		<-room.doneChan
+	}
 }
 
-// MessageBuff 消息缓存
+// MessageBuff 待广播的聊天消息, 序号与编码在房间协程出队时生成
 type MessageBuff struct {
-	buff   []byte
+	sender *User
 	srcMsg *proto.SMChatContent
 }
 
+// enterReq 进入聊天室请求
+type enterReq struct {
+	user    *User
+	lastSeq uint64
+}
+
 // Room 单个聊天室
 type Room struct {
+	msgSeq     uint64 // 聊天消息序号, 用于断线重连补发, 仅由房间协程访问
 	ident      uint32
 	usersMap   sync.Map // map[string]*User
 	closeChan  chan struct{}
+	closeOnce  sync.Once
+	doneChan   chan struct{}
+	notice     *proto.SMServerNotice // 停服通知, 关闭前广播
 	popular    *popular.MostPopularWord
 	offlineMsg *OfflineMsg
 
-	enteringChannel chan *User
+	enteringChannel chan *enterReq
 	leavingChannel  chan *User
 	messageChannel  chan *MessageBuff
 }
@@ -161,9 +238,10 @@ func newChatRoom() *Room {
 		ident:           atomic.AddUint32(&globalIdent, 1),
 		usersMap:        sync.Map{},
 		closeChan:       make(chan struct{}),
+		doneChan:        make(chan struct{}),
 		popular:         popular.NewMostPopularWord(MAX_POPULAR_DURA),
 		offlineMsg:      NewOfflineMsg(MAX_OFFLINE_MSG),
-		enteringChannel: make(chan *User),
+		enteringChannel: make(chan *enterReq),
 		leavingChannel:  make(chan *User),
 		messageChannel:  make(chan *MessageBuff, MSG_QUEUE_LEN),
 	}
@@ -175,66 +253,114 @@ func (r *Room) GetPopularWord(past time.Duration) string {
 	return r.popular.GetTopWord(past)
 }
 
-func (r *Room) UserEntering(usr *User) {
-	r.enteringChannel <- usr
+func (r *Room) UserEntering(usr *User, lastSeq uint64) {
+	select {
+	case r.enteringChannel <- &enterReq{user: usr, lastSeq: lastSeq}:
+	case <-r.closeChan:
+	}
 }
 
 func (r *Room) UserLeaving(usr *User) {
-	r.leavingChannel <- usr
+	select {
+	case r.leavingChannel <- usr:
+	case <-r.closeChan:
+	}
 }
 
 func (r *Room) Broadcast(usr *User, msg *proto.SMChatContent) {
 	//xTODO content filter
 	msg.Content = trie.Filter(msg.Content)
 
-	buf, err := usr.BuildMessageBuf(msg)
-	if err != nil {
-		log.Println("entering BuildMessageBuf error:", err)
-		return
-	}
 	if len(r.messageChannel) >= MSG_QUEUE_LEN {
 		log.Println("Room messageChannel is full")
 	}
-	r.messageChannel <- &MessageBuff{buff: buf, srcMsg: msg}
+	select {
+	case r.messageChannel <- &MessageBuff{sender: usr, srcMsg: msg}:
+	case <-r.closeChan:
+	}
+}
+
+// stamp 出队时分配序号并编码, 保证广播与离线消息的顺序和序号一致; 仅由房间协程调用
+func (r *Room) stamp(m *MessageBuff) *tcp.SharedFrames {
+	r.msgSeq++
+	m.srcMsg.Seq = r.msgSeq
+	frames, err := m.sender.BuildFrames(m.srcMsg)
+	if err != nil {
+		log.Println("broadcast BuildFrames error:", err)
+		return nil
+	}
+	return frames
 }
 
-func (r *Room) broadsend(buf []byte, except string) {
+// broadsend 广播消息, 同一格式的接收者共享同一缓冲, 发送后释放房间持有的引用
+func (r *Room) broadsend(frames *tcp.SharedFrames, except string) {
 	r.usersMap.Range(func(name, val interface{}) bool {
 		user, ok := val.(*User)
 		if ok && (user.Nickname != except) {
-			user.AsyncSendBuff(buf)
+			user.AsyncSendFrames(frames)
 		}
 		return true
 	})
+	frames.Release()
 }
 
 func (r *Room) Start() {
+	defer close(r.doneChan)
+	for !r.run() {
+		// panic 后重新进入事件循环, 用户、离线消息等状态保留在 Room 中
+		log.Printf("Room %d restarted\n", r.ident)
+	}
+}
+
+// run 聊天室事件循环, 关闭时返回 true, 处理某条事件 panic 时返回 false
+func (r *Room) run() (closed bool) {
+	defer func() {
+		if tcp.LogPanic(fmt.Sprintf("Room %d", r.ident), recover()) {
+			closed = false
+		}
+	}()
+
 	for {
 		select {
 		case <-r.closeChan:
-			log.Println("Room go Closed")
-			return
-		case user := <-r.enteringChannel: // 新进入
+			r.drainMessages()
+			if r.notice != nil {
+				r.usersMap.Range(func(name, val interface{}) bool {
+					if user, ok := val.(*User); ok {
+						user.AsyncSendMessage(r.notice)
+					}
+					return true
+				})
+			}
+			log.Printf("Room %d go Closed\n", r.ident)
+			return true
+		case req := <-r.enteringChannel: // 新进入
 			{
-				r.usersMap.LoadOrStore(user.Nickname, user)
+				user := req.user
+				// 重连时旧连接可能尚未离开, 以新连接为准
+				r.usersMap.Store(user.Nickname, user)
 
 				// 发送离线消息
-				r.offlineMsg.Send(user)
+				r.offlineMsg.SendAfter(user, req.lastSeq)
 
 				// 通知其他用户
 				smsg := &proto.SMUserEnter{
 					NickName: user.Nickname,
 					SendTime: time.Now().Unix(),
 				}
-				buf, err := user.BuildMessageBuf(smsg)
+				frames, err := user.BuildFrames(smsg)
 				if err != nil {
-					log.Println("entering BuildMessageBuf error:", err)
-					return
+					log.Println("entering BuildFrames error:", err)
+					break
 				}
-				r.broadsend(buf, user.Nickname)
+				r.broadsend(frames, user.Nickname)
 			}
 		case user := <-r.leavingChannel: // 离开
 			{
+				if val, ok := r.usersMap.Load(user.Nickname); !ok || val != user {
+					// 已被重连的新连接替换
+					break
+				}
 				r.usersMap.Delete(user.Nickname)
 
 				// 通知其他用户
@@ -242,21 +368,25 @@ func (r *Room) Start() {
 					NickName: user.Nickname,
 					SendTime: time.Now().Unix(),
 				}
-				buf, err := user.BuildMessageBuf(smsg)
+				frames, err := user.BuildFrames(smsg)
 				if err != nil {
-					log.Println("entering BuildMessageBuf error:", err)
-					return
+					log.Println("leaving BuildFrames error:", err)
+					break
 				}
-				r.broadsend(buf, user.Nickname)
+				r.broadsend(frames, user.Nickname)
 			}
 		case m := <-r.messageChannel: // 广播
 			{
+				frames := r.stamp(m)
+				if frames == nil {
+					break
+				}
 				words := strings.Fields(m.srcMsg.Content)
 				for _, w := range words {
 					r.popular.Record(w)
 				}
 
-				r.broadsend(m.buff, m.srcMsg.NickName)
+				r.broadsend(frames, m.srcMsg.NickName)
 
 				// 离线消息保存
 				r.offlineMsg.Save(m.srcMsg)
@@ -265,8 +395,29 @@ func (r *Room) Start() {
 	}
 }
 
+// drainMessages 广播关闭前已排队的聊天消息
+func (r *Room) drainMessages() {
+	for {
+		select {
+		case m := <-r.messageChannel:
+			if frames := r.stamp(m); frames != nil {
+				r.broadsend(frames, m.srcMsg.NickName)
+			}
+		default:
+			return
+		}
+	}
+}
+
 func (r *Room) Close() {
-	r.closeChan <- struct{}{}
+	r.shutdown(nil)
+}
+
+func (r *Room) shutdown(notice *proto.SMServerNotice) {
+	r.closeOnce.Do(func() {
+		r.notice = notice
+		close(r.closeChan)
+	})
 }
 
 var (
@@ -278,6 +429,7 @@ var (
 func RoomAdmin() *RoomManager {
 	raonce.Do(func() {
 		rm = new(RoomManager)
+		rm.sessions = NewSessionManager(SESSION_TTL)
 		rm.CreateRoom(ROOM_NUM)
 	})
 	return rm
@@ -0,0 +1,113 @@
+package logic
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	SESSION_TTL          = 5 * time.Minute // 断线后会话保留时间
+	SESSION_SWEEP_PERIOD = time.Minute
+)
+
+// resumeSession 登录会话, 断线重连时凭 token 恢复昵称
+type resumeSession struct {
+	nickname string
+	expireAt time.Time // 零值表示在线
+}
+
+// SessionManager 管理登录时签发的续连 token
+type SessionManager struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	sessions  map[string]*resumeSession
+	lastSweep time.Time
+}
+
+func NewSessionManager(ttl time.Duration) *SessionManager {
+	return &SessionManager{
+		ttl:      ttl,
+		sessions: make(map[string]*resumeSession),
+	}
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Create 为 nickname 签发新 token
+func (sm *SessionManager) Create(nickname string) string {
+	token := newToken()
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.sweep()
+	sm.sessions[token] = &resumeSession{nickname: nickname}
+	return token
+}
+
+// Remove 删除会话
+func (sm *SessionManager) Remove(token string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	delete(sm.sessions, token)
+}
+
+// Valid 校验 token 属于 nickname 且未过期
+func (sm *SessionManager) Valid(token, nickname string) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.valid(token, nickname)
+}
+
+// Attach 校验 token 属于 nickname 且未过期, 成功后会话重新标记为在线
+func (sm *SessionManager) Attach(token, nickname string) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if !sm.valid(token, nickname) {
+		return false
+	}
+	sm.sessions[token].expireAt = time.Time{}
+	return true
+}
+
+func (sm *SessionManager) valid(token, nickname string) bool {
+	s, ok := sm.sessions[token]
+	if !ok || s.nickname != nickname {
+		return false
+	}
+	if !s.expireAt.IsZero() && time.Now().After(s.expireAt) {
+		delete(sm.sessions, token)
+		return false
+	}
+	return true
+}
+
+// Detach 连接断开, 会话在 ttl 内可被恢复
+func (sm *SessionManager) Detach(token string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if s, ok := sm.sessions[token]; ok {
+		s.expireAt = time.Now().Add(sm.ttl)
+	}
+}
+
+// sweep 清理过期会话, 调用方需持有锁
+func (sm *SessionManager) sweep() {
+	now := time.Now()
+	if now.Sub(sm.lastSweep) < SESSION_SWEEP_PERIOD {
+		return
+	}
+	sm.lastSweep = now
+	for token, s := range sm.sessions {
+		if !s.expireAt.IsZero() && now.After(s.expireAt) {
+			delete(sm.sessions, token)
+		}
+	}
+}
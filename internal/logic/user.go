@@ -1,9 +1,11 @@
 package logic
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -18,19 +20,33 @@ type User struct {
 	Nickname string
 	Addr     string
 	conn     *tcp.TCPConn
+
+	ProxyAddr string // 经负载均衡转发时为代理地址, Addr 为客户端真实地址
+
+	ResumeToken string // 断线续连 token, 登录成功时由服务端签发
+	LastSeq     uint64 // 客户端已收到的最后一条聊天消息序号
+
+	loggedOut  chan struct{} // Logout 完成后关闭
+	logoutOnce sync.Once
 }
 
 var globalUID int64 = 0
 
 func NewServerUser(conn *tcp.TCPConn) *User {
-	return &User{
+	u := &User{
 		IsNew:    true,
 		EnterAt:  time.Now(),
 		UID:      atomic.AddInt64(&globalUID, 1),
 		Nickname: "",
-		Addr:     conn.GetRawConn().RemoteAddr().String(),
+		Addr:     conn.RemoteAddr().String(),
 		conn:     conn,
+
+		loggedOut: make(chan struct{}),
+	}
+	if proxy := conn.ProxyAddr(); proxy != nil {
+		u.ProxyAddr = proxy.String()
 	}
+	return u
 }
 
 func NewClientUser(conn *tcp.TCPConn, nickname string) *User {
@@ -39,8 +55,10 @@ func NewClientUser(conn *tcp.TCPConn, nickname string) *User {
 		EnterAt:  time.Now(),
 		UID:      atomic.AddInt64(&globalUID, 1),
 		Nickname: nickname,
-		Addr:     conn.GetRawConn().LocalAddr().String(),
+		Addr:     conn.LocalAddr().String(),
 		conn:     conn,
+
+		loggedOut: make(chan struct{}),
 	}
 }
 
@@ -52,18 +70,57 @@ func (u *User) AsyncSendMessage(msg tcp.Packet) {
 	}
 }
 
-func (u *User) AsyncSendBuff(buf []byte) {
-	if err := u.conn.AsyncSendBuff(buf); err != nil {
+// Reply 回复请求 req, 响应带回请求序号
+func (u *User) Reply(req, resp tcp.Packet) {
+	u.AsyncSendMessage(tcp.ReplyTo(req, resp))
+}
+
+// Call 发送请求并等待响应, 超时由 ctx 控制
+func (u *User) Call(ctx context.Context, req tcp.Packet) (tcp.Packet, error) {
+	return u.conn.Call(ctx, req)
+}
+
+// AsyncSendFrames 发送广播帧, 不改变调用方持有的引用
+func (u *User) AsyncSendFrames(f *tcp.SharedFrames) {
+	if err := u.conn.AsyncSendFrames(f); err != nil {
 		if !errors.Is(err, tcp.ErrConnClosing) {
-			log.Printf("User.AsyncSendBuff user:%v  error:%v\n", u, err)
+			log.Printf("User.AsyncSendFrames user:%v  error:%v\n", u, err)
 		}
 	}
 }
 
-func (u *User) BuildMessageBuf(msg tcp.Packet) ([]byte, error) {
-	return u.conn.BuildMessageBuf(msg)
+// Dropped 因客户端接收过慢被丢弃的消息数
+func (u *User) Dropped() uint64 {
+	return u.conn.Dropped()
+}
+
+// CompressStats 连接的压缩统计
+func (u *User) CompressStats() tcp.CompressStats {
+	return u.conn.CompressStats()
+}
+
+// Kick 断开用户连接
+func (u *User) Kick() {
+	u.conn.Close()
+}
+
+// markLoggedOut Logout 完成, 唤醒等待该用户登出的 Resume
+func (u *User) markLoggedOut() {
+	u.logoutOnce.Do(func() { close(u.loggedOut) })
+}
+
+// BuildFrames 按本连接的格式预先编码广播消息, 其他格式在发送时按需编码; 用完后需 Release
+func (u *User) BuildFrames(msg tcp.Packet) (*tcp.SharedFrames, error) {
+	f := tcp.NewSharedFrames(msg)
+	if _, err := f.For(u.conn); err != nil {
+		return nil, err
+	}
+	return f, nil
 }
 
 func (u *User) String() string {
+	if u.ProxyAddr != "" {
+		return fmt.Sprintf("UID:%d  Nickname:%s  Addr:%s  Via:%s", u.UID, u.Nickname, u.Addr, u.ProxyAddr)
+	}
 	return fmt.Sprintf("UID:%d  Nickname:%s  Addr:%s", u.UID, u.Nickname, u.Addr)
 }
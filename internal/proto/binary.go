@@ -0,0 +1,151 @@
+package proto
+
+import (
+	"github.com/jinnblue/chatroom-test/pkg/tcp/protocol"
+)
+
+// 以下为 protocol.BinaryProtocol 使用的紧凑编码, 字段按声明顺序读写;
+// 新增字段只能追加在末尾, 并同时修改读写两端
+
+func (m *CMLogin) MarshalBinaryTo(w *protocol.BinaryWriter) {
+	w.Str(m.NickName)
+	w.Varint(m.SendTime)
+	w.Str(m.ResumeToken)
+}
+
+func (m *CMLogin) UnmarshalBinaryFrom(r *protocol.BinaryReader) {
+	m.NickName = r.Str()
+	m.SendTime = r.Varint()
+	m.ResumeToken = r.Str()
+}
+
+func (m *CMEnter) MarshalBinaryTo(w *protocol.BinaryWriter) {
+	w.Uvarint(uint64(m.RoomId))
+	w.Uvarint(m.LastSeq)
+}
+
+func (m *CMEnter) UnmarshalBinaryFrom(r *protocol.BinaryReader) {
+	m.RoomId = r.Uint32()
+	m.LastSeq = r.Uvarint()
+}
+
+func (m *CMLeave) MarshalBinaryTo(w *protocol.BinaryWriter)     {}
+func (m *CMLeave) UnmarshalBinaryFrom(r *protocol.BinaryReader) {}
+
+func (m *CMPong) MarshalBinaryTo(w *protocol.BinaryWriter)     {}
+func (m *CMPong) UnmarshalBinaryFrom(r *protocol.BinaryReader) {}
+
+func (m *CMChat) MarshalBinaryTo(w *protocol.BinaryWriter) {
+	w.Str(m.Content)
+	w.Varint(m.SendTime)
+}
+
+func (m *CMChat) UnmarshalBinaryFrom(r *protocol.BinaryReader) {
+	m.Content = r.Str()
+	m.SendTime = r.Varint()
+}
+
+func (m *CMCommandGM) MarshalBinaryTo(w *protocol.BinaryWriter) {
+	w.Varint(int64(m.CmdType))
+	w.Str(m.Param)
+}
+
+func (m *CMCommandGM) UnmarshalBinaryFrom(r *protocol.BinaryReader) {
+	m.CmdType = CommandType(r.Varint())
+	m.Param = r.Str()
+}
+
+func (m *SMRespLogin) MarshalBinaryTo(w *protocol.BinaryWriter) {
+	w.Varint(int64(m.ErrCode))
+	w.Str(m.ResumeToken)
+	w.Bool(m.Resumed)
+}
+
+func (m *SMRespLogin) UnmarshalBinaryFrom(r *protocol.BinaryReader) {
+	m.ErrCode = MsgErrCode(r.Varint())
+	m.ResumeToken = r.Str()
+	m.Resumed = r.Bool()
+}
+
+func (m *SMRespEnter) MarshalBinaryTo(w *protocol.BinaryWriter) {
+	w.Varint(int64(m.ErrCode))
+}
+
+func (m *SMRespEnter) UnmarshalBinaryFrom(r *protocol.BinaryReader) {
+	m.ErrCode = MsgErrCode(r.Varint())
+}
+
+func (m *SMRespLeave) MarshalBinaryTo(w *protocol.BinaryWriter) {
+	w.Varint(int64(m.ErrCode))
+}
+
+func (m *SMRespLeave) UnmarshalBinaryFrom(r *protocol.BinaryReader) {
+	m.ErrCode = MsgErrCode(r.Varint())
+}
+
+func (m *SMUserEnter) MarshalBinaryTo(w *protocol.BinaryWriter) {
+	w.Str(m.NickName)
+	w.Varint(m.SendTime)
+}
+
+func (m *SMUserEnter) UnmarshalBinaryFrom(r *protocol.BinaryReader) {
+	m.NickName = r.Str()
+	m.SendTime = r.Varint()
+}
+
+func (m *SMUserLeave) MarshalBinaryTo(w *protocol.BinaryWriter) {
+	w.Str(m.NickName)
+	w.Varint(m.SendTime)
+}
+
+func (m *SMUserLeave) UnmarshalBinaryFrom(r *protocol.BinaryReader) {
+	m.NickName = r.Str()
+	m.SendTime = r.Varint()
+}
+
+func (m *SMPing) MarshalBinaryTo(w *protocol.BinaryWriter)     {}
+func (m *SMPing) UnmarshalBinaryFrom(r *protocol.BinaryReader) {}
+
+func (m *SMChatContent) MarshalBinaryTo(w *protocol.BinaryWriter) {
+	w.Uvarint(m.Seq)
+	w.Str(m.NickName)
+	w.Str(m.Content)
+	w.Varint(m.SendTime)
+}
+
+func (m *SMChatContent) UnmarshalBinaryFrom(r *protocol.BinaryReader) {
+	m.Seq = r.Uvarint()
+	m.NickName = r.Str()
+	m.Content = r.Str()
+	m.SendTime = r.Varint()
+}
+
+func (m *SMUserStats) MarshalBinaryTo(w *protocol.BinaryWriter) {
+	w.Str(m.NickName)
+	w.Str(m.Stats)
+}
+
+func (m *SMUserStats) UnmarshalBinaryFrom(r *protocol.BinaryReader) {
+	m.NickName = r.Str()
+	m.Stats = r.Str()
+}
+
+func (m *SMServerNotice) MarshalBinaryTo(w *protocol.BinaryWriter) {
+	w.Varint(int64(m.Code))
+	w.Str(m.Content)
+	w.Varint(m.SendTime)
+}
+
+func (m *SMServerNotice) UnmarshalBinaryFrom(r *protocol.BinaryReader) {
+	m.Code = MsgErrCode(r.Varint())
+	m.Content = r.Str()
+	m.SendTime = r.Varint()
+}
+
+func (m *SMPopularWord) MarshalBinaryTo(w *protocol.BinaryWriter) {
+	w.Str(m.TheWord)
+}
+
+func (m *SMPopularWord) UnmarshalBinaryFrom(r *protocol.BinaryReader) {
+	m.TheWord = r.Str()
+}
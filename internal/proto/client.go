@@ -8,19 +8,26 @@ type ClientMsg = tcp.Message
 
 type CMLogin struct {
 	ClientMsg
-	NickName string
-	SendTime int64
+	NickName    string
+	SendTime    int64
+	ResumeToken string // 断线重连时携带上次登录签发的 token
 }
 
 type CMEnter struct {
 	ClientMsg
-	RoomId uint32
+	RoomId  uint32
+	LastSeq uint64 // 重连时已收到的最后一条消息序号, 只补发之后的消息
 }
 
 type CMLeave struct {
 	ClientMsg
 }
 
+// CMPong 客户端回复服务端心跳
+type CMPong struct {
+	ClientMsg
+}
+
 type CMChat struct {
 	ClientMsg
 	Content  string
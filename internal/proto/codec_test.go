@@ -0,0 +1,177 @@
+package proto_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/jinnblue/chatroom-test/internal/proto"
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+	"github.com/jinnblue/chatroom-test/pkg/tcp/protocol"
+)
+
+var codecs = []string{"gob", "gobstream", "json", "binary"}
+
+func newParser(tb testing.TB, codec string) *tcp.HeaderPacketParser {
+	prot, err := protocol.New(codec)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	proto.RegAllClientMsg(prot)
+	proto.RegAllServerMsg(prot)
+	return tcp.NewHeaderPacketParser(prot)
+}
+
+// newStreams 返回发送端与接收端各自的连接解析器, 接收端已读取发送端的前导帧
+func newStreams(tb testing.TB, codec string) (send, recv tcp.PacketParser) {
+	parser := newParser(tb, codec)
+	send, preamble := parser.NewStream()
+	recv, _ = parser.NewStream()
+	if preamble != nil {
+		defer preamble.Release()
+		if _, _, err := recv.(tcp.FrameDecoder).DecodeFrame(preamble.Bytes()); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return send, recv
+}
+
+func sampleMessages() []tcp.Packet {
+	return []tcp.Packet{
+		&proto.CMLogin{ClientMsg: tcp.Message{ReqSeq: 3}, NickName: "小明", SendTime: 1700000000, ResumeToken: "tok"},
+		&proto.CMEnter{RoomId: 5, LastSeq: 1 << 40},
+		&proto.CMLeave{},
+		&proto.CMPong{},
+		&proto.CMChat{Content: "hello, world", SendTime: -1},
+		&proto.CMCommandGM{ClientMsg: tcp.Message{ReqSeq: 1 << 31}, CmdType: proto.STATS, Param: "bob"},
+		&proto.SMRespLogin{ErrCode: proto.LOGIN_OK, ResumeToken: "tok", Resumed: true},
+		&proto.SMRespEnter{ErrCode: proto.INVALID_ROOM_ID},
+		&proto.SMRespLeave{ErrCode: proto.LEAVE_OK},
+		&proto.SMUserEnter{NickName: "bob", SendTime: 1700000000},
+		&proto.SMUserLeave{NickName: "bob", SendTime: 1700000000},
+		&proto.SMPing{},
+		chatContent(),
+		&proto.SMUserStats{NickName: "bob", Stats: "Online: 3s"},
+		&proto.SMPopularWord{TheWord: "go"},
+		&proto.SMServerNotice{Code: proto.SERVER_SHUTDOWN, Content: "bye", SendTime: 1700000000},
+	}
+}
+
+func chatContent() *proto.SMChatContent {
+	return &proto.SMChatContent{
+		Seq:      42,
+		NickName: "Client_00001",
+		Content:  "Client benchmark test say hello to everyone in the room",
+		SendTime: 1700000000,
+	}
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	for _, codec := range codecs {
+		send, recv := newStreams(t, codec)
+		for _, msg := range sampleMessages() {
+			frame, err := send.BuildPacketBuf(msg)
+			if err != nil {
+				t.Fatalf("%s: build %T: %v", codec, msg, err)
+			}
+			got, n, err := recv.(tcp.FrameDecoder).DecodeFrame(frame)
+			if err != nil || n != len(frame) {
+				t.Fatalf("%s: decode %T: n=%d err=%v", codec, msg, n, err)
+			}
+			if !reflect.DeepEqual(got, msg) {
+				t.Fatalf("%s: decoded %+v, want %+v", codec, got, msg)
+			}
+		}
+	}
+}
+
+func TestWireIDs(t *testing.T) {
+	if err := protocol.CheckWireIDs(append(proto.ClientMsgs(), proto.ServerMsgs()...)...); err != nil {
+		t.Fatal(err)
+	}
+	for _, codec := range codecs {
+		frame, err := newParser(t, codec).BuildPacketBuf(chatContent())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(frame, []byte("chatroom-test")) {
+			t.Fatalf("%s: frame %q contains go package path", codec, frame)
+		}
+		// gob 类型描述(含流模式的前导帧)同样不含 Go 类型名
+		_, preamble := newParser(t, codec).NewStream()
+		if preamble != nil {
+			frame = append(frame, preamble.Bytes()...)
+			preamble.Release()
+		}
+		for _, msg := range append(proto.ClientMsgs(), proto.ServerMsgs()...) {
+			name := reflect.TypeOf(msg).Elem().Name()
+			if bytes.Contains(frame, []byte(name)) {
+				t.Fatalf("%s: frame %q contains go type name %s", codec, frame, name)
+			}
+		}
+		for _, name := range []string{"Message", "ClientMsg", "MsgErrCode", "CommandType"} {
+			if bytes.Contains(frame, []byte(name)) {
+				t.Fatalf("%s: frame %q contains go type name %s", codec, frame, name)
+			}
+		}
+	}
+}
+
+func TestBinaryTruncated(t *testing.T) {
+	prot := protocol.NewBinaryProtocol()
+	proto.RegAllServerMsg(prot)
+	data, err := prot.Marshal(chatContent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(data); i++ {
+		if _, err := prot.Unmarshal(data[:i]); err == nil {
+			t.Fatalf("unmarshal %d of %d bytes succeeded", i, len(data))
+		}
+	}
+	if _, err := prot.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 对比各编码的帧长度与编解码耗时:
+// go test ./internal/proto -run XXX -bench Codec -benchmem
+func BenchmarkCodecEncode(b *testing.B) {
+	for _, codec := range codecs {
+		b.Run(codec, func(b *testing.B) {
+			parser := newParser(b, codec)
+			msg := chatContent()
+			b.ReportAllocs()
+			size := 0
+			for i := 0; i < b.N; i++ {
+				sb, err := parser.BuildSharedBuf(msg)
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = sb.Len()
+				sb.Release()
+			}
+			b.ReportMetric(float64(size), "B/frame")
+		})
+	}
+}
+
+func BenchmarkCodecDecode(b *testing.B) {
+	for _, codec := range codecs {
+		b.Run(codec, func(b *testing.B) {
+			send, recv := newStreams(b, codec)
+			frame, err := send.BuildPacketBuf(chatContent())
+			if err != nil {
+				b.Fatal(err)
+			}
+			dec := recv.(tcp.FrameDecoder)
+			b.ReportAllocs()
+			b.ReportMetric(float64(len(frame)), "B/frame")
+			for i := 0; i < b.N; i++ {
+				if _, _, err := dec.DecodeFrame(frame); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
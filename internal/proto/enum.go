@@ -0,0 +1,75 @@
+package proto
+
+import "fmt"
+
+// enumInfo 枚举值的名称与说明, 用于日志与协议文档
+type enumInfo struct {
+	name, desc string
+}
+
+var errCodeInfo = [...]enumInfo{
+	UNKNOW:             {"UNKNOW", "未知错误"},
+	LOGIN_OK:           {"LOGIN_OK", "登录成功"},
+	NICK_NAME_EXIST:    {"NICK_NAME_EXIST", "昵称已被使用"},
+	ENTER_OK:           {"ENTER_OK", "进入聊天室成功"},
+	INVALID_ROOM_ID:    {"INVALID_ROOM_ID", "聊天室不存在"},
+	LEAVE_OK:           {"LEAVE_OK", "离开聊天室成功"},
+	NOT_IN_ROOM:        {"NOT_IN_ROOM", "不在聊天室中"},
+	SERVER_SHUTDOWN:    {"SERVER_SHUTDOWN", "服务器即将关闭"},
+	RATE_LIMITED:       {"RATE_LIMITED", "发送过快, 已被限速或断开"},
+	CONN_LIMITED:       {"CONN_LIMITED", "连接数超限"},
+	HANDSHAKE_REQUIRED: {"HANDSHAKE_REQUIRED", "服务端要求版本握手, 客户端需升级"},
+}
+
+// ErrCodes 全部错误码
+func ErrCodes() []MsgErrCode {
+	codes := make([]MsgErrCode, len(errCodeInfo))
+	for i := range codes {
+		codes[i] = MsgErrCode(i)
+	}
+	return codes
+}
+
+func (c MsgErrCode) String() string {
+	if c >= 0 && int(c) < len(errCodeInfo) {
+		return errCodeInfo[c].name
+	}
+	return fmt.Sprintf("MsgErrCode(%d)", int(c))
+}
+
+// Desc 错误码说明
+func (c MsgErrCode) Desc() string {
+	if c >= 0 && int(c) < len(errCodeInfo) {
+		return errCodeInfo[c].desc
+	}
+	return ""
+}
+
+var commandInfo = [...]enumInfo{
+	POPULAR: {"POPULAR", "/popular 查询聊天室热词, Param 为聊天室 id"},
+	STATS:   {"STATS", "/stats 查询用户信息, Param 为昵称"},
+}
+
+// CommandTypes 全部 GM 命令
+func CommandTypes() []CommandType {
+	cmds := make([]CommandType, len(commandInfo))
+	for i := range cmds {
+		cmds[i] = CommandType(i)
+	}
+	return cmds
+}
+
+func (c CommandType) String() string {
+	if c >= 0 && int(c) < len(commandInfo) {
+		return commandInfo[c].name
+	}
+	return fmt.Sprintf("CommandType(%d)", int(c))
+}
+
+// Desc 命令说明
+func (c CommandType) Desc() string {
+	if c >= 0 && int(c) < len(commandInfo) {
+		return commandInfo[c].desc
+	}
+	return ""
+}
@@ -0,0 +1,40 @@
+package proto
+
+// 消息线上标识, 客户端与服务端消息共用一个命名空间, 须互不重复(RegAll*Msg 启动时检查);
+// 各编码格式只使用标识, Go 类型改名不影响线上格式, 修改标识则需递增 PROTO_VERSION
+const (
+	ID_CM_LOGIN         = "chat.login"
+	ID_CM_ENTER         = "chat.enter"
+	ID_CM_LEAVE         = "chat.leave"
+	ID_CM_PONG          = "chat.pong"
+	ID_CM_CHAT          = "chat.chat"
+	ID_CM_COMMAND_GM    = "chat.gm"
+	ID_SM_RESP_LOGIN    = "chat.login.resp"
+	ID_SM_RESP_ENTER    = "chat.enter.resp"
+	ID_SM_RESP_LEAVE    = "chat.leave.resp"
+	ID_SM_USER_ENTER    = "chat.user.enter"
+	ID_SM_USER_LEAVE    = "chat.user.leave"
+	ID_SM_PING          = "chat.ping"
+	ID_SM_CHAT_CONTENT  = "chat.content"
+	ID_SM_USER_STATS    = "chat.stats"
+	ID_SM_POPULAR_WORD  = "chat.popular"
+	ID_SM_SERVER_NOTICE = "chat.notice"
+)
+
+func (*CMLogin) WireID() string     { return ID_CM_LOGIN }
+func (*CMEnter) WireID() string     { return ID_CM_ENTER }
+func (*CMLeave) WireID() string     { return ID_CM_LEAVE }
+func (*CMPong) WireID() string      { return ID_CM_PONG }
+func (*CMChat) WireID() string      { return ID_CM_CHAT }
+func (*CMCommandGM) WireID() string { return ID_CM_COMMAND_GM }
+
+func (*SMRespLogin) WireID() string    { return ID_SM_RESP_LOGIN }
+func (*SMRespEnter) WireID() string    { return ID_SM_RESP_ENTER }
+func (*SMRespLeave) WireID() string    { return ID_SM_RESP_LEAVE }
+func (*SMUserEnter) WireID() string    { return ID_SM_USER_ENTER }
+func (*SMUserLeave) WireID() string    { return ID_SM_USER_LEAVE }
+func (*SMPing) WireID() string         { return ID_SM_PING }
+func (*SMChatContent) WireID() string  { return ID_SM_CHAT_CONTENT }
+func (*SMUserStats) WireID() string    { return ID_SM_USER_STATS }
+func (*SMPopularWord) WireID() string  { return ID_SM_POPULAR_WORD }
+func (*SMServerNotice) WireID() string { return ID_SM_SERVER_NOTICE }
@@ -1,24 +1,61 @@
 package proto
 
 import (
+	"log"
+	"sync"
+
 	"github.com/jinnblue/chatroom-test/pkg/tcp/protocol"
 )
 
-func RegAllClientMsg(prot *protocol.GobProtocol) {
-	prot.Register(&CMLogin{})
-	prot.Register(&CMEnter{})
-	prot.Register(&CMLeave{})
-	prot.Register(&CMChat{})
-	prot.Register(&CMCommandGM{})
+// ClientMsgs 客户端发往服务端的全部消息
+func ClientMsgs() []interface{} {
+	return []interface{}{
+		&CMLogin{},
+		&CMEnter{},
+		&CMLeave{},
+		&CMPong{},
+		&CMChat{},
+		&CMCommandGM{},
+	}
+}
+
+// ServerMsgs 服务端发往客户端的全部消息
+func ServerMsgs() []interface{} {
+	return []interface{}{
+		&SMRespLogin{},
+		&SMRespEnter{},
+		&SMRespLeave{},
+		&SMUserEnter{},
+		&SMUserLeave{},
+		&SMPing{},
+		&SMChatContent{},
+		&SMUserStats{},
+		&SMPopularWord{},
+		&SMServerNotice{},
+	}
+}
+
+var checkOnce sync.Once
+
+// checkWireIDs 两端各自只注册一部分消息, 启动时统一检查全部消息的线上标识
+func checkWireIDs() {
+	checkOnce.Do(func() {
+		if err := protocol.CheckWireIDs(append(ClientMsgs(), ServerMsgs()...)...); err != nil {
+			log.Fatal(err)
+		}
+	})
+}
+
+func RegAllClientMsg(prot protocol.Protocol) {
+	checkWireIDs()
+	for _, msg := range ClientMsgs() {
+		prot.Register(msg)
+	}
 }
 
-func RegAllServerMsg(prot *protocol.GobProtocol) {
-	prot.Register(&SMRespLogin{})
-	prot.Register(&SMRespEnter{})
-	prot.Register(&SMRespLeave{})
-	prot.Register(&SMUserEnter{})
-	prot.Register(&SMUserLeave{})
-	prot.Register(&SMChatContent{})
-	prot.Register(&SMUserStats{})
-	prot.Register(&SMPopularWord{})
+func RegAllServerMsg(prot protocol.Protocol) {
+	checkWireIDs()
+	for _, msg := range ServerMsgs() {
+		prot.Register(msg)
+	}
 }
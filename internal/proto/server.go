@@ -16,11 +16,17 @@ const (
 	INVALID_ROOM_ID
 	LEAVE_OK
 	NOT_IN_ROOM
+	SERVER_SHUTDOWN
+	RATE_LIMITED
+	CONN_LIMITED
+	HANDSHAKE_REQUIRED
 )
 
 type SMRespLogin struct {
 	ServerMsg
-	ErrCode MsgErrCode
+	ErrCode     MsgErrCode
+	ResumeToken string // 断线重连凭证
+	Resumed     bool   // 是否通过 ResumeToken 恢复了会话
 }
 
 type SMRespEnter struct {
@@ -45,9 +51,15 @@ type SMUserLeave struct {
 	SendTime int64
 }
 
+// SMPing 服务端心跳, 客户端需回复 CMPong
+type SMPing struct {
+	ServerMsg
+}
+
 type SMChatContent struct {
 	ServerMsg
 	userUID      int64
+	Seq          uint64 // 聊天室内消息序号
 	NickName     string
 	Content      string
 	orignContent string
@@ -68,6 +80,14 @@ type SMUserStats struct {
 	Stats    string
 }
 
+// SMServerNotice 服务端系统通知, 如停服
+type SMServerNotice struct {
+	ServerMsg
+	Code     MsgErrCode
+	Content  string
+	SendTime int64
+}
+
 type SMPopularWord struct {
 	ServerMsg
 	TheWord string
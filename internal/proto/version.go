@@ -0,0 +1,36 @@
+package proto
+
+import (
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+)
+
+// 协议版本, 增删消息或修改字段时递增 PROTO_VERSION;
+// 仍能兼容的最老版本为 PROTO_MIN_VERSION
+const (
+	PROTO_VERSION     uint16 = 2
+	PROTO_MIN_VERSION uint16 = 2
+)
+
+// 功能位, 握手时取两端都支持的部分
+const (
+	FEATURE_RESUME  uint32 = 1 << iota // 凭 ResumeToken 恢复会话
+	FEATURE_HISTORY                    // 进入房间时只补发 LastSeq 之后的离线消息
+
+	FEATURE_ALL = FEATURE_RESUME | FEATURE_HISTORY
+)
+
+// NewHandshake 本版本协议的握手配置, codecs 按优先顺序
+func NewHandshake(codecs ...tcp.Codec) tcp.Handshake {
+	return tcp.Handshake{
+		Version:    PROTO_VERSION,
+		MinVersion: PROTO_MIN_VERSION,
+		Codecs:     codecs,
+		Features:   FEATURE_ALL,
+	}
+}
+
+// Supports 连接是否可使用功能 f, 未握手的旧客户端视为支持
+func Supports(c *tcp.TCPConn, f uint32) bool {
+	n := c.Negotiated()
+	return n == nil || n.Has(f)
+}
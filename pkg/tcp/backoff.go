@@ -0,0 +1,44 @@
+package tcp
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	DEFAULT_RECONNECT_MIN = 500 * time.Millisecond
+	DEFAULT_RECONNECT_MAX = 30 * time.Second
+)
+
+// backoff 带抖动的指数退避, 每次等待时间在 [d/2, d) 之间, d 从 min 开始翻倍直到 max
+type backoff struct {
+	min, max time.Duration
+	cur      time.Duration
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	if min <= 0 {
+		min = DEFAULT_RECONNECT_MIN
+	}
+	if max < min {
+		max = min
+	}
+	return &backoff{min: min, max: max}
+}
+
+func (b *backoff) Next() time.Duration {
+	if b.cur == 0 {
+		b.cur = b.min
+	} else {
+		b.cur *= 2
+		if b.cur > b.max {
+			b.cur = b.max
+		}
+	}
+	half := b.cur / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func (b *backoff) Reset() {
+	b.cur = 0
+}
@@ -0,0 +1,116 @@
+package tcp
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrNotSequenced = errors.New("packet does not carry request sequence")
+
+// REQ_SEQ_RESPONSE 请求序号的最高位, 由 ReplyTo 设置, 表示该包是响应;
+// 两端各自为 Call 编号, 只有带该位的包才会与本端等待中的请求关联, 对端的请求不会被误当作响应
+const REQ_SEQ_RESPONSE uint32 = 1 << 31
+
+// Sequenced 携带请求序号的消息, 嵌入 Message 即可; 响应带回请求序号并设置 REQ_SEQ_RESPONSE, 用于关联请求与响应
+type Sequenced interface {
+	GetReqSeq() uint32
+	SetReqSeq(seq uint32)
+}
+
+func (m *Message) GetReqSeq() uint32 {
+	return m.ReqSeq
+}
+
+func (m *Message) SetReqSeq(seq uint32) {
+	m.ReqSeq = seq
+}
+
+// ReplyTo 把请求序号复制到响应并标记为响应, 返回 resp; 回复请求时使用, req 不是请求时 resp 不变
+func ReplyTo(req, resp Packet) Packet {
+	rq, ok1 := req.(Sequenced)
+	rs, ok2 := resp.(Sequenced)
+	if ok1 && ok2 {
+		if seq := rq.GetReqSeq(); seq != 0 && seq&REQ_SEQ_RESPONSE == 0 {
+			rs.SetReqSeq(seq | REQ_SEQ_RESPONSE)
+		}
+	}
+	return resp
+}
+
+// pendingCalls 等待响应的请求
+type pendingCalls struct {
+	mu    sync.Mutex
+	seq   uint32
+	calls map[uint32]chan Packet
+}
+
+func (pc *pendingCalls) add() (uint32, chan Packet) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.calls == nil {
+		pc.calls = make(map[uint32]chan Packet)
+	}
+	// 0 表示非请求消息, 最高位留给响应标记
+	pc.seq = (pc.seq + 1) &^ REQ_SEQ_RESPONSE
+	if pc.seq == 0 {
+		pc.seq++
+	}
+	ch := make(chan Packet, 1)
+	pc.calls[pc.seq] = ch
+	return pc.seq, ch
+}
+
+func (pc *pendingCalls) remove(seq uint32) chan Packet {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	ch, ok := pc.calls[seq]
+	if ok {
+		delete(pc.calls, seq)
+	}
+	return ch
+}
+
+// Call 发送请求并等待序号相同的响应, ctx 取消或超时、连接关闭时返回错误;
+// 响应直接返回给调用方, 不再交给 Handler.OnMessage. 不可在处理消息的协程(OnMessage)中调用
+func (c *TCPConn) Call(ctx context.Context, req Packet) (Packet, error) {
+	sq, ok := req.(Sequenced)
+	if !ok {
+		return nil, ErrNotSequenced
+	}
+	seq, ch := c.calls.add()
+	defer c.calls.remove(seq)
+
+	sq.SetReqSeq(seq)
+	if err := c.AsyncSendPacket(req); err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.closeChan:
+		return nil, ErrConnClosing
+	}
+}
+
+// resolveCall 收到的包是 Call 等待的响应时交给调用方, 返回 true
+func (c *TCPConn) resolveCall(p Packet) bool {
+	sq, ok := p.(Sequenced)
+	if !ok {
+		return false
+	}
+	seq := sq.GetReqSeq()
+	if seq&REQ_SEQ_RESPONSE == 0 {
+		// 非请求消息或对端发来的请求
+		return false
+	}
+	ch := c.calls.remove(seq &^ REQ_SEQ_RESPONSE)
+	if ch == nil {
+		// 已超时的请求, 按普通消息处理
+		return false
+	}
+	ch <- p
+	return true
+}
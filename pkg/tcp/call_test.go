@@ -0,0 +1,117 @@
+package tcp_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+)
+
+// silentHandler 不回复任何消息
+type silentHandler struct {
+	echoHandler
+}
+
+func (h *silentHandler) OnMessage(c *tcp.TCPConn, p tcp.Packet) bool {
+	return true
+}
+
+func dialCallClient(t *testing.T, addr string) (*connRecvHandler, *tcp.TCPConn) {
+	t.Helper()
+	h := &connRecvHandler{recvHandler: newRecvHandler("hello"), conns: make(chan *tcp.TCPConn, 1)}
+	client := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newTestParser(), tcp.WithSendChanLimit(32)))
+	client.Start()
+	t.Cleanup(client.Close)
+	select {
+	case c := <-h.conns:
+		return h, c
+	case <-time.After(3 * time.Second):
+		t.Fatal("client connect timeout")
+	}
+	return nil, nil
+}
+
+func TestCall(t *testing.T) {
+	_, _, addr := startTestServer(t, tcp.WithSendChanLimit(32))
+	h, c := dialCallClient(t, addr)
+	// 非 Call 的消息照常交给 OnMessage
+	waitRecv(t, h.recvHandler, "hello")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+			text := fmt.Sprint("req-", i)
+			resp, err := c.Call(ctx, &echoMsg{Text: text})
+			if err != nil {
+				errs <- err
+				return
+			}
+			if got := resp.(*echoMsg).Text; got != text {
+				errs <- fmt.Errorf("call %q got %q", text, got)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	select {
+	case got := <-h.recv:
+		t.Fatalf("response %q also routed to OnMessage", got)
+	default:
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	_, addr := startServer(t, &silentHandler{})
+
+	_, c := dialCallClient(t, addr)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Call(ctx, &echoMsg{Text: "anyone?"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("call err %v, want deadline exceeded", err)
+	}
+
+	c.Close()
+	if _, err := c.Call(context.Background(), &echoMsg{Text: "closed"}); err != tcp.ErrConnClosing {
+		t.Fatalf("call on closed conn err %v, want ErrConnClosing", err)
+	}
+}
+
+// askBackHandler 收到请求后先用相同序号向对端发起自己的请求, 再回复
+type askBackHandler struct {
+	echoHandler
+}
+
+func (h *askBackHandler) OnMessage(c *tcp.TCPConn, p tcp.Packet) bool {
+	req := p.(*echoMsg)
+	c.AsyncSendPacket(&echoMsg{Message: tcp.Message{ReqSeq: req.ReqSeq}, Text: "server request"})
+	return c.AsyncSendPacket(tcp.ReplyTo(req, &echoMsg{Text: req.Text})) == nil
+}
+
+// TestCallIgnoresPeerRequest 对端请求的序号与本端等待中的 Call 相同时, 不被当作响应
+func TestCallIgnoresPeerRequest(t *testing.T) {
+	_, addr := startServer(t, &askBackHandler{})
+	h, c := dialCallClient(t, addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	resp, err := c.Call(ctx, &echoMsg{Text: "mine"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.(*echoMsg).Text; got != "mine" {
+		t.Fatalf("call got %q, want mine", got)
+	}
+	waitRecv(t, h.recvHandler, "server request")
+}
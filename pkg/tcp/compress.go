@@ -0,0 +1,260 @@
+package tcp
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// 压缩协商: 客户端连接后先发送一个空负载帧(offer)表示支持压缩帧; 开启压缩的服务端收到后
+// 回复一个空负载帧(ack), 此后发往该客户端的帧带标志字节; 客户端收到 ack 后再发送一个空负载帧,
+// 此后发出的帧带标志字节. 未开启压缩的服务端忽略 offer 不回复, 双方保持原有帧格式;
+// 未发送 offer 的旧客户端同样保持原有帧格式.
+//
+// | len | flag | data |, flag 的 FRAME_FLAG_FLATE 位表示 data 经 flate 压缩
+const (
+	FRAME_FLAG_FLATE byte = 1 << 0
+
+	DEFAULT_COMPRESS_LEVEL     = flate.BestSpeed
+	DEFAULT_COMPRESS_THRESHOLD = 256 // 负载小于该字节数时不压缩
+)
+
+var ErrCompressFrame = errors.New("invalid compressed frame")
+
+// PayloadParser PacketParser 可选实现, 按负载读写帧, 压缩帧需要
+type PayloadParser interface {
+	ReadPayload(r io.Reader) ([]byte, error)
+	SplitFrame(data []byte) (payload []byte, n int, err error)
+	DecodePayload(payload []byte) (Packet, error)
+	BuildFrameBuf(fill func(buf *bytes.Buffer) error) (*SharedBuf, error)
+	MaxFrameSize() int
+}
+
+// CompressStats 连接协商压缩后的收发统计, Raw 为压缩前帧大小, Wire 为实际传输的帧大小
+type CompressStats struct {
+	Enabled bool // 收发任一方向已使用压缩帧
+	RawIn   uint64
+	WireIn  uint64
+	RawOut  uint64
+	WireOut uint64
+}
+
+// InRatio 接收方向压缩率(传输/原始), 无数据时为 1
+func (s CompressStats) InRatio() float64 {
+	if s.RawIn == 0 {
+		return 1
+	}
+	return float64(s.WireIn) / float64(s.RawIn)
+}
+
+// OutRatio 发送方向压缩率(传输/原始), 无数据时为 1
+func (s CompressStats) OutRatio() float64 {
+	if s.RawOut == 0 {
+		return 1
+	}
+	return float64(s.WireOut) / float64(s.RawOut)
+}
+
+func (s CompressStats) String() string {
+	return fmt.Sprintf("in %d/%d(%.2f) out %d/%d(%.2f)",
+		s.WireIn, s.RawIn, s.InRatio(), s.WireOut, s.RawOut, s.OutRatio())
+}
+
+// deflaters 各压缩级别的 flate.Writer 池, 创建开销较大需复用
+var deflaters [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+func getDeflater(level int, w io.Writer) *flate.Writer {
+	if fw, ok := deflaters[level-flate.HuffmanOnly].Get().(*flate.Writer); ok {
+		fw.Reset(w)
+		return fw
+	}
+	fw, _ := flate.NewWriter(w, level)
+	return fw
+}
+
+func putDeflater(level int, fw *flate.Writer) {
+	deflaters[level-flate.HuffmanOnly].Put(fw)
+}
+
+// frameCodec 连接的压缩帧状态, 未配置压缩时为 nil
+type frameCodec struct {
+	parser    PayloadParser
+	level     int
+	threshold int
+	offer     bool       // 客户端: 连接后主动发起协商
+	ack       *SharedBuf // 协商用的空负载帧, 写出后发往对端的帧带标志字节
+	offered   bool       // 服务端: 已收到客户端的 offer, 仅由读协程访问
+	inFlagged bool       // 对端发来的帧带标志字节, 仅由读协程访问
+	outFlag   int32      // 发往对端的帧带标志字节
+	inflater  io.ReadCloser
+
+	rawIn, wireIn, rawOut, wireOut uint64
+}
+
+// newFrameCodec 握手时按协商结果开启压缩, 两端直接使用带标志字节的帧
+func newFrameCodec(opt *tcpOption, parser PacketParser, hs *Negotiated) *frameCodec {
+	compress := opt.compress
+	if hs != nil {
+		compress = hs.Compress
+	}
+	if !compress {
+		return nil
+	}
+	pp := parser.(PayloadParser)
+	z := &frameCodec{
+		parser:    pp,
+		level:     opt.compressLevel,
+		threshold: opt.compressThreshold,
+	}
+	ack, err := pp.BuildFrameBuf(func(*bytes.Buffer) error { return nil })
+	if err != nil {
+		panic(err)
+	}
+	z.ack = NewSharedBuf(append([]byte(nil), ack.Bytes()...))
+	ack.Release()
+	if hs != nil {
+		z.inFlagged = true
+		z.setFlaggedOut()
+	}
+	return z
+}
+
+func (z *frameCodec) flaggedOut() bool {
+	return z != nil && atomic.LoadInt32(&z.outFlag) == 1
+}
+
+func (z *frameCodec) setFlaggedOut() {
+	atomic.StoreInt32(&z.outFlag, 1)
+}
+
+// outFrame 返回实际写出的帧: 协商前为原帧, 协商后为带标志字节的变体帧(按阈值压缩)
+func (z *frameCodec) outFrame(sb *SharedBuf) (*SharedBuf, error) {
+	if !z.flaggedOut() || sb == z.ack {
+		return sb, nil
+	}
+	alt, err := sb.variant(z.reframe)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddUint64(&z.rawOut, uint64(sb.Len()))
+	atomic.AddUint64(&z.wireOut, uint64(alt.Len()))
+	return alt, nil
+}
+
+// reframe 把普通帧转换为带标志字节的帧
+func (z *frameCodec) reframe(frame []byte) (*SharedBuf, error) {
+	payload, n, err := z.parser.SplitFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(frame) {
+		return nil, fmt.Errorf("%w: reframe %d of %d bytes", ErrCompressFrame, n, len(frame))
+	}
+	return z.parser.BuildFrameBuf(func(buf *bytes.Buffer) error {
+		start := buf.Len()
+		if len(payload) >= z.threshold {
+			buf.WriteByte(FRAME_FLAG_FLATE)
+			fw := getDeflater(z.level, buf)
+			_, err := fw.Write(payload)
+			if err == nil {
+				err = fw.Close()
+			}
+			putDeflater(z.level, fw)
+			if err != nil {
+				return err
+			}
+			if buf.Len()-start <= len(payload) {
+				return nil
+			}
+			// 压缩后更大, 改为原样发送
+			buf.Truncate(start)
+		}
+		buf.WriteByte(0)
+		buf.Write(payload)
+		return nil
+	})
+}
+
+// decode 解析一帧负载; 协商用的空负载帧返回 nil, 仅由读协程调用
+func (z *frameCodec) decode(c *TCPConn, payload []byte) (Packet, error) {
+	if len(payload) == 0 {
+		return nil, z.negotiate(c)
+	}
+	if !z.inFlagged {
+		return z.parser.DecodePayload(payload)
+	}
+
+	flag, data := payload[0], payload[1:]
+	wire := len(payload)
+	if flag&FRAME_FLAG_FLATE != 0 {
+		var err error
+		if data, err = z.inflate(data); err != nil {
+			return nil, err
+		}
+	}
+	atomic.AddUint64(&z.wireIn, uint64(wire))
+	atomic.AddUint64(&z.rawIn, uint64(len(data)))
+	return z.parser.DecodePayload(data)
+}
+
+// negotiate 处理空负载的协商帧, 回复的空负载帧写出后本端开始发送带标志字节的帧, 仅由读协程调用
+func (z *frameCodec) negotiate(c *TCPConn) error {
+	switch {
+	case z.inFlagged:
+		return fmt.Errorf("%w: empty frame", ErrCompressFrame)
+	case z.offer:
+		// 客户端收到 ack: 此后收到的帧带标志字节, 回复空负载帧通知服务端切换
+		z.inFlagged = true
+		return c.AsyncSendShared(z.ack)
+	case !z.offered:
+		// 服务端收到 offer: 回复 ack
+		z.offered = true
+		return c.AsyncSendShared(z.ack)
+	default:
+		// 服务端收到客户端的切换帧
+		z.inFlagged = true
+		return nil
+	}
+}
+
+// inflate 解压负载, 解压后超过最大帧长度视为错误, 防止压缩炸弹
+func (z *frameCodec) inflate(data []byte) ([]byte, error) {
+	r := bytes.NewReader(data)
+	if z.inflater == nil {
+		z.inflater = flate.NewReader(r)
+	} else if err := z.inflater.(flate.Resetter).Reset(r, nil); err != nil {
+		return nil, err
+	}
+	max := z.parser.MaxFrameSize()
+	out, err := io.ReadAll(io.LimitReader(z.inflater, int64(max)+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCompressFrame, err)
+	}
+	if len(out) > max {
+		return nil, fmt.Errorf("%w: inflated > %d", ErrFrameTooLarge, max)
+	}
+	return out, nil
+}
+
+// stats 收发统计
+func (z *frameCodec) stats() CompressStats {
+	if z == nil {
+		return CompressStats{}
+	}
+	return CompressStats{
+		Enabled: z.flaggedOut() || atomic.LoadUint64(&z.wireIn) > 0,
+		RawIn:   atomic.LoadUint64(&z.rawIn),
+		WireIn:  atomic.LoadUint64(&z.wireIn),
+		RawOut:  atomic.LoadUint64(&z.rawOut),
+		WireOut: atomic.LoadUint64(&z.wireOut),
+	}
+}
+
+// CompressStats 连接的压缩统计, 未协商压缩时各项为 0
+func (c *TCPConn) CompressStats() CompressStats {
+	return c.codec.stats()
+}
@@ -0,0 +1,146 @@
+package tcp_test
+
+import (
+	"compress/flate"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+)
+
+// connRecvHandler 在 recvHandler 基础上记录客户端连接, 用于读取压缩统计
+type connRecvHandler struct {
+	*recvHandler
+	conns chan *tcp.TCPConn
+}
+
+func (h *connRecvHandler) OnConnect(c *tcp.TCPConn) bool {
+	h.conns <- c
+	return h.recvHandler.OnConnect(c)
+}
+
+func startCompressClient(t *testing.T, addr, hello string) (*connRecvHandler, *tcp.TCPConn) {
+	t.Helper()
+	h := &connRecvHandler{recvHandler: newRecvHandler(hello), conns: make(chan *tcp.TCPConn, 1)}
+	client := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newTestParser(),
+		tcp.WithCompression(flate.BestSpeed, 64)))
+	client.Start()
+	t.Cleanup(client.Close)
+	select {
+	case c := <-h.conns:
+		return h, c
+	case <-time.After(3 * time.Second):
+		t.Fatal("client connect timeout")
+	}
+	return nil, nil
+}
+
+func TestCompression(t *testing.T) {
+	long := strings.Repeat("compress me please ", 50)
+	for _, mode := range []struct {
+		name string
+		opts []tcp.TCPOptionFn
+	}{
+		{"goroutine", nil},
+		{"epoll", []tcp.TCPOptionFn{tcp.WithEpoll(1)}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			_, _, addr := startTestServer(t, append(mode.opts, tcp.WithCompression(flate.BestSpeed, 64))...)
+
+			h, c := startCompressClient(t, addr, long)
+			waitRecv(t, h.recvHandler, long)
+			// 连接时发出的消息早于服务端 ack, 为原格式; 收到 ack 之后发出的帧才压缩
+			if err := c.AsyncSendPacket(&echoMsg{Text: long}); err != nil {
+				t.Fatal(err)
+			}
+			waitRecv(t, h.recvHandler, long)
+			st := c.CompressStats()
+			if !st.Enabled || st.OutRatio() >= 0.5 || st.InRatio() >= 0.5 {
+				t.Fatalf("stats %v, want compressed both ways", st)
+			}
+
+			// 小于阈值的消息原样发送
+			before := c.CompressStats()
+			if err := c.AsyncSendPacket(&echoMsg{Text: "hi"}); err != nil {
+				t.Fatal(err)
+			}
+			waitRecv(t, h.recvHandler, "hi")
+			st = c.CompressStats()
+			if raw, wire := st.RawIn-before.RawIn, st.WireIn-before.WireIn; wire != raw+1 {
+				t.Fatalf("small frame wire %d raw %d, want raw+flag", wire, raw)
+			}
+
+			// 未协商压缩的旧客户端按原格式收发
+			old, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer old.Close()
+			old.SetDeadline(time.Now().Add(3 * time.Second))
+			parser := newTestParser()
+			if _, err := parser.WritePacket(old, &echoMsg{Text: long}); err != nil {
+				t.Fatal(err)
+			}
+			p, err := parser.ReadPacket(old)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p.(*echoMsg).Text; got != long {
+				t.Fatalf("old client recv %d bytes, want %d", len(got), len(long))
+			}
+		})
+	}
+}
+
+// 同一共享缓冲多次发送时复用压缩后的变体帧
+func TestCompressionSharedBuf(t *testing.T) {
+	_, _, addr := startTestServer(t, tcp.WithCompression(flate.BestSpeed, 64))
+	h, c := startCompressClient(t, addr, "ready")
+	waitRecv(t, h.recvHandler, "ready")
+
+	long := strings.Repeat("broadcast ", 100)
+	sb, err := c.BuildSharedBuf(&echoMsg{Text: long})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sb.Release()
+	for i := 0; i < 3; i++ {
+		if err := c.AsyncSendShared(sb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		waitRecv(t, h.recvHandler, long)
+	}
+	if st := c.CompressStats(); st.OutRatio() >= 0.5 {
+		t.Fatalf("stats %v, want shared frames compressed", st)
+	}
+}
+
+// TestCompressionServerDisabled 开启压缩的客户端连接未开启压缩的服务端, 收不到回复时保持原帧格式
+func TestCompressionServerDisabled(t *testing.T) {
+	long := strings.Repeat("compress me please ", 50)
+	for _, mode := range []struct {
+		name string
+		opts []tcp.TCPOptionFn
+	}{
+		{"goroutine", nil},
+		{"epoll", []tcp.TCPOptionFn{tcp.WithEpoll(1)}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			_, _, addr := startTestServer(t, mode.opts...)
+
+			h, c := startCompressClient(t, addr, long)
+			waitRecv(t, h.recvHandler, long)
+			if err := c.AsyncSendPacket(&echoMsg{Text: "again"}); err != nil {
+				t.Fatal(err)
+			}
+			waitRecv(t, h.recvHandler, "again")
+			if st := c.CompressStats(); st.Enabled || st.WireOut != 0 || st.WireIn != 0 {
+				t.Fatalf("stats %v, want uncompressed", st)
+			}
+		})
+	}
+}
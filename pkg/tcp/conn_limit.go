@@ -0,0 +1,228 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DEFAULT_REJECT_TIMEOUT 写出拒绝通知并等待对端关闭的最长时间
+const DEFAULT_REJECT_TIMEOUT = time.Second
+
+var (
+	ErrTooManyConns      = errors.New("too many connections")
+	ErrTooManyConnsPerIP = errors.New("too many connections from same ip")
+)
+
+// ParseAllowlist 解析 IP 或 CIDR 列表, 如 "127.0.0.1", "10.0.0.0/8"
+func ParseAllowlist(entries ...string) ([]*net.IPNet, error) {
+	return parseIPNets("allowlist", entries...)
+}
+
+// parseIPNets 解析 IP 或 CIDR 列表, what 用于错误信息
+func parseIPNets(what string, entries ...string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if !strings.Contains(e, "/") {
+			ip := net.ParseIP(e)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid %s ip %q", what, e)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s cidr %q: %w", what, e, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// connLimiter 限制全局与单个 IP 的并发连接数, 白名单内的地址不受限制
+type connLimiter struct {
+	maxConns int
+	maxPerIP int
+	allow    []*net.IPNet
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func newConnLimiter(opt *tcpOption) *connLimiter {
+	if opt.maxConns <= 0 && opt.maxConnsPerIP <= 0 {
+		return nil
+	}
+	return &connLimiter{
+		maxConns: opt.maxConns,
+		maxPerIP: opt.maxConnsPerIP,
+		allow:    opt.allowlist,
+		perIP:    make(map[string]int),
+	}
+}
+
+// remoteIP 取对端 IP, unix socket、net.Pipe 等没有 IP 时返回空
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil || net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
+
+func (l *connLimiter) allowed(ip string) bool {
+	return containsIP(l.allow, net.ParseIP(ip))
+}
+
+// containsIP ip 是否属于 nets 中任一网段
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// connSlot 一个连接占用的名额: 先占用全局名额, 得到真实地址后再计入单个 IP 的名额
+type connSlot struct {
+	l     *connLimiter
+	total bool   // 已占用全局名额
+	ip    string // 已计入单 IP 名额的地址
+	once  sync.Once
+}
+
+// acquire 占用全局名额, addr 为 nil 表示真实地址尚未知道(等待 PROXY 头), 此时不检查白名单;
+// 成功后须调用 bind 计入单 IP 名额, 连接结束时调用 release 归还
+func (l *connLimiter) acquire(addr net.Addr) (*connSlot, error) {
+	s := &connSlot{l: l}
+	if addr != nil && l.allowed(remoteIP(addr)) {
+		return s, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxConns > 0 && l.total >= l.maxConns {
+		return nil, ErrTooManyConns
+	}
+	l.total++
+	s.total = true
+	return s, nil
+}
+
+// bind 按真实地址计入单 IP 名额, 真实地址在白名单内时归还全局名额; 失败时归还已占用的名额
+func (s *connSlot) bind(addr net.Addr) error {
+	l := s.l
+	ip := remoteIP(addr)
+	if l.allowed(ip) {
+		s.release()
+		return nil
+	}
+
+	l.mu.Lock()
+	if l.maxPerIP > 0 && ip != "" && l.perIP[ip] >= l.maxPerIP {
+		l.mu.Unlock()
+		s.release()
+		return ErrTooManyConnsPerIP
+	}
+	if ip != "" {
+		l.perIP[ip]++
+		s.ip = ip
+	}
+	l.mu.Unlock()
+	return nil
+}
+
+// release 归还名额, 可重复调用; 未配置连接数限制时 s 为 nil
+func (s *connSlot) release() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		l := s.l
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if s.total {
+			l.total--
+		}
+		if s.ip != "" {
+			if l.perIP[s.ip]--; l.perIP[s.ip] <= 0 {
+				delete(l.perIP, s.ip)
+			}
+		}
+	})
+}
+
+// reject 向超出限制的连接写出拒绝通知后关闭; 拒绝发生在 TLS 握手之前,
+// TLS 连接不为发送通知而完成握手, 直接关闭, 客户端按连接失败重连
+func (server *TCPServer) reject(conn net.Conn, reason error) {
+	defer conn.Close()
+	if server.opt.tlsConfig != nil {
+		return
+	}
+
+	// 开启握手时客户端等待 hello 回复, 拒绝原因放在回复中
+	if hs := server.opt.handshake; hs != nil {
+		conn.SetDeadline(time.Now().Add(DEFAULT_REJECT_TIMEOUT))
+		if err := writeHello(conn, server.opt.parser.(PayloadParser), hs.reject(reason.Error(), true)); err == nil {
+			drainPeer(conn)
+		}
+		return
+	}
+
+	server.notify(conn, reason)
+}
+
+// notify 由 RejectHandler 生成通知, 按连接的编码写出后等待对端关闭; 调用方负责关闭 conn
+func (server *TCPServer) notify(conn net.Conn, reason error) {
+	rh, ok := server.opt.handler.(RejectHandler)
+	if !ok {
+		return
+	}
+	p := rh.OnReject(conn, reason)
+	if p == nil {
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(DEFAULT_REJECT_TIMEOUT))
+	parser, preamble := newStreamParser(server.opt.parser)
+	if preamble != nil {
+		_, err := conn.Write(preamble.Bytes())
+		preamble.Release()
+		if err != nil {
+			return
+		}
+	}
+	if _, err := parser.WritePacket(conn, p); err != nil {
+		return
+	}
+	drainPeer(conn)
+}
+
+// drainPeer 半关闭后读尽对端数据, 避免带着未读数据关闭触发 RST 导致通知丢失
+func drainPeer(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		io.Copy(io.Discard, conn)
+	}
+}
@@ -0,0 +1,122 @@
+package tcp_test
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+)
+
+// rejectHandler 回显消息, 拒绝连接时把原因发给对端
+type rejectHandler struct {
+	echoHandler
+}
+
+func (h *rejectHandler) OnReject(conn net.Conn, reason error) tcp.Packet {
+	return &echoMsg{Text: reason.Error()}
+}
+
+func startLimitServer(t *testing.T, opts ...tcp.TCPOptionFn) string {
+	t.Helper()
+	_, addr := startServer(t, &rejectHandler{}, opts...)
+	return addr
+}
+
+func dialLimit(t *testing.T, addr, hello string) (*recvHandler, *tcp.TCPClient) {
+	t.Helper()
+	h := newRecvHandler(hello)
+	client := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newTestParser()))
+	client.Start()
+	t.Cleanup(client.Close)
+	return h, client
+}
+
+func waitClosed(t *testing.T, h *recvHandler) {
+	t.Helper()
+	select {
+	case <-h.closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	addr := startLimitServer(t, tcp.WithMaxConns(1))
+
+	h1, c1 := dialLimit(t, addr, "first")
+	waitRecv(t, h1, "first")
+
+	h2, _ := dialLimit(t, addr, "second")
+	waitRecv(t, h2, tcp.ErrTooManyConns.Error())
+	waitClosed(t, h2)
+
+	// 释放名额后可再次连接
+	c1.Close()
+	time.Sleep(50 * time.Millisecond)
+	h3, _ := dialLimit(t, addr, "third")
+	waitRecv(t, h3, "third")
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	addr := startLimitServer(t, tcp.WithMaxConnsPerIP(1))
+
+	h1, _ := dialLimit(t, addr, "first")
+	waitRecv(t, h1, "first")
+
+	h2, _ := dialLimit(t, addr, "second")
+	waitRecv(t, h2, tcp.ErrTooManyConnsPerIP.Error())
+	waitClosed(t, h2)
+}
+
+func TestConnLimitAllowlist(t *testing.T) {
+	addr := startLimitServer(t, tcp.WithMaxConns(1), tcp.WithMaxConnsPerIP(1), tcp.WithAllowlist("10.0.0.0/8", "127.0.0.1"))
+
+	for _, hello := range []string{"a", "b", "c"} {
+		h, _ := dialLimit(t, addr, hello)
+		waitRecv(t, h, hello)
+	}
+
+	if _, err := tcp.ParseAllowlist("10.0.0.0/33"); err == nil {
+		t.Fatal("invalid cidr accepted")
+	}
+	if _, err := tcp.ParseAllowlist("localhost"); err == nil {
+		t.Fatal("hostname accepted")
+	}
+}
+
+// TestMaxConnsPerIPCountsTLSHandshake 尚未完成 TLS 握手的连接也占用名额
+func TestMaxConnsPerIPCountsTLSHandshake(t *testing.T) {
+	certs := genTestCerts(t)
+	srvCfg, err := tcp.NewServerTLSConfig(certs.serverCert, certs.serverKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startLimitServer(t, tcp.WithTLSConfig(srvCfg), tcp.WithMaxConnsPerIP(1))
+	cliCfg, err := tcp.NewClientTLSConfig(certs.caFile, "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 只建立 TCP 连接, 不发起 TLS 握手
+	stalled, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	dialer := &net.Dialer{Timeout: 3 * time.Second}
+	if c, err := tls.DialWithDialer(dialer, "tcp", addr, cliCfg); err == nil {
+		c.Close()
+		t.Fatal("tls handshake succeeded while the only slot is held")
+	}
+
+	stalled.Close()
+	time.Sleep(50 * time.Millisecond)
+	h := newRecvHandler("after")
+	client := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newTestParser(), tcp.WithTLSConfig(cliCfg)))
+	client.Start()
+	defer client.Close()
+	waitRecv(t, h, "after")
+}
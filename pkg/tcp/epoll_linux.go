@@ -0,0 +1,875 @@
+//go:build linux
+// +build linux
+
+package tcp
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	EPOLL_READ_BUF_SIZE  = 64 * 1024 // 每个 poller 共享的读缓冲
+	EPOLL_WRITE_BUF_SIZE = 64 * 1024 // 每个 poller 共享的合并写缓冲
+	EPOLL_MAX_EVENTS     = 256
+)
+
+const (
+	pauseRecvFull = 1 << iota // 接收队列已满, 等待处理
+	pauseThrottle             // 限速延迟中
+)
+
+// pollerGroup 一组 poller, 新连接轮流分配
+type pollerGroup struct {
+	pollers []*poller
+	next    uint32
+}
+
+func newPollerGroup(n int, opt *tcpOption) (*pollerGroup, error) {
+	if _, ok := opt.parser.(FrameDecoder); !ok {
+		return nil, ErrEpollParser
+	}
+	if opt.handshake != nil {
+		for _, c := range opt.handshake.Codecs {
+			if _, ok := c.Parser.(FrameDecoder); !ok {
+				return nil, ErrEpollParser
+			}
+		}
+	}
+	if n <= 0 {
+		n = 1
+	}
+	g := &pollerGroup{}
+	for i := 0; i < n; i++ {
+		p, err := newPoller(opt)
+		if err != nil {
+			g.close()
+			return nil, err
+		}
+		g.pollers = append(g.pollers, p)
+		go p.loop()
+	}
+	return g, nil
+}
+
+// newConn 为支持 epoll 的连接创建 TCPConn 并分配 poller, 不支持时返回 nil
+func (g *pollerGroup) newConn(conn net.Conn, opt *tcpOption, hs *Negotiated) *TCPConn {
+	rc, fd, ok := pollFD(conn)
+	if !ok {
+		return nil
+	}
+	c := newEpollConn(conn, rc, fd, opt, hs)
+	idx := atomic.AddUint32(&g.next, 1)
+	c.ep.p = g.pollers[int(idx)%len(g.pollers)]
+	return c
+}
+
+// add 注册到 epoll 开始收发
+func (g *pollerGroup) add(c *TCPConn) error {
+	return c.ep.p.add(c)
+}
+
+func (g *pollerGroup) close() {
+	for _, p := range g.pollers {
+		p.close()
+	}
+}
+
+// pollFD 取得可注册到 epoll 的连接, 仅支持 *net.TCPConn、*net.UnixConn 等 syscall.Conn
+func pollFD(conn net.Conn) (syscall.RawConn, int, bool) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, 0, false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, 0, false
+	}
+	fd := -1
+	if err := rc.Control(func(f uintptr) { fd = int(f) }); err != nil || fd < 0 {
+		return nil, 0, false
+	}
+	return rc, fd, true
+}
+
+// epollConn epoll 模式下连接的收发状态, 缓冲只在有数据待处理时分配
+type epollConn struct {
+	fd int
+	rc syscall.RawConn // 通过 RawConn 读写, 保证读写期间 fd 不被关闭复用
+	p  *poller
+
+	rmu sync.Mutex // 读侧: 半帧数据与限速器, 由 poller 或限速恢复定时器持有
+	in  []byte     // 未解析完的半帧数据
+
+	mu       sync.Mutex
+	events   uint32
+	paused   int
+	readDone bool
+	recvQ    []Packet
+	working  bool
+	outQ     []*SharedBuf
+	outOff   int // outQ[0] 已写出的字节数
+	queued   bool
+	draining bool
+	space    chan struct{} // 发送队列写出后通知 OVERFLOW_BLOCK 的等待者
+
+	lastRead int64
+	lastPing int64
+}
+
+// reading 是否继续读取, 调用方持有 mu
+func (ep *epollConn) reading() bool {
+	return ep.paused == 0 && !ep.readDone
+}
+
+// wantEvents 根据当前状态计算需要关注的事件, 调用方持有 mu;
+// 暂停读取时不关注 EPOLLRDHUP, 否则对端半关闭后水平触发的事件会反复唤醒 poller
+func (ep *epollConn) wantEvents() uint32 {
+	var events uint32
+	if ep.reading() {
+		events |= syscall.EPOLLIN | syscall.EPOLLRDHUP
+	}
+	if len(ep.outQ) > 0 {
+		events |= syscall.EPOLLOUT
+	}
+	return events
+}
+
+// updateEvents 关注事件变化时更新 epoll 注册, 调用方持有 mu
+func (ep *epollConn) updateEvents(c *TCPConn) {
+	events := ep.wantEvents()
+	if events == ep.events || c.IsClosed() {
+		return
+	}
+	ep.events = events
+	ev := syscall.EpollEvent{Events: events, Fd: int32(ep.fd), Pad: int32(c.OnlineIdx)}
+	if err := syscall.EpollCtl(ep.p.epfd, syscall.EPOLL_CTL_MOD, ep.fd, &ev); err != nil && !errors.Is(err, syscall.ENOENT) {
+		log.Printf("TCPConn client:%d epoll mod err:%v\n", c.OnlineIdx, err)
+	}
+}
+
+// poller 一个 epoll 实例及其事件循环
+type poller struct {
+	epfd      int
+	wakeR     int // 唤醒管道, 有连接待写或关闭时写入
+	wakeW     int
+	opt       *tcpOption
+	mu        sync.Mutex
+	conns     map[int]*TCPConn
+	pmu       sync.Mutex
+	pending   []*TCPConn // 待写出的连接
+	woken     bool
+	rbuf      []byte
+	wbuf      []byte
+	tick      time.Duration
+	heartbeat *SharedFrames // 按连接的编码格式各编码一次
+	closeFlag int32
+	done      chan struct{}
+}
+
+func newPoller(opt *tcpOption) (*poller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	var fds [2]int
+	if err := syscall.Pipe2(fds[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fds[0])}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fds[0], &ev); err != nil {
+		syscall.Close(epfd)
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+		return nil, err
+	}
+
+	p := &poller{
+		epfd:  epfd,
+		wakeR: fds[0],
+		wakeW: fds[1],
+		opt:   opt,
+		conns: make(map[int]*TCPConn),
+		rbuf:  make([]byte, EPOLL_READ_BUF_SIZE),
+		wbuf:  make([]byte, 0, EPOLL_WRITE_BUF_SIZE),
+		tick:  -1,
+		done:  make(chan struct{}),
+	}
+
+	// 空闲检测与心跳共用一个检查周期
+	var period time.Duration
+	if opt.idleTimeout > 0 {
+		period = opt.idleTimeout
+	}
+	if opt.heartbeatInterval > 0 && opt.heartbeatPacket != nil {
+		if period == 0 || opt.heartbeatInterval < period {
+			period = opt.heartbeatInterval
+		}
+		p.heartbeat = NewSharedFrames(opt.heartbeatPacket)
+		if _, err := p.heartbeat.forParser(opt.parser); err != nil {
+			p.close()
+			return nil, err
+		}
+	}
+	if period > 0 {
+		p.tick = period / 4
+		if p.tick < 10*time.Millisecond {
+			p.tick = 10 * time.Millisecond
+		}
+		if p.tick > time.Second {
+			p.tick = time.Second
+		}
+	}
+	return p, nil
+}
+
+func (p *poller) add(c *TCPConn) error {
+	ep := c.ep
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&ep.lastRead, now)
+	atomic.StoreInt64(&ep.lastPing, now)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// 与 remove 互斥, 已关闭的连接不再注册, 避免 fd 被复用
+	if atomic.LoadInt32(&p.closeFlag) == 1 || c.IsClosed() {
+		return ErrConnClosing
+	}
+	ep.mu.Lock()
+	ep.events = ep.wantEvents()
+	ev := syscall.EpollEvent{Events: ep.events, Fd: int32(ep.fd), Pad: int32(c.OnlineIdx)}
+	ep.mu.Unlock()
+	if err := syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, ep.fd, &ev); err != nil {
+		return err
+	}
+	p.conns[ep.fd] = c
+	return nil
+}
+
+// remove 在关闭 fd 之前调用, 避免 fd 被复用后收到旧连接的事件
+func (p *poller) remove(c *TCPConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cur, ok := p.conns[c.ep.fd]; ok && cur == c {
+		delete(p.conns, c.ep.fd)
+		syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, c.ep.fd, nil)
+	}
+}
+
+func (p *poller) wake() {
+	var b [1]byte
+	syscall.Write(p.wakeW, b[:])
+}
+
+// schedule 登记待写出的连接并唤醒事件循环, 同一轮内多次发送只唤醒一次
+func (p *poller) schedule(c *TCPConn) {
+	p.pmu.Lock()
+	if !c.ep.queued {
+		c.ep.queued = true
+		p.pending = append(p.pending, c)
+	}
+	needWake := !p.woken
+	p.woken = true
+	p.pmu.Unlock()
+	if needWake {
+		p.wake()
+	}
+}
+
+func (p *poller) close() {
+	if !atomic.CompareAndSwapInt32(&p.closeFlag, 0, 1) {
+		return
+	}
+	p.wake()
+	<-p.done
+}
+
+func (p *poller) loop() {
+	defer func() {
+		syscall.Close(p.epfd)
+		syscall.Close(p.wakeR)
+		syscall.Close(p.wakeW)
+		if p.heartbeat != nil {
+			p.heartbeat.Release()
+		}
+		close(p.done)
+	}()
+
+	events := make([]syscall.EpollEvent, EPOLL_MAX_EVENTS)
+	msec := -1
+	if p.tick > 0 {
+		msec = int(p.tick / time.Millisecond)
+	}
+	lastTick := time.Now()
+	for atomic.LoadInt32(&p.closeFlag) == 0 {
+		n, err := syscall.EpollWait(p.epfd, events, msec)
+		if err != nil && err != syscall.EINTR {
+			log.Printf("poller EpollWait err:%v\n", err)
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			ev := &events[i]
+			fd := int(ev.Fd)
+			if fd == p.wakeR {
+				p.drainWake()
+				continue
+			}
+			p.mu.Lock()
+			c, ok := p.conns[fd]
+			p.mu.Unlock()
+			if !ok || int32(c.OnlineIdx) != ev.Pad {
+				continue
+			}
+			p.handle(c, ev.Events)
+		}
+
+		p.flushPending()
+		if p.tick > 0 && time.Since(lastTick) >= p.tick {
+			lastTick = time.Now()
+			p.checkTimers(lastTick)
+		}
+	}
+}
+
+func (p *poller) drainWake() {
+	var b [64]byte
+	for {
+		n, err := syscall.Read(p.wakeR, b[:])
+		if n <= 0 || err != nil {
+			break
+		}
+	}
+	p.pmu.Lock()
+	p.woken = false
+	p.pmu.Unlock()
+}
+
+func (p *poller) flushPending() {
+	p.pmu.Lock()
+	pending := p.pending
+	p.pending = nil
+	for _, c := range pending {
+		c.ep.queued = false
+	}
+	p.pmu.Unlock()
+	for _, c := range pending {
+		p.flush(c)
+	}
+}
+
+// checkTimers 空闲超时检测与心跳
+func (p *poller) checkTimers(now time.Time) {
+	var idle, ping []*TCPConn
+	p.mu.Lock()
+	for _, c := range p.conns {
+		ep := c.ep
+		if p.opt.idleTimeout > 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&ep.lastRead))) > p.opt.idleTimeout {
+			idle = append(idle, c)
+			continue
+		}
+		if p.heartbeat != nil && now.Sub(time.Unix(0, atomic.LoadInt64(&ep.lastPing))) >= p.opt.heartbeatInterval {
+			atomic.StoreInt64(&ep.lastPing, now.UnixNano())
+			ping = append(ping, c)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, c := range idle {
+		log.Printf("TCPConn client:%d idle timeout %v\n", c.OnlineIdx, p.opt.idleTimeout)
+		c.Close()
+	}
+	for _, c := range ping {
+		if sb, err := p.heartbeat.For(c); err == nil {
+			c.AsyncSendShared(sb)
+		}
+	}
+}
+
+// handle 处理连接上的事件, panic 时只关闭该连接
+func (p *poller) handle(c *TCPConn, events uint32) {
+	defer func() {
+		if c.recoverPanic("poller", recover()) {
+			c.Close()
+		}
+	}()
+	if events&(syscall.EPOLLIN|syscall.EPOLLRDHUP|syscall.EPOLLHUP|syscall.EPOLLERR) != 0 {
+		if !p.read(c) && events&(syscall.EPOLLHUP|syscall.EPOLLERR) != 0 {
+			c.epHangup()
+		}
+	}
+	if events&syscall.EPOLLOUT != 0 {
+		p.flush(c)
+	}
+}
+
+// read 读取一次数据并解析, 对端关闭或出错时标记读结束;
+// 暂停读取(接收队列满、限速延迟)或读已结束时不读取, 返回 false
+func (p *poller) read(c *TCPConn) bool {
+	ep := c.ep
+	ep.rmu.Lock()
+	defer ep.rmu.Unlock()
+	ep.mu.Lock()
+	reading := ep.reading()
+	ep.mu.Unlock()
+	if !reading {
+		return false
+	}
+	var n int
+	var rerr error
+	err := ep.rc.Read(func(fd uintptr) bool {
+		for {
+			n, rerr = syscall.Read(int(fd), p.rbuf)
+			if rerr != syscall.EINTR {
+				return true
+			}
+		}
+	})
+	if err == nil {
+		err = rerr
+	}
+	if err == syscall.EAGAIN {
+		return true
+	}
+	if err != nil || n <= 0 {
+		if err != nil && !errors.Is(err, net.ErrClosed) && err != syscall.ECONNRESET {
+			log.Printf("TCPConn.read() client:%d err:%v\n", c.OnlineIdx, err)
+		}
+		c.epReadDone()
+		return true
+	}
+	atomic.StoreInt64(&ep.lastRead, time.Now().UnixNano())
+
+	data := p.rbuf[:n]
+	if len(ep.in) > 0 {
+		ep.in = append(ep.in, data...)
+		data = ep.in
+	}
+	c.epConsume(data)
+	return true
+}
+
+// epConsume 解析已读到的数据, 剩余的半帧保存到 ep.in; 调用方持有 rmu
+func (c *TCPConn) epConsume(data []byte) {
+	ep := c.ep
+	for len(data) > 0 {
+		pkt, n, err := c.epDecode(data)
+		if err != nil {
+			log.Printf("TCPConn.read() client:%d err:%v\n", c.OnlineIdx, err)
+			ep.in = nil
+			c.epReadDone()
+			return
+		}
+		if n == 0 {
+			break
+		}
+		data = data[n:]
+		if pkt == nil {
+			// 压缩协商帧
+			continue
+		}
+
+		if c.limiter != nil {
+			now := time.Now()
+			ok, wait := c.limiter.limit(n, now)
+			if !ok || wait > 0 {
+				if th, isTh := c.opt.handler.(ThrottleHandler); isTh && c.limiter.shouldNotice(now) {
+					th.OnThrottle(c, c.limiter.policy)
+				}
+				switch c.limiter.policy {
+				case THROTTLE_DELAY:
+					// 暂停读取, 到期后放行该包并继续解析剩余数据
+					ep.in = append([]byte(nil), data...)
+					c.epPause(pauseThrottle, true)
+					time.AfterFunc(wait, func() { c.epResume(pkt) })
+					return
+				case THROTTLE_DISCONNECT:
+					log.Printf("TCPConn client:%d rate limit exceeded, disconnect\n", c.OnlineIdx)
+					c.setCloseReason(ErrRateLimited)
+					ep.in = nil
+					c.epPause(pauseThrottle, true)
+					c.Drain()
+					return
+				}
+				continue
+			}
+		}
+		c.epDispatch(pkt)
+	}
+
+	if len(data) == 0 {
+		ep.in = nil
+	} else if len(ep.in) == 0 || &data[0] != &ep.in[0] {
+		ep.in = append([]byte(nil), data...)
+	} else {
+		ep.in = ep.in[:copy(ep.in, data)]
+	}
+}
+
+// epDecode 解析一帧, 开启压缩时切出负载后解码, 协商帧返回的 pkt 为 nil
+func (c *TCPConn) epDecode(data []byte) (Packet, int, error) {
+	if c.codec == nil {
+		return c.parser.(FrameDecoder).DecodeFrame(data)
+	}
+	payload, n, err := c.codec.parser.SplitFrame(data)
+	if err != nil || n == 0 {
+		return nil, 0, err
+	}
+	pkt, err := c.codec.decode(c, payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	return pkt, n, nil
+}
+
+// epResume 限速延迟到期
+func (c *TCPConn) epResume(pkt Packet) {
+	if c.IsClosed() {
+		return
+	}
+	defer func() {
+		if c.recoverPanic("epResume", recover()) {
+			c.Close()
+		}
+	}()
+	ep := c.ep
+	ep.rmu.Lock()
+	defer ep.rmu.Unlock()
+	c.epDispatch(pkt)
+	c.epPause(pauseThrottle, false)
+	if len(ep.in) > 0 {
+		c.epConsume(ep.in)
+	}
+}
+
+func (c *TCPConn) epPause(flag int, pause bool) {
+	ep := c.ep
+	ep.mu.Lock()
+	if pause {
+		ep.paused |= flag
+	} else {
+		ep.paused &^= flag
+	}
+	ep.updateEvents(c)
+	ep.mu.Unlock()
+}
+
+// epDispatch 放入接收队列(自动回复的心跳包除外), 没有处理协程时启动一个, 队列处理完后协程退出
+func (c *TCPConn) epDispatch(pkt Packet) {
+	if c.autoPong(pkt) {
+		return
+	}
+	ep := c.ep
+	ep.mu.Lock()
+	ep.recvQ = append(ep.recvQ, pkt)
+	if len(ep.recvQ) >= c.opt.recvChanCapLimit {
+		ep.paused |= pauseRecvFull
+		ep.updateEvents(c)
+	}
+	start := !ep.working
+	ep.working = true
+	ep.mu.Unlock()
+	if start {
+		go c.epWork()
+	}
+}
+
+func (c *TCPConn) epWork() {
+	ep := c.ep
+	for {
+		ep.mu.Lock()
+		if len(ep.recvQ) == 0 || c.IsClosed() {
+			ep.working = false
+			readDone := ep.readDone
+			ep.recvQ = nil
+			ep.mu.Unlock()
+			if readDone {
+				c.Close()
+			}
+			return
+		}
+		pkt := ep.recvQ[0]
+		ep.recvQ[0] = nil
+		ep.recvQ = ep.recvQ[1:]
+		if ep.paused&pauseRecvFull != 0 && len(ep.recvQ) < c.opt.recvChanCapLimit {
+			ep.paused &^= pauseRecvFull
+			ep.updateEvents(c)
+		}
+		ep.mu.Unlock()
+
+		if !c.handleMessage(pkt) {
+			c.Close()
+			return
+		}
+	}
+}
+
+// epReadDone 对端关闭或读出错, 处理完已收到的包后关闭连接
+func (c *TCPConn) epReadDone() {
+	ep := c.ep
+	ep.mu.Lock()
+	ep.readDone = true
+	ep.updateEvents(c)
+	working := ep.working
+	ep.mu.Unlock()
+	if !working {
+		c.Close()
+	}
+}
+
+// epHangup 连接已复位或两端均已关闭而读取已暂停: EPOLLHUP/EPOLLERR 无法屏蔽,
+// 停止监听 fd 以免事件反复触发, 已收到的包处理完后关闭连接
+func (c *TCPConn) epHangup() {
+	ep := c.ep
+	ep.p.mu.Lock()
+	if cur, ok := ep.p.conns[ep.fd]; ok && cur == c {
+		syscall.EpollCtl(ep.p.epfd, syscall.EPOLL_CTL_DEL, ep.fd, nil)
+	}
+	ep.p.mu.Unlock()
+	c.epReadDone()
+}
+
+// epSend 放入发送队列, 由 poller 合并写出
+func (c *TCPConn) epSend(sb *SharedBuf) error {
+	ep := c.ep
+	limit := c.opt.sendChanCapLimit * 100
+	closed := false
+	// 协商压缩后入队带标志字节的变体帧, 入队成功时队列持有的引用由 sb 转给变体帧
+	var alt *SharedBuf
+	var altErr error
+	toFrame := func() {
+		if alt == nil && altErr == nil && c.codec.flaggedOut() {
+			alt, altErr = c.codec.outFrame(sb)
+			if alt == sb {
+				alt = nil
+			} else if alt != nil {
+				alt.Retain()
+			}
+		}
+	}
+	defer func() {
+		if alt != nil {
+			alt.Release()
+		}
+	}()
+	toFrame()
+	if altErr != nil {
+		return altErr
+	}
+	push := func() bool {
+		ep.mu.Lock()
+		defer ep.mu.Unlock()
+		// 与 epClose 互斥, 关闭后不再入队
+		if c.IsClosed() {
+			closed = true
+			return false
+		}
+		if len(ep.outQ) >= limit {
+			return false
+		}
+		// 与协商回复入队互斥, 保证回复之后入队的都是变体帧
+		if toFrame(); altErr != nil {
+			return false
+		}
+		if alt == nil {
+			ep.outQ = append(ep.outQ, sb)
+			if c.codec != nil && sb == c.codec.ack {
+				c.codec.setFlaggedOut()
+			}
+			return true
+		}
+		ep.outQ = append(ep.outQ, alt)
+		alt = nil
+		sb.Release()
+		return true
+	}
+
+	if !push() {
+		if altErr != nil {
+			return altErr
+		}
+		if closed {
+			return ErrConnClosing
+		}
+		evict := func() bool {
+			ep.mu.Lock()
+			defer ep.mu.Unlock()
+			// outQ[0] 可能已部分写出, 丢弃其后最旧的一条
+			if len(ep.outQ) < 2 {
+				return false
+			}
+			old := ep.outQ[1]
+			ep.outQ = append(ep.outQ[:1], ep.outQ[2:]...)
+			old.Release()
+			return true
+		}
+		wait := func(timeout <-chan time.Time) bool {
+			for {
+				select {
+				case <-ep.space:
+					if push() {
+						return true
+					}
+				case <-timeout:
+					return false
+				case <-c.closeChan:
+					return false
+				}
+			}
+		}
+		if err := c.overflow(push, evict, wait); err != nil {
+			return err
+		}
+		if altErr != nil {
+			return altErr
+		}
+		if closed {
+			return ErrConnClosing
+		}
+	}
+	ep.p.schedule(c)
+	return nil
+}
+
+// flush 合并发送队列写出, 写不完时关注 EPOLLOUT
+func (p *poller) flush(c *TCPConn) {
+	ep := c.ep
+	ep.mu.Lock()
+	var werr error
+	for len(ep.outQ) > 0 && werr == nil {
+		// 小包拷贝到合并写缓冲, 单个大包直接写
+		batch := p.wbuf[:0]
+		first := ep.outQ[0].Bytes()[ep.outOff:]
+		if len(first) >= cap(batch) {
+			batch = first
+		} else {
+			for i, sb := range ep.outQ {
+				b := sb.Bytes()
+				if i == 0 {
+					b = first
+				}
+				if len(batch)+len(b) > cap(batch) {
+					break
+				}
+				batch = append(batch, b...)
+			}
+		}
+
+		var n int
+		err := ep.rc.Write(func(fd uintptr) bool {
+			for {
+				n, werr = syscall.Write(int(fd), batch)
+				if werr != syscall.EINTR {
+					return true
+				}
+			}
+		})
+		if err != nil {
+			werr = err
+		}
+		if n > 0 {
+			ep.consumeOut(n)
+		}
+		if n < len(batch) && werr == nil {
+			werr = syscall.EAGAIN
+		}
+	}
+
+	if werr != nil && werr != syscall.EAGAIN {
+		ep.mu.Unlock()
+		if !errors.Is(werr, net.ErrClosed) && werr != syscall.EPIPE && werr != syscall.ECONNRESET {
+			log.Printf("TCPConn.flush() client:%d err:%v\n", c.OnlineIdx, werr)
+		}
+		c.Close()
+		return
+	}
+	ep.updateEvents(c)
+	drained := len(ep.outQ) == 0 && ep.draining
+	ep.mu.Unlock()
+	if drained {
+		c.close(true)
+	}
+}
+
+// consumeOut 释放已写出的缓冲, 调用方持有 mu
+func (ep *epollConn) consumeOut(n int) {
+	for n > 0 && len(ep.outQ) > 0 {
+		remain := ep.outQ[0].Len() - ep.outOff
+		if n < remain {
+			ep.outOff += n
+			break
+		}
+		n -= remain
+		ep.outQ[0].Release()
+		ep.outQ[0] = nil
+		ep.outQ = ep.outQ[1:]
+		ep.outOff = 0
+	}
+	if len(ep.outQ) == 0 {
+		ep.outQ = nil
+	}
+	select {
+	case ep.space <- struct{}{}:
+	default:
+	}
+}
+
+// epDrain 写出发送队列后关闭
+func (c *TCPConn) epDrain() {
+	ep := c.ep
+	ep.mu.Lock()
+	ep.draining = true
+	empty := len(ep.outQ) == 0
+	ep.mu.Unlock()
+	if empty {
+		c.close(true)
+		return
+	}
+	ep.p.schedule(c)
+}
+
+// epClose 从 poller 移除并释放未写出的缓冲, 在关闭 fd 之前调用
+func (c *TCPConn) epClose() {
+	ep := c.ep
+	if ep.p != nil {
+		ep.p.remove(c)
+	}
+	ep.mu.Lock()
+	for _, sb := range ep.outQ {
+		sb.Release()
+	}
+	ep.outQ = nil
+	ep.recvQ = nil
+	ep.mu.Unlock()
+}
+
+func newEpollConn(conn net.Conn, rc syscall.RawConn, fd int, opt *tcpOption, hs *Negotiated) *TCPConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &TCPConn{
+		OnlineIdx: atomic.AddUint32(&globalIdx, 1),
+		opt:       opt,
+		rawConn:   conn,
+		closeChan: make(chan struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+		drainChan: make(chan struct{}),
+		limiter:   newRateLimiter(opt.rateLimit),
+		ep: &epollConn{
+			fd:    fd,
+			rc:    rc,
+			space: make(chan struct{}, 1),
+		},
+	}
+	// 连接级编解码流的前导帧排在发送队列最前
+	if preamble := c.initCodec(hs); preamble != nil {
+		c.ep.outQ = append(c.ep.outQ, preamble)
+	}
+	return c
+}
@@ -0,0 +1,231 @@
+package tcp_test
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+)
+
+func TestEpollEcho(t *testing.T) {
+	_, _, addr := startTestServer(t, tcp.WithEpoll(2))
+
+	h := newRecvHandler("hello epoll")
+	client := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newTestParser()))
+	client.Start()
+	defer client.Close()
+
+	waitRecv(t, h, "hello epoll")
+}
+
+func TestEpollLargeFrame(t *testing.T) {
+	_, _, addr := startTestServer(t, tcp.WithEpoll(1), tcp.WithFrameHeader(tcp.HEADER_UINT32))
+
+	// 大于单次读取缓冲, 需跨多次读取拼帧
+	text := strings.Repeat("x", 200*1024)
+	h := newRecvHandler(text)
+	client := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newTestParser(), tcp.WithFrameHeader(tcp.HEADER_UINT32)))
+	client.Start()
+	defer client.Close()
+
+	waitRecv(t, h, text)
+}
+
+func TestEpollManyConnsFewGoroutines(t *testing.T) {
+	_, _, addr := startTestServer(t, tcp.WithEpoll(2))
+	parser := newTestParser()
+
+	const n = 200
+	base := runtime.NumGoroutine()
+	conns := make([]net.Conn, 0, n)
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for i := 0; i < n; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	for _, c := range conns {
+		if _, err := parser.WritePacket(c, &echoMsg{Text: "ping"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range conns {
+		c.SetReadDeadline(time.Now().Add(3 * time.Second))
+		p, err := parser.ReadPacket(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.(*echoMsg).Text; got != "ping" {
+			t.Fatalf("recv %q, want ping", got)
+		}
+	}
+
+	// 空闲连接不占用协程
+	if grown := runtime.NumGoroutine() - base; grown > n/4 {
+		t.Fatalf("goroutines grew by %d for %d idle conns", grown, n)
+	}
+}
+
+func TestEpollIdleTimeout(t *testing.T) {
+	_, _, addr := startTestServer(t, tcp.WithEpoll(1), tcp.WithIdleTimeout(200*time.Millisecond))
+
+	h := newRecvHandler("only once")
+	client := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newTestParser()))
+	client.Start()
+	defer client.Close()
+	waitRecv(t, h, "only once")
+
+	select {
+	case <-h.closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("silent client not closed by idle timeout")
+	}
+}
+
+func TestEpollHeartbeatKeepAlive(t *testing.T) {
+	_, _, addr := startTestServer(t, tcp.WithEpoll(1),
+		tcp.WithHeartbeat(50*time.Millisecond, &echoMsg{Text: "ping"}),
+		tcp.WithIdleTimeout(200*time.Millisecond))
+
+	h := &pongHandler{newRecvHandler("hello")}
+	client := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newTestParser()))
+	client.Start()
+	defer client.Close()
+	waitRecv(t, h.recvHandler, "hello")
+
+	deadline := time.After(600 * time.Millisecond)
+	for {
+		select {
+		case <-h.closed:
+			t.Fatal("client answering heartbeat was closed")
+		case <-h.recv:
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// TestEpollAutoPong epoll 模式下心跳包由读取侧直接回复, Handler 阻塞时照常回复
+func TestEpollAutoPong(t *testing.T) {
+	h := &holdHandler{recv: make(chan string, 8), release: make(chan struct{}), closed: make(chan struct{})}
+	defer close(h.release)
+	_, addr := startServer(t, h, tcp.WithEpoll(1), tcp.WithAutoPong(&pingMsg{}, &echoMsg{Text: "pong"}))
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	parser := newTestParser()
+	if _, err := parser.WritePacket(c, &echoMsg{Text: "hold"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := parser.WritePacket(c, &pingMsg{}); err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(3 * time.Second))
+		p, err := parser.ReadPacket(c)
+		if err != nil {
+			t.Fatalf("wait pong %d: %v", i, err)
+		}
+		if got := p.(*echoMsg).Text; got != "pong" {
+			t.Fatalf("recv %q, want pong", got)
+		}
+	}
+	if got := <-h.recv; got != "hold" {
+		t.Fatalf("handler recv %q, want hold", got)
+	}
+}
+
+func TestEpollShutdownDrain(t *testing.T) {
+	bh := &burstHandler{n: 50, queued: make(chan struct{})}
+	srv, addr := startServer(t, bh, tcp.WithSendChanLimit(bh.n), tcp.WithEpoll(1))
+
+	h := newRecvHandler("go")
+	h.recv = make(chan string, bh.n)
+	client := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newTestParser()))
+	client.Start()
+	defer client.Close()
+
+	<-bh.queued
+	if err := srv.Shutdown(3 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-h.closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("client not closed after shutdown")
+	}
+	if n := len(h.recv); n != bh.n {
+		t.Fatalf("recv %d packets before close, want %d", n, bh.n)
+	}
+}
+
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// TestEpollHalfCloseWhilePaused 接收队列满暂停读取时对端半关闭: poller 不空转, 恢复后按序处理完再关闭
+func TestEpollHalfCloseWhilePaused(t *testing.T) {
+	h := &holdHandler{recv: make(chan string, 8), release: make(chan struct{}), closed: make(chan struct{})}
+	_, addr := startServer(t, h, tcp.WithEpoll(1), tcp.WithRecvChanLimit(1))
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	parser := newTestParser()
+	for i := 0; i < 5; i++ {
+		if _, err := parser.WritePacket(c, &echoMsg{Text: fmt.Sprint("m", i)}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.(*net.TCPConn).CloseWrite()
+
+	select {
+	case got := <-h.recv:
+		if got != "m0" {
+			t.Fatalf("recv %q, want m0", got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait m0 timeout")
+	}
+	start, cpu := time.Now(), cpuTime()
+	time.Sleep(300 * time.Millisecond)
+	if used := cpuTime() - cpu; used > time.Since(start)/2 {
+		t.Fatalf("poller busy while paused: cpu %v in %v", used, time.Since(start))
+	}
+
+	close(h.release)
+	for i := 1; i < 5; i++ {
+		select {
+		case got := <-h.recv:
+			if want := fmt.Sprint("m", i); got != want {
+				t.Fatalf("recv %q, want %q", got, want)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("wait m%d timeout", i)
+		}
+	}
+	select {
+	case <-h.closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("half-closed conn not closed after queue drained")
+	}
+}
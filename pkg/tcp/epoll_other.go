@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package tcp
+
+import "net"
+
+// 非 linux 平台不支持 epoll, 服务端退回每连接独立协程的模式
+type pollerGroup struct{}
+
+type epollConn struct{}
+
+func newPollerGroup(n int, opt *tcpOption) (*pollerGroup, error) {
+	return nil, ErrEpollUnsupported
+}
+
+func (g *pollerGroup) newConn(conn net.Conn, opt *tcpOption, hs *Negotiated) *TCPConn { return nil }
+
+func (g *pollerGroup) add(c *TCPConn) error { return ErrEpollUnsupported }
+
+func (g *pollerGroup) close() {}
+
+func (c *TCPConn) epSend(sb *SharedBuf) error { return ErrEpollUnsupported }
+
+func (c *TCPConn) epDrain() {}
+
+func (c *TCPConn) epClose() {}
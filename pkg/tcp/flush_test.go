@@ -0,0 +1,94 @@
+package tcp_test
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+)
+
+// countConn 统计 Write 调用次数
+type countConn struct {
+	net.Conn
+	writes int32
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+// lateHandler 收到消息后先回复一批, 稍后再单独回复一条
+type lateHandler struct {
+	burst int
+}
+
+func (h *lateHandler) OnConnect(c *tcp.TCPConn) bool { return true }
+
+func (h *lateHandler) OnMessage(c *tcp.TCPConn, p tcp.Packet) bool {
+	for i := 0; i < h.burst; i++ {
+		c.AsyncSendPacket(&echoMsg{Text: "burst"})
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c.AsyncSendPacket(&echoMsg{Text: "lone"})
+	}()
+	return true
+}
+
+func (h *lateHandler) OnClose(c *tcp.TCPConn) {}
+
+func TestFlushLoneMessageAfterBurst(t *testing.T) {
+	lh := &lateHandler{burst: 200}
+	_, addr := startServer(t, lh, tcp.WithSendChanLimit(lh.burst), tcp.WithFlush(5*time.Second, 1<<20))
+
+	h := newRecvHandler("go")
+	h.recv = make(chan string, lh.burst+1)
+	client := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newTestParser()))
+	client.Start()
+	defer client.Close()
+
+	// 队列取空即写出, 不等待 maxLatency
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case text := <-h.recv:
+			if text == "lone" {
+				return
+			}
+		case <-deadline:
+			t.Fatal("lone message after burst not flushed")
+		}
+	}
+}
+
+func TestFlushCoalescesQueuedPackets(t *testing.T) {
+	qh := &queueHandler{n: 100, result: make(chan queueResult, 1)}
+	srv := tcp.NewTCPServer("pipe", tcp.NewTCPOption(qh, newTestParser(),
+		tcp.WithSendChanLimit(qh.n), tcp.WithFlush(time.Second, 1<<20)))
+	defer srv.Close()
+
+	var sc *countConn
+	dial := func(addr string) (net.Conn, error) {
+		cliConn, srvConn := net.Pipe()
+		sc = &countConn{Conn: srvConn}
+		go srv.ServeConn(sc)
+		return cliConn, nil
+	}
+	h := newRecvHandler("hi")
+	h.recv = make(chan string, qh.n)
+	client := tcp.NewTCPClient("pipe", 1, tcp.NewTCPOption(h, newTestParser(), tcp.WithDialer(dial)))
+	client.Start()
+	defer client.Close()
+
+	<-qh.result
+	for i := 0; i < qh.n; i++ {
+		waitRecv(t, h, fmt.Sprint("m", i))
+	}
+	if n := atomic.LoadInt32(&sc.writes); n > 5 {
+		t.Fatalf("%d queued packets written in %d writes, want coalesced", qh.n, n)
+	}
+}
@@ -0,0 +1,118 @@
+package tcp_test
+
+import (
+	"compress/flate"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+	"github.com/jinnblue/chatroom-test/pkg/tcp/protocol"
+)
+
+var (
+	testStreamProt     *protocol.GobProtocol
+	testStreamProtOnce sync.Once
+)
+
+func newStreamParser() *tcp.HeaderPacketParser {
+	testStreamProtOnce.Do(func() {
+		testStreamProt = protocol.NewGobStreamProtocol()
+		testStreamProt.Register(&echoMsg{})
+	})
+	return tcp.NewHeaderPacketParser(testStreamProt)
+}
+
+func TestGobStreamFrames(t *testing.T) {
+	parser := newStreamParser()
+	send, preamble := parser.NewStream()
+	if preamble == nil {
+		t.Fatal("stream without preamble")
+	}
+	defer preamble.Release()
+	recv, _ := parser.NewStream()
+
+	msg := &echoMsg{Text: "hello"}
+	frame, err := send.BuildPacketBuf(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 共享帧(广播)由协议的共享编码器生成, 与连接流的帧可互换
+	shared, err := parser.BuildPacketBuf(&echoMsg{Text: "broadcast"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateless, err := newTestParser().BuildPacketBuf(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frame) >= len(stateless)/2 {
+		t.Fatalf("stream frame %d bytes, stateless %d: type descriptors not elided", len(frame), len(stateless))
+	}
+
+	// 收到前导帧之前无法解码
+	if _, _, err := recv.(tcp.FrameDecoder).DecodeFrame(frame); err == nil {
+		t.Fatal("decoded stream frame before preamble")
+	}
+	recv, _ = parser.NewStream()
+	dec := recv.(tcp.FrameDecoder)
+	p, n, err := dec.DecodeFrame(preamble.Bytes())
+	if err != nil || p != nil || n != preamble.Len() {
+		t.Fatalf("preamble decode %v %d %v", p, n, err)
+	}
+	for _, tc := range []struct {
+		frame []byte
+		want  string
+	}{{frame, "hello"}, {shared, "broadcast"}, {frame, "hello"}, {stateless, "hello"}} {
+		p, _, err := dec.DecodeFrame(tc.frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.(*echoMsg).Text; got != tc.want {
+			t.Fatalf("decoded %q, want %q", got, tc.want)
+		}
+	}
+}
+
+func TestGobStreamConn(t *testing.T) {
+	for _, mode := range []struct {
+		name string
+		srv  []tcp.TCPOptionFn
+		cli  []tcp.TCPOptionFn
+	}{
+		{"goroutine", nil, nil},
+		{"epoll", []tcp.TCPOptionFn{tcp.WithEpoll(1)}, nil},
+		{"compress", []tcp.TCPOptionFn{tcp.WithCompression(flate.BestSpeed, 16)},
+			[]tcp.TCPOptionFn{tcp.WithCompression(flate.BestSpeed, 16)}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			srvH := &connRecvHandler{recvHandler: newRecvHandler("welcome"), conns: make(chan *tcp.TCPConn, 1)}
+			_, addr := startParserServer(t, srvH, newStreamParser(), mode.srv...)
+
+			h := newRecvHandler("hi")
+			client := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newStreamParser(), mode.cli...))
+			client.Start()
+			defer client.Close()
+
+			var c *tcp.TCPConn
+			select {
+			case c = <-srvH.conns:
+			case <-time.After(3 * time.Second):
+				t.Fatal("connect timeout")
+			}
+			waitRecv(t, h, "welcome")
+			waitRecv(t, srvH.recvHandler, "hi")
+
+			f := tcp.NewSharedFrames(&echoMsg{Text: "broadcast"})
+			if err := c.AsyncSendFrames(f); err != nil {
+				t.Fatal(err)
+			}
+			f.Release()
+			waitRecv(t, h, "broadcast")
+			if err := c.AsyncSendPacket(&echoMsg{Text: "direct"}); err != nil {
+				t.Fatal(err)
+			}
+			waitRecv(t, h, "direct")
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package tcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// 版本握手: 客户端连接(及 TLS 握手)后发送 hello 帧, 给出可接受的协议版本范围、按优先顺序的编码、
+// 是否开启压缩与功能位; 服务端选定双方都支持的最高版本、客户端最优先的共同编码, 回复协商结果.
+// 不兼容时服务端在回复中给出原因并关闭连接, 客户端得到 HandshakeError 且不再重连.
+// 握手在创建 TCPConn 之前完成, OnConnect 中可通过 TCPConn.Negotiated 读取结果.
+//
+// hello 帧使用连接配置的长度头, 负载为 | HANDSHAKE_MAGIC | json |
+const (
+	HANDSHAKE_MAGIC           = "\x00HELLO"
+	DEFAULT_HANDSHAKE_TIMEOUT = 5 * time.Second
+)
+
+var (
+	ErrHandshakeFrame = errors.New("invalid handshake frame")
+	// ErrNoHandshake 对端的首帧不是 hello, 多为未开启握手的旧客户端
+	ErrNoHandshake = fmt.Errorf("%w: missing magic, peer may not enable handshake", ErrHandshakeFrame)
+)
+
+// Codec 握手可协商的编码, Name 为两端约定的名称
+type Codec struct {
+	Name   string
+	Parser PacketParser
+}
+
+// Handshake 握手配置
+type Handshake struct {
+	Version    uint16        // 本端协议版本
+	MinVersion uint16        // 可接受的对端最低版本, 0 表示与 Version 相同
+	Codecs     []Codec       // 支持的编码, 按优先顺序
+	Features   uint32        // 本端支持的功能位
+	Required   uint32        // 对端必须支持的功能位
+	Timeout    time.Duration // 握手超时, <=0 时使用默认值
+}
+
+// Negotiated 握手协商结果
+type Negotiated struct {
+	Version  uint16
+	Codec    string
+	Compress bool
+	Features uint32 // 两端都支持的功能位
+	parser   PacketParser
+}
+
+// Has 是否协商了功能位 f, 未握手(nil)时返回 false
+func (n *Negotiated) Has(f uint32) bool {
+	return n != nil && n.Features&f == f
+}
+
+func (n *Negotiated) String() string {
+	return fmt.Sprintf("v%d %s compress:%v features:%#x", n.Version, n.Codec, n.Compress, n.Features)
+}
+
+// HandshakeError 握手被拒绝, Reason 为服务端给出的原因; Retry 为 true 时可稍后重连(如连接数超限)
+type HandshakeError struct {
+	Reason string
+	Retry  bool
+}
+
+func (e *HandshakeError) Error() string {
+	return "handshake rejected: " + e.Reason
+}
+
+// hello 握手帧内容, 客户端给出可选范围, 服务端回复选定结果或拒绝原因
+type hello struct {
+	Version    uint16
+	MinVersion uint16   `json:",omitempty"`
+	Codecs     []string `json:",omitempty"`
+	Compress   bool     `json:",omitempty"`
+	Features   uint32   `json:",omitempty"`
+	Required   uint32   `json:",omitempty"`
+	Err        string   `json:",omitempty"`
+	Retry      bool     `json:",omitempty"`
+}
+
+func (hs *Handshake) hello(compress bool) *hello {
+	h := &hello{
+		Version:    hs.Version,
+		MinVersion: hs.MinVersion,
+		Compress:   compress,
+		Features:   hs.Features,
+		Required:   hs.Required,
+	}
+	for _, c := range hs.Codecs {
+		h.Codecs = append(h.Codecs, c.Name)
+	}
+	return h
+}
+
+func (hs *Handshake) reject(reason string, retry bool) *hello {
+	h := hs.hello(false)
+	h.Err, h.Retry = reason, retry
+	return h
+}
+
+func (hs *Handshake) codec(name string) PacketParser {
+	for _, c := range hs.Codecs {
+		if c.Name == name {
+			return c.Parser
+		}
+	}
+	return nil
+}
+
+// negotiate 服务端按客户端 hello 选定版本、编码、压缩与功能位, 不兼容时返回原因
+func (hs *Handshake) negotiate(peer *hello, compress bool) (*Negotiated, string) {
+	n := &Negotiated{
+		Version:  hs.Version,
+		Compress: compress && peer.Compress,
+		Features: hs.Features & peer.Features,
+	}
+	if peer.Version < n.Version {
+		n.Version = peer.Version
+	}
+	if n.Version < hs.MinVersion || n.Version < peer.MinVersion {
+		return nil, fmt.Sprintf("protocol version %d-%d not supported, server supports %d-%d",
+			peer.MinVersion, peer.Version, hs.MinVersion, hs.Version)
+	}
+	for _, name := range peer.Codecs {
+		if p := hs.codec(name); p != nil {
+			n.Codec, n.parser = name, p
+			break
+		}
+	}
+	if n.parser == nil {
+		return nil, fmt.Sprintf("no common codec, client offers [%s], server supports [%s]",
+			strings.Join(peer.Codecs, " "), strings.Join(hs.hello(false).Codecs, " "))
+	}
+	if missing := hs.Required &^ peer.Features; missing != 0 {
+		return nil, fmt.Sprintf("client lacks required features %#x", missing)
+	}
+	if missing := peer.Required &^ hs.Features; missing != 0 {
+		return nil, fmt.Sprintf("server lacks features %#x required by client", missing)
+	}
+	return n, ""
+}
+
+// accept 校验服务端回复的协商结果
+func (hs *Handshake) accept(reply *hello, compress bool) (*Negotiated, error) {
+	if reply.Err != "" {
+		return nil, &HandshakeError{Reason: reply.Err, Retry: reply.Retry}
+	}
+	n := &Negotiated{Version: reply.Version, Compress: reply.Compress, Features: reply.Features}
+	if len(reply.Codecs) == 1 {
+		n.Codec = reply.Codecs[0]
+		n.parser = hs.codec(n.Codec)
+	}
+	switch {
+	case n.Version < hs.MinVersion || n.Version > hs.Version:
+		return nil, fmt.Errorf("%w: server chose version %d", ErrHandshakeFrame, n.Version)
+	case n.parser == nil:
+		return nil, fmt.Errorf("%w: server chose codec %v", ErrHandshakeFrame, reply.Codecs)
+	case n.Compress && !compress:
+		return nil, fmt.Errorf("%w: server chose compression", ErrHandshakeFrame)
+	case n.Features&^hs.Features != 0 || hs.Required&^n.Features != 0:
+		return nil, fmt.Errorf("%w: server chose features %#x", ErrHandshakeFrame, n.Features)
+	}
+	return n, nil
+}
+
+func writeHello(conn net.Conn, pp PayloadParser, h *hello) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	frame, err := pp.BuildFrameBuf(func(buf *bytes.Buffer) error {
+		buf.WriteString(HANDSHAKE_MAGIC)
+		buf.Write(data)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	defer frame.Release()
+	_, err = conn.Write(frame.Bytes())
+	return err
+}
+
+// readHello 读取一个 hello 帧, 只读取该帧的数据, 之后的数据留给连接
+func readHello(conn net.Conn, pp PayloadParser) (*hello, error) {
+	payload, err := pp.ReadPayload(conn)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(payload, []byte(HANDSHAKE_MAGIC)) {
+		return nil, ErrNoHandshake
+	}
+	h := &hello{}
+	if err := json.Unmarshal(payload[len(HANDSHAKE_MAGIC):], h); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrHandshakeFrame, err)
+	}
+	return h, nil
+}
+
+// acceptHandshake 服务端握手, 不兼容时回复原因后返回 HandshakeError
+func acceptHandshake(conn net.Conn, opt *tcpOption) (*Negotiated, error) {
+	hs := opt.handshake
+	pp := opt.parser.(PayloadParser)
+	conn.SetDeadline(time.Now().Add(hs.Timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	peer, err := readHello(conn, pp)
+	if err != nil {
+		return nil, err
+	}
+	n, reason := hs.negotiate(peer, opt.compress)
+	if n == nil {
+		writeHello(conn, pp, hs.reject(reason, false))
+		return nil, &HandshakeError{Reason: reason}
+	}
+	reply := &hello{Version: n.Version, Codecs: []string{n.Codec}, Compress: n.Compress, Features: n.Features}
+	if err := writeHello(conn, pp, reply); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// dialHandshake 客户端握手, 返回服务端选定的结果
+func dialHandshake(conn net.Conn, opt *tcpOption) (*Negotiated, error) {
+	hs := opt.handshake
+	pp := opt.parser.(PayloadParser)
+	conn.SetDeadline(time.Now().Add(hs.Timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := writeHello(conn, pp, hs.hello(opt.compress)); err != nil {
+		return nil, err
+	}
+	reply, err := readHello(conn, pp)
+	if err != nil {
+		return nil, err
+	}
+	return hs.accept(reply, opt.compress)
+}
+
+// Negotiated 握手协商结果, 未开启握手时为 nil
+func (c *TCPConn) Negotiated() *Negotiated {
+	return c.negotiated
+}
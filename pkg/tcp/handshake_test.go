@@ -0,0 +1,157 @@
+package tcp_test
+
+import (
+	"compress/flate"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+)
+
+// failHandler 记录客户端握手被拒绝的错误
+type failHandler struct {
+	*recvHandler
+	fails chan *tcp.HandshakeError
+}
+
+func newFailHandler() *failHandler {
+	return &failHandler{recvHandler: newRecvHandler("hi"), fails: make(chan *tcp.HandshakeError, 4)}
+}
+
+func (h *failHandler) OnHandshakeFail(err *tcp.HandshakeError) {
+	h.fails <- err
+}
+
+func serverHandshake(version, min uint16) tcp.TCPOptionFn {
+	return tcp.WithHandshake(tcp.Handshake{
+		Version:    version,
+		MinVersion: min,
+		Codecs:     []tcp.Codec{{Name: "gob", Parser: newTestParser()}, {Name: "json", Parser: newJSONParser()}},
+		Features:   0x3,
+	})
+}
+
+func waitFail(t *testing.T, h *failHandler) *tcp.HandshakeError {
+	t.Helper()
+	select {
+	case err := <-h.fails:
+		return err
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait handshake fail timeout")
+	}
+	return nil
+}
+
+func TestHandshakeNegotiate(t *testing.T) {
+	for _, mode := range []struct {
+		name string
+		opts []tcp.TCPOptionFn
+	}{
+		{"goroutine", nil},
+		{"epoll", []tcp.TCPOptionFn{tcp.WithEpoll(1)}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			opts := append(mode.opts, serverHandshake(3, 1), tcp.WithCompression(flate.BestSpeed, 16))
+			_, _, addr := startTestServer(t, opts...)
+
+			h := &connRecvHandler{recvHandler: newRecvHandler("hi"), conns: make(chan *tcp.TCPConn, 1)}
+			client := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newJSONParser(),
+				tcp.WithCompression(flate.BestSpeed, 16),
+				tcp.WithHandshake(tcp.Handshake{
+					Version:    2,
+					MinVersion: 1,
+					Codecs:     []tcp.Codec{{Name: "json", Parser: newJSONParser()}},
+					Features:   0x5,
+				})))
+			client.Start()
+			defer client.Close()
+
+			var c *tcp.TCPConn
+			select {
+			case c = <-h.conns:
+			case <-time.After(3 * time.Second):
+				t.Fatal("connect timeout")
+			}
+			n := c.Negotiated()
+			if n == nil || n.Version != 2 || n.Codec != "json" || !n.Compress || n.Features != 0x1 {
+				t.Fatalf("negotiated %v", n)
+			}
+			waitRecv(t, h.recvHandler, "hi")
+
+			long := strings.Repeat("compressible ", 20)
+			if err := c.AsyncSendPacket(&echoMsg{Text: long}); err != nil {
+				t.Fatal(err)
+			}
+			waitRecv(t, h.recvHandler, long)
+			if st := c.CompressStats(); st.WireIn == 0 || st.WireOut == 0 {
+				t.Fatalf("compress stats %v", st)
+			}
+		})
+	}
+}
+
+func TestHandshakeRejectVersion(t *testing.T) {
+	_, srvH, addr := startTestServer(t, serverHandshake(3, 2))
+
+	h := newFailHandler()
+	client := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newTestParser(),
+		tcp.WithReconnect(10*time.Millisecond, 20*time.Millisecond),
+		tcp.WithHandshake(tcp.Handshake{
+			Version: 1,
+			Codecs:  []tcp.Codec{{Name: "gob", Parser: newTestParser()}},
+		})))
+	client.Start()
+	defer client.Close()
+
+	err := waitFail(t, h)
+	if err.Retry || !strings.Contains(err.Reason, "protocol version 1-1 not supported, server supports 2-3") {
+		t.Fatalf("handshake error %v", err)
+	}
+	// 版本不兼容不再重连
+	select {
+	case err := <-h.fails:
+		t.Fatalf("reconnected after reject: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if n := atomic.LoadInt32(&srvH.connects); n != 0 {
+		t.Fatalf("server OnConnect %d times", n)
+	}
+}
+
+func TestHandshakeRejectConnLimit(t *testing.T) {
+	_, _, addr := startTestServer(t, serverHandshake(1, 1), tcp.WithMaxConns(1))
+	hs := tcp.WithHandshake(tcp.Handshake{
+		Version: 1,
+		Codecs:  []tcp.Codec{{Name: "gob", Parser: newTestParser()}},
+	})
+
+	first := newRecvHandler("hi")
+	c1 := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(first, newTestParser(), hs))
+	c1.Start()
+	defer c1.Close()
+	waitRecv(t, first, "hi")
+
+	h := newFailHandler()
+	c2 := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newTestParser(), hs))
+	c2.Start()
+	defer c2.Close()
+
+	if err := waitFail(t, h); !err.Retry || err.Reason != tcp.ErrTooManyConns.Error() {
+		t.Fatalf("handshake error %v", err)
+	}
+}
+
+// TestHandshakeOldClientNotice 未握手的旧客户端收到按服务端编码写出的通知后被关闭
+func TestHandshakeOldClientNotice(t *testing.T) {
+	_, addr := startServer(t, &rejectHandler{}, serverHandshake(1, 1))
+
+	h := newRecvHandler("hi")
+	client := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newTestParser()))
+	client.Start()
+	defer client.Close()
+
+	waitRecv(t, h, tcp.ErrNoHandshake.Error())
+	waitClosed(t, h)
+}
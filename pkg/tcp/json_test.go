@@ -0,0 +1,137 @@
+package tcp_test
+
+import (
+	"bufio"
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+	"github.com/jinnblue/chatroom-test/pkg/tcp/protocol"
+)
+
+var (
+	testJSONProt     *protocol.JSONProtocol
+	testJSONProtOnce sync.Once
+)
+
+func newJSONParser() *tcp.HeaderPacketParser {
+	testJSONProtOnce.Do(func() {
+		testJSONProt = protocol.NewJSONProtocol()
+		testJSONProt.Register(&echoMsg{})
+	})
+	return tcp.NewHeaderPacketParser(testJSONProt)
+}
+
+func TestJSONProtocol(t *testing.T) {
+	parser := newJSONParser()
+	frame, err := parser.BuildPacketBuf(&echoMsg{Text: "<hi> & bye"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"type":"echoMsg","data":{"Text":"<hi> & bye"}}`
+	if got := string(frame[tcp.LEN_BYTES:]); got != want {
+		t.Fatalf("payload %s, want %s", got, want)
+	}
+
+	// 其他语言手写的负载: 字段顺序不同、省略 data
+	var stream bytes.Buffer
+	stream.Write(frame)
+	for _, payload := range []string{
+		`{"data":{"Text":"reordered","ReqSeq":7},"type":"echoMsg"}`,
+		`{"type":"echoMsg"}`,
+	} {
+		stream.Write([]byte{0, byte(len(payload))})
+		stream.WriteString(payload)
+	}
+	data := stream.Bytes()
+
+	for _, size := range []int{4096, 16} {
+		r := bufio.NewReaderSize(bytes.NewReader(data), size)
+		var got []echoMsg
+		for i := 0; i < 3; i++ {
+			p, err := parser.ReadBufPacket(r)
+			if err != nil {
+				t.Fatalf("buf %d: packet %d: %v", size, i, err)
+			}
+			got = append(got, *p.(*echoMsg))
+		}
+		if got[0].Text != "<hi> & bye" || got[1].Text != "reordered" || got[1].ReqSeq != 7 || got[2].Text != "" {
+			t.Fatalf("buf %d: decoded %+v", size, got)
+		}
+	}
+
+	p, n, err := parser.DecodeFrame(data)
+	if err != nil || n != len(frame) || p.(*echoMsg).Text != "<hi> & bye" {
+		t.Fatalf("DecodeFrame %v %d %v", p, n, err)
+	}
+
+	if _, err := testJSONProt.Unmarshal([]byte(`{"type":"nosuch","data":{}}`)); err == nil {
+		t.Fatal("unmarshal unregistered type succeeded")
+	}
+	if _, err := testJSONProt.Unmarshal([]byte(`not json`)); err == nil {
+		t.Fatal("unmarshal invalid json succeeded")
+	}
+}
+
+// TestSharedFramesMixedCodecs 同一条广播按 gob、json 连接各自的格式编码一次
+func TestSharedFramesMixedCodecs(t *testing.T) {
+	start := func(parser tcp.PacketParser) (*connRecvHandler, string) {
+		h := &connRecvHandler{recvHandler: newRecvHandler("hello"), conns: make(chan *tcp.TCPConn, 1)}
+		_, addr := startParserServer(t, h, parser)
+		return h, addr
+	}
+	gobSrv, gobAddr := start(newTestParser())
+	jsonSrv, jsonAddr := start(newJSONParser())
+
+	var conns []*tcp.TCPConn
+	var clients []*recvHandler
+	for _, ep := range []struct {
+		srv    *connRecvHandler
+		addr   string
+		parser tcp.PacketParser
+	}{
+		{gobSrv, gobAddr, newTestParser()},
+		{jsonSrv, jsonAddr, newJSONParser()},
+	} {
+		h := newRecvHandler("hi")
+		client := tcp.NewTCPClient(ep.addr, 1, tcp.NewTCPOption(h, ep.parser))
+		client.Start()
+		t.Cleanup(client.Close)
+		select {
+		case c := <-ep.srv.conns:
+			conns = append(conns, c)
+		case <-time.After(3 * time.Second):
+			t.Fatal("connect timeout")
+		}
+		waitRecv(t, h, "hello")
+		clients = append(clients, h)
+	}
+
+	f := tcp.NewSharedFrames(&echoMsg{Text: "broadcast"})
+	gobBuf, err := f.For(conns[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonBuf, err := f.For(conns[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gobBuf == jsonBuf {
+		t.Fatal("gob and json connections share one frame")
+	}
+	if again, _ := f.For(conns[1]); again != jsonBuf {
+		t.Fatal("frame encoded twice for the same parser")
+	}
+	for _, c := range conns {
+		if err := c.AsyncSendFrames(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Release()
+
+	for _, h := range clients {
+		waitRecv(t, h, "broadcast")
+	}
+}
@@ -0,0 +1,74 @@
+package tcp
+
+import "reflect"
+
+// MessageHandler 处理一条消息, msgID 为协议中的消息标识, 返回 false 时断开连接
+type MessageHandler func(c *TCPConn, msgID string, p Packet) bool
+
+// Middleware 包装 Handler.OnMessage, 可在调用 next 前后做日志、鉴权、统计等; 不调用 next 即拦截该消息
+type Middleware func(next MessageHandler) MessageHandler
+
+// RouteFunc 把已解码的消息路由到处理函数, userData 为连接上的用户数据
+type RouteFunc func(msgID string, msg interface{}, userData interface{}) error
+
+// RouteMiddleware 包装 Protocol.Route, 返回错误时 Handler 断开连接, 返回 nil 且不调用 next 即忽略该消息
+type RouteMiddleware func(next RouteFunc) RouteFunc
+
+// MsgIdentifier Protocol、PacketParser 可选实现, 返回消息在协议中的标识
+type MsgIdentifier interface {
+	MsgID(msg interface{}) (string, error)
+}
+
+// Chain 按注册顺序组合中间件, mws[0] 最先执行
+func Chain(h MessageHandler, mws ...Middleware) MessageHandler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// ChainRoute 按注册顺序组合路由中间件, mws[0] 最先执行
+func ChainRoute(r RouteFunc, mws ...RouteMiddleware) RouteFunc {
+	for i := len(mws) - 1; i >= 0; i-- {
+		r = mws[i](r)
+	}
+	return r
+}
+
+// TypeName 消息类型名, 协议未提供消息标识时使用
+func TypeName(msg interface{}) string {
+	t := reflect.TypeOf(msg)
+	if t == nil {
+		return ""
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// packetID 由 parser 得到消息标识, 不支持时使用类型名
+func packetID(parser PacketParser, p Packet) string {
+	if mi, ok := parser.(MsgIdentifier); ok {
+		if id, err := mi.MsgID(p); err == nil {
+			return id
+		}
+	}
+	return TypeName(p)
+}
+
+// handleMessage Call 的响应交给调用方, 其余经过中间件后交给 Handler.OnMessage, panic 时只关闭该连接
+func (c *TCPConn) handleMessage(p Packet) (ok bool) {
+	defer func() {
+		if c.recoverPanic("OnMessage", recover()) {
+			ok = false
+		}
+	}()
+	if c.resolveCall(p) {
+		return true
+	}
+	if c.opt.onMessage == nil {
+		return c.opt.handler.OnMessage(c, p)
+	}
+	return c.opt.onMessage(c, packetID(c.base, p), p)
+}
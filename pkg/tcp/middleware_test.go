@@ -0,0 +1,113 @@
+package tcp_test
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+	"github.com/jinnblue/chatroom-test/pkg/tcp/protocol"
+)
+
+func TestMiddlewareOrderAndShortCircuit(t *testing.T) {
+	var mu sync.Mutex
+	var trace []string
+	record := func(name string) tcp.Middleware {
+		return func(next tcp.MessageHandler) tcp.MessageHandler {
+			return func(c *tcp.TCPConn, msgID string, p tcp.Packet) bool {
+				mu.Lock()
+				trace = append(trace, name+":"+msgID)
+				mu.Unlock()
+				return next(c, msgID, p)
+			}
+		}
+	}
+	block := func(next tcp.MessageHandler) tcp.MessageHandler {
+		return func(c *tcp.TCPConn, msgID string, p tcp.Packet) bool {
+			if p.(*echoMsg).Text == "blocked" {
+				return true
+			}
+			return next(c, msgID, p)
+		}
+	}
+
+	srv := tcp.NewTCPServer("pipe", tcp.NewTCPOption(&echoHandler{}, newTestParser(),
+		tcp.WithMiddleware(record("a"), block), tcp.WithMiddleware(record("b"))))
+	defer srv.Close()
+	cli, srvConn := net.Pipe()
+	go srv.ServeConn(srvConn)
+	defer cli.Close()
+
+	parser := newTestParser()
+	for _, text := range []string{"blocked", "hello"} {
+		if _, err := parser.WritePacket(cli, &echoMsg{Text: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cli.SetReadDeadline(time.Now().Add(3 * time.Second))
+	p, err := parser.ReadPacket(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.(*echoMsg).Text; got != "hello" {
+		t.Fatalf("recv %q, want hello", got)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"a:echoMsg", "a:echoMsg", "b:echoMsg"}
+	if len(trace) != len(want) {
+		t.Fatalf("trace %v, want %v", trace, want)
+	}
+	for i := range want {
+		if trace[i] != want[i] {
+			t.Fatalf("trace %v, want %v", trace, want)
+		}
+	}
+}
+
+type routeMsg struct {
+	tcp.Message
+}
+
+func TestRouteMiddleware(t *testing.T) {
+	prot := protocol.NewGobProtocol()
+	var handled []interface{}
+	prot.RegisterAndHandle(&routeMsg{}, func(param []interface{}) {
+		handled = append(handled, param[1])
+	})
+
+	errDenied := errors.New("denied")
+	var ids []string
+	prot.Use(func(next tcp.RouteFunc) tcp.RouteFunc {
+		return func(msgID string, msg interface{}, userData interface{}) error {
+			ids = append(ids, msgID)
+			return next(msgID, msg, userData)
+		}
+	}, func(next tcp.RouteFunc) tcp.RouteFunc {
+		return func(msgID string, msg interface{}, userData interface{}) error {
+			switch userData {
+			case "guest":
+				return nil
+			case "banned":
+				return errDenied
+			}
+			return next(msgID, msg, userData)
+		}
+	})
+
+	for _, user := range []string{"guest", "banned", "member"} {
+		err := prot.Route(&routeMsg{}, user)
+		if (user == "banned") != errors.Is(err, errDenied) {
+			t.Fatalf("route %s err %v", user, err)
+		}
+	}
+	if len(handled) != 1 || handled[0] != "member" {
+		t.Fatalf("handled %v, want [member]", handled)
+	}
+	if len(ids) != 3 || ids[0] != "routeMsg" {
+		t.Fatalf("middleware saw ids %v", ids)
+	}
+}
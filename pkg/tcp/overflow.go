@@ -0,0 +1,82 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// OverflowPolicy 发送队列已满时的处理策略
+type OverflowPolicy uint8
+
+const (
+	OVERFLOW_DROP_NEWEST OverflowPolicy = iota // 丢弃新消息并返回 ErrWriteBlocking, 默认
+	OVERFLOW_DROP_OLDEST                       // 丢弃队列中最旧的消息, 放入新消息
+	OVERFLOW_BLOCK                             // 阻塞等待队列空出, 超时后丢弃新消息
+	OVERFLOW_DISCONNECT                        // 断开慢速连接, 关闭原因为 ErrSlowConsumer
+)
+
+const DEFAULT_OVERFLOW_BLOCK_TIMEOUT = 100 * time.Millisecond
+
+var ErrSlowConsumer = errors.New("slow consumer: send queue overflow")
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OVERFLOW_DROP_NEWEST:
+		return "drop-newest"
+	case OVERFLOW_DROP_OLDEST:
+		return "drop-oldest"
+	case OVERFLOW_BLOCK:
+		return "block"
+	case OVERFLOW_DISCONNECT:
+		return "disconnect"
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", uint8(p))
+}
+
+// ParseOverflowPolicy 由名称(drop-newest/drop-oldest/block/disconnect)得到发送队列溢出策略
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	for _, p := range []OverflowPolicy{OVERFLOW_DROP_NEWEST, OVERFLOW_DROP_OLDEST, OVERFLOW_BLOCK, OVERFLOW_DISCONNECT} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return OVERFLOW_DROP_NEWEST, fmt.Errorf("unknown overflow policy %q", name)
+}
+
+// closeReason 包装关闭原因, atomic.Value 要求存入相同类型
+type closeReason struct {
+	err error
+}
+
+// overflow 发送队列已满, 按策略处理; push 尝试入队, evict 尝试丢弃一条最旧的消息
+func (c *TCPConn) overflow(push func() bool, evict func() bool, wait func(<-chan time.Time) bool) error {
+	switch c.opt.overflowPolicy {
+	case OVERFLOW_DROP_OLDEST:
+		for i := 0; i < c.opt.sendChanCapLimit; i++ {
+			if evict() {
+				c.addDropped()
+			}
+			if push() {
+				return nil
+			}
+		}
+	case OVERFLOW_BLOCK:
+		t := time.NewTimer(c.opt.overflowTimeout)
+		defer t.Stop()
+		if wait(t.C) {
+			return nil
+		}
+		if c.IsClosed() {
+			return ErrConnClosing
+		}
+	case OVERFLOW_DISCONNECT:
+		c.addDropped()
+		c.setCloseReason(ErrSlowConsumer)
+		// 调用方可能正持有房间等资源, 异步关闭避免 OnClose 重入
+		go c.Close()
+		return ErrSlowConsumer
+	}
+	c.addDropped()
+	return ErrWriteBlocking
+}
@@ -0,0 +1,102 @@
+package tcp_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+)
+
+// queueHandler 连接建立时(写协程启动前)向容量为2的发送队列排入 n 条消息
+type queueHandler struct {
+	n      int
+	result chan queueResult
+}
+
+type queueResult struct {
+	errs    []error
+	dropped uint64
+	reason  error
+}
+
+func (h *queueHandler) OnConnect(c *tcp.TCPConn) bool {
+	var r queueResult
+	for i := 0; i < h.n; i++ {
+		r.errs = append(r.errs, c.AsyncSendPacket(&echoMsg{Text: fmt.Sprint("m", i)}))
+	}
+	r.dropped = c.Dropped()
+	r.reason = c.CloseReason()
+	h.result <- r
+	return true
+}
+
+func (h *queueHandler) OnMessage(c *tcp.TCPConn, p tcp.Packet) bool { return true }
+
+func (h *queueHandler) OnClose(c *tcp.TCPConn) {}
+
+func runOverflow(t *testing.T, policy tcp.OverflowPolicy) (queueResult, *recvHandler) {
+	t.Helper()
+	qh := &queueHandler{n: 5, result: make(chan queueResult, 1)}
+	_, addr := startServer(t, qh, tcp.WithSendChanLimit(2), tcp.WithSendOverflow(policy, 20*time.Millisecond))
+
+	h := newRecvHandler("hi")
+	client := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newTestParser()))
+	client.Start()
+	t.Cleanup(client.Close)
+
+	select {
+	case r := <-qh.result:
+		return r, h
+	case <-time.After(3 * time.Second):
+		t.Fatal("server not connected")
+	}
+	return queueResult{}, nil
+}
+
+func TestOverflowDropNewest(t *testing.T) {
+	r, h := runOverflow(t, tcp.OVERFLOW_DROP_NEWEST)
+	if r.dropped != 3 || !errors.Is(r.errs[4], tcp.ErrWriteBlocking) {
+		t.Fatalf("dropped %d errs %v", r.dropped, r.errs)
+	}
+	waitRecv(t, h, "m0")
+	waitRecv(t, h, "m1")
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	r, h := runOverflow(t, tcp.OVERFLOW_DROP_OLDEST)
+	for i, err := range r.errs {
+		if err != nil {
+			t.Fatalf("send %d err %v", i, err)
+		}
+	}
+	if r.dropped != 3 {
+		t.Fatalf("dropped %d, want 3", r.dropped)
+	}
+	waitRecv(t, h, "m3")
+	waitRecv(t, h, "m4")
+}
+
+func TestOverflowBlockTimeout(t *testing.T) {
+	start := time.Now()
+	r, _ := runOverflow(t, tcp.OVERFLOW_BLOCK)
+	if r.dropped != 3 || !errors.Is(r.errs[2], tcp.ErrWriteBlocking) {
+		t.Fatalf("dropped %d errs %v", r.dropped, r.errs)
+	}
+	if d := time.Since(start); d < 60*time.Millisecond {
+		t.Fatalf("3 blocked sends took %v, want >= 60ms", d)
+	}
+}
+
+func TestOverflowDisconnect(t *testing.T) {
+	r, h := runOverflow(t, tcp.OVERFLOW_DISCONNECT)
+	if !errors.Is(r.errs[2], tcp.ErrSlowConsumer) || r.reason != tcp.ErrSlowConsumer {
+		t.Fatalf("errs %v reason %v", r.errs, r.reason)
+	}
+	select {
+	case <-h.closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("slow consumer not disconnected")
+	}
+}
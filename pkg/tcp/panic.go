@@ -0,0 +1,57 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// ErrPanic 处理消息时发生 panic, 作为连接的关闭原因
+var ErrPanic = errors.New("panic in handler")
+
+var panics uint64
+
+// Panics 已捕获的 panic 次数
+func Panics() uint64 {
+	return atomic.LoadUint64(&panics)
+}
+
+// LogPanic 记录 recover() 得到的 panic 及堆栈并计数, r 为 nil 时返回 false; 须在 defer 中调用:
+//
+//	defer func() { tcp.LogPanic("where", recover()) }()
+func LogPanic(where string, r interface{}) bool {
+	if r == nil {
+		return false
+	}
+	n := atomic.AddUint64(&panics, 1)
+	log.Printf("panic #%d in %s: %v\n%s", n, where, r, debug.Stack())
+	return true
+}
+
+// onConnect 调用 Handler.OnConnect, panic 时拒绝连接
+func (c *TCPConn) onConnect() (ok bool) {
+	defer func() {
+		if c.recoverPanic("OnConnect", recover()) {
+			ok = false
+		}
+	}()
+	return c.opt.handler.OnConnect(c)
+}
+
+// onClose 调用 Handler.OnClose, panic 不影响后续清理
+func (c *TCPConn) onClose() {
+	defer func() { c.recoverPanic("OnClose", recover()) }()
+	c.opt.handler.OnClose(c)
+}
+
+// recoverPanic 记录连接上发生的 panic, 并把 ErrPanic 记为关闭原因
+func (c *TCPConn) recoverPanic(where string, r interface{}) bool {
+	if r == nil {
+		return false
+	}
+	LogPanic(fmt.Sprintf("client:%d %s", c.OnlineIdx, where), r)
+	c.setCloseReason(ErrPanic)
+	return true
+}
@@ -0,0 +1,85 @@
+package tcp_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+)
+
+// panicHandler 收到 boom 时 panic, 其余消息回显; 记录被关闭连接的原因
+type panicHandler struct {
+	echoHandler
+	reasons chan error
+}
+
+func (h *panicHandler) OnMessage(c *tcp.TCPConn, p tcp.Packet) bool {
+	if p.(*echoMsg).Text == "boom" {
+		var user *echoMsg
+		_ = user.Text // nil pointer dereference
+	}
+	return h.echoHandler.OnMessage(c, p)
+}
+
+func (h *panicHandler) OnClose(c *tcp.TCPConn) {
+	h.reasons <- c.CloseReason()
+}
+
+func TestPanicClosesOnlyThatConn(t *testing.T) {
+	for _, mode := range []struct {
+		name string
+		opts []tcp.TCPOptionFn
+	}{
+		{"goroutine", nil},
+		{"epoll", []tcp.TCPOptionFn{tcp.WithEpoll(1)}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			h := &panicHandler{reasons: make(chan error, 2)}
+			_, addr := startServer(t, h, mode.opts...)
+
+			parser := newTestParser()
+			dial := func() net.Conn {
+				c, err := net.Dial("tcp", addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.SetReadDeadline(time.Now().Add(3 * time.Second))
+				return c
+			}
+			good, bad := dial(), dial()
+			defer good.Close()
+			defer bad.Close()
+
+			before := tcp.Panics()
+			if _, err := parser.WritePacket(bad, &echoMsg{Text: "boom"}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := parser.ReadPacket(bad); err == nil {
+				t.Fatal("panicking conn not closed")
+			}
+			select {
+			case reason := <-h.reasons:
+				if reason != tcp.ErrPanic {
+					t.Fatalf("close reason %v, want ErrPanic", reason)
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("OnClose not called")
+			}
+			if n := tcp.Panics() - before; n != 1 {
+				t.Fatalf("panics counted %d, want 1", n)
+			}
+
+			if _, err := parser.WritePacket(good, &echoMsg{Text: "still alive"}); err != nil {
+				t.Fatal(err)
+			}
+			p, err := parser.ReadPacket(good)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p.(*echoMsg).Text; got != "still alive" {
+				t.Fatalf("recv %q, want still alive", got)
+			}
+		})
+	}
+}
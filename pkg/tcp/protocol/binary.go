@@ -0,0 +1,285 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"reflect"
+
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+)
+
+const BINARY_ID_LEN = 2
+
+var ErrBinaryShort = errors.New("binary message too short")
+
+// BinaryMessage BinaryProtocol 要求消息实现的紧凑编码, 按固定顺序读写各字段;
+// 请求序号(tcp.Sequenced)由协议统一编码, 消息无需处理
+type BinaryMessage interface {
+	MarshalBinaryTo(w *BinaryWriter)
+	UnmarshalBinaryFrom(r *BinaryReader)
+}
+
+// BinaryProtocol 负载为 2字节消息编号|uvarint请求序号|字段;
+// 编号由消息名称哈希得到, 与注册顺序无关, 注册时检查冲突
+type BinaryProtocol struct {
+	registry
+	nums  map[string]uint16 // 消息名称 -> 编号
+	names map[uint16]string // 编号 -> 消息名称
+}
+
+func NewBinaryProtocol() *BinaryProtocol {
+	p := &BinaryProtocol{
+		nums:  make(map[string]uint16),
+		names: make(map[uint16]string),
+	}
+	p.init(func(msgID string, msg interface{}) {
+		if _, ok := msg.(BinaryMessage); !ok {
+			log.Fatalf("message %v does not implement BinaryMessage", msgID)
+		}
+		num := BinaryMsgNum(msgID)
+		if other, ok := p.names[num]; ok {
+			log.Fatalf("message %v and %v share binary id %d", msgID, other, num)
+		}
+		p.nums[msgID] = num
+		p.names[num] = msgID
+	})
+	return p
+}
+
+// BinaryMsgNum 由消息名称得到 BinaryProtocol 使用的编号
+func BinaryMsgNum(msgID string) uint16 {
+	h := fnv.New32a()
+	h.Write([]byte(msgID))
+	sum := h.Sum32()
+	return uint16(sum>>16) ^ uint16(sum)
+}
+
+// MsgNum 已注册消息的编号
+func (p *BinaryProtocol) MsgNum(msgID string) (uint16, bool) {
+	num, ok := p.nums[msgID]
+	return num, ok
+}
+
+func (p *BinaryProtocol) GetDecoder(r io.Reader) tcp.ProtDecoder {
+	return &binaryDecoder{r: r}
+}
+
+func (p *BinaryProtocol) GetEncoder(w io.Writer) tcp.ProtEncoder {
+	return &binaryEncoder{w: w}
+}
+
+func (p *BinaryProtocol) lookupNum(data []byte) (*MsgInfo, error) {
+	if len(data) < BINARY_ID_LEN {
+		return nil, ErrBinaryShort
+	}
+	num := binary.BigEndian.Uint16(data)
+	msgID, ok := p.names[num]
+	if !ok {
+		return nil, fmt.Errorf("message id %d not registered", num)
+	}
+	return p.lookup(msgID)
+}
+
+// Unmarshal 反序列化,goroutine safe
+func (p *BinaryProtocol) Unmarshal(data []byte) (interface{}, error) {
+	inf, err := p.lookupNum(data)
+	if err != nil {
+		return nil, err
+	}
+	msg := reflect.New(inf.msgType.Elem()).Interface()
+	if err := decodeBinaryBody(data[BINARY_ID_LEN:], msg); err != nil {
+		return nil, fmt.Errorf("message %v: %w", inf.msgType.Elem().Name(), err)
+	}
+	return msg, nil
+}
+
+// UnmarshalType 反序列化得到消息类型(MessageType),goroutine safe
+func (p *BinaryProtocol) UnmarshalType(data []byte) (reflect.Type, error) {
+	inf, err := p.lookupNum(data)
+	if err != nil {
+		return nil, err
+	}
+	return inf.msgType.Elem(), nil
+}
+
+// Marshal 序列化,goroutine safe
+func (p *BinaryProtocol) Marshal(msg interface{}) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, 256))
+	err := p.MarshalTo(buf, msg)
+	return buf.Bytes(), err
+}
+
+// MarshalTo 序列化追加到 buf, 实现 tcp.BufferMarshaler, goroutine safe
+func (p *BinaryProtocol) MarshalTo(buf *bytes.Buffer, msg interface{}) error {
+	msgID, err := p.MsgID(msg)
+	if err != nil {
+		return err
+	}
+
+	var head [BINARY_ID_LEN]byte
+	binary.BigEndian.PutUint16(head[:], p.nums[msgID])
+	buf.Write(head[:])
+	encodeBinaryBody(buf, msg.(BinaryMessage))
+	return nil
+}
+
+func encodeBinaryBody(buf *bytes.Buffer, msg BinaryMessage) {
+	w := (*BinaryWriter)(buf)
+	var seq uint32
+	if s, ok := msg.(tcp.Sequenced); ok {
+		seq = s.GetReqSeq()
+	}
+	w.Uvarint(uint64(seq))
+	msg.MarshalBinaryTo(w)
+}
+
+func decodeBinaryBody(data []byte, msg interface{}) error {
+	bm, ok := msg.(BinaryMessage)
+	if !ok {
+		return fmt.Errorf("%T does not implement BinaryMessage", msg)
+	}
+	r := &BinaryReader{data: data}
+	seq := r.Uint32()
+	if s, ok := msg.(tcp.Sequenced); ok {
+		s.SetReqSeq(seq)
+	}
+	bm.UnmarshalBinaryFrom(r)
+	return r.Err()
+}
+
+// binaryDecoder 读取 r 中剩余的全部数据, 解码为一条消息的字段
+type binaryDecoder struct {
+	r io.Reader
+}
+
+func (d *binaryDecoder) Decode(e interface{}) error {
+	if pi, ok := e.(*interface{}); ok {
+		e = *pi
+	}
+	data, err := io.ReadAll(d.r)
+	if err != nil {
+		return err
+	}
+	return decodeBinaryBody(data, e)
+}
+
+// binaryEncoder 把一条消息的字段写入 w
+type binaryEncoder struct {
+	w io.Writer
+}
+
+func (e *binaryEncoder) Encode(v interface{}) error {
+	if pi, ok := v.(*interface{}); ok {
+		v = *pi
+	}
+	bm, ok := v.(BinaryMessage)
+	if !ok {
+		return fmt.Errorf("%T does not implement BinaryMessage", v)
+	}
+	var buf bytes.Buffer
+	encodeBinaryBody(&buf, bm)
+	_, err := e.w.Write(buf.Bytes())
+	return err
+}
+
+// BinaryWriter 字段写入器, 整数使用变长编码, 字符串(Str)为 uvarint长度|字节
+type BinaryWriter bytes.Buffer
+
+func (w *BinaryWriter) Uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	(*bytes.Buffer)(w).Write(b[:n])
+}
+
+func (w *BinaryWriter) Varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(b[:], v)
+	(*bytes.Buffer)(w).Write(b[:n])
+}
+
+func (w *BinaryWriter) Str(s string) {
+	w.Uvarint(uint64(len(s)))
+	(*bytes.Buffer)(w).WriteString(s)
+}
+
+func (w *BinaryWriter) Bool(v bool) {
+	if v {
+		(*bytes.Buffer)(w).WriteByte(1)
+	} else {
+		(*bytes.Buffer)(w).WriteByte(0)
+	}
+}
+
+// BinaryReader 字段读取器, 出错后后续读取均返回零值, 由 Err 统一检查
+type BinaryReader struct {
+	data []byte
+	err  error
+}
+
+// Err 第一个读取错误
+func (r *BinaryReader) Err() error {
+	return r.err
+}
+
+func (r *BinaryReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+	r.data = nil
+}
+
+func (r *BinaryReader) Uvarint() uint64 {
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.fail(ErrBinaryShort)
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *BinaryReader) Uint32() uint32 {
+	v := r.Uvarint()
+	if v > math.MaxUint32 {
+		r.fail(errors.New("binary uint32 overflow"))
+		return 0
+	}
+	return uint32(v)
+}
+
+func (r *BinaryReader) Varint() int64 {
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.fail(ErrBinaryShort)
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *BinaryReader) Str() string {
+	n := r.Uvarint()
+	if n > uint64(len(r.data)) {
+		r.fail(ErrBinaryShort)
+		return ""
+	}
+	s := string(r.data[:n])
+	r.data = r.data[n:]
+	return s
+}
+
+func (r *BinaryReader) Bool() bool {
+	if len(r.data) < 1 {
+		r.fail(ErrBinaryShort)
+		return false
+	}
+	v := r.data[0] != 0
+	r.data = r.data[1:]
+	return v
+}
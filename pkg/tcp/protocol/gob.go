@@ -9,160 +9,314 @@ import (
 	"io"
 	"log"
 	"reflect"
+	"sort"
+	"sync"
 
 	"github.com/jinnblue/chatroom-test/pkg/tcp"
 )
 
+// GobProtocol 负载为 2字节名称长度|名称|gob数据, 名称为消息的线上标识(Identified);
+// gob 数据为消息的无名信封(见 gobEnvelope)
 type GobProtocol struct {
-	msgInfo map[string]*MsgInfo
+	registry
+	envelopes  map[reflect.Type]*gobEnvelope // 消息指针类型 -> 信封, 注册时生成
+	stream     bool
+	sharedOnce sync.Once
+	shared     *gobStreamEncoder // 流模式下编码广播等共享帧, 已发送过全部类型描述
 }
 
-type MsgInfo struct {
-	msgType    reflect.Type
-	msgHandler MsgHandler
-}
-
-type MsgHandler func([]interface{})
+const (
+	NAME_LEN        = 2
+	GOB_STREAM_FLAG = 0x8000 // 名称长度最高位: 数据只含值, 类型描述已在连接的前导帧中发送
+)
 
-const NAME_LEN = 2
+var ErrGobStream = errors.New("gob stream frame outside connection stream")
 
 func NewGobProtocol() *GobProtocol {
-	return &GobProtocol{
-		msgInfo: make(map[string]*MsgInfo),
-	}
+	p := &GobProtocol{envelopes: make(map[reflect.Type]*gobEnvelope)}
+	p.init(func(msgID string, msg interface{}) {
+		if len(msgID) >= GOB_STREAM_FLAG {
+			log.Fatalf("message %v: wire id too long", msgID)
+		}
+		msgType := reflect.TypeOf(msg)
+		env, err := newGobEnvelope(msgType.Elem())
+		if err != nil {
+			log.Fatalf("message %v: %v", msgID, err)
+		}
+		p.envelopes[msgType] = env
+		if p.stream {
+			// 前导帧编码各消息的零值, 注册时即检查能否编码
+			var buf bytes.Buffer
+			if err := p.encode(gob.NewEncoder(&buf), msg); err != nil {
+				log.Fatalf("message %v: %v", msgID, err)
+			}
+		}
+	})
+	return p
 }
 
-// Register 注册消息和路由
-func (p *GobProtocol) RegisterAndHandle(msg interface{}, h MsgHandler) {
-	msgID := p.Register(msg)
-	inf, ok := p.msgInfo[msgID]
-	if ok {
-		inf.msgHandler = h
-	}
+// NewGobStreamProtocol 连接级 gob 流: 每个连接先发送一次全部消息的类型描述, 此后的帧只含值;
+// 两端须同时使用
+func NewGobStreamProtocol() *GobProtocol {
+	p := NewGobProtocol()
+	p.stream = true
+	return p
 }
 
-// Register 注册消息
-func (p *GobProtocol) Register(msg interface{}) string {
-	msgType := reflect.TypeOf(msg)
-	if msgType == nil || msgType.Kind() != reflect.Ptr {
-		log.Fatal("gob message pointer required")
-	}
-	msgID := msgType.Elem().Name()
-	if msgID == "" {
-		log.Fatal("unnamed gob message")
-	}
-	if _, ok := p.msgInfo[msgID]; ok {
-		log.Fatalf("message %v is already registered", msgID)
-	}
-
-	//gob register
-	gob.Register(msg)
-
-	inf := new(MsgInfo)
-	inf.msgType = msgType
-	p.msgInfo[msgID] = inf
-	return msgID
-}
+// TypePrefixed 实现 tcp.TypePrefixed
+func (p *GobProtocol) TypePrefixed() {}
 
-// SetHandler 设置路由
-func (p *GobProtocol) SetHandler(msg interface{}, msgHandler MsgHandler) {
-	msgType := reflect.TypeOf(msg)
-	if msgType == nil || msgType.Kind() != reflect.Ptr {
-		log.Fatal("gob message pointer required")
-	}
-	msgID := msgType.Elem().Name()
-	i, ok := p.msgInfo[msgID]
-	if !ok {
-		log.Fatalf("message %v not registered", msgID)
+// NewStream 实现 tcp.StreamProtocol, 非流模式返回 nil
+func (p *GobProtocol) NewStream() tcp.ProtocolStream {
+	if !p.stream {
+		return nil
 	}
-
-	i.msgHandler = msgHandler
+	s := &gobStream{p: p}
+	var types []byte
+	s.enc, types = p.newStreamEncoder()
+	// 前导帧: 带流标志的空名称头|类型描述及各消息零值
+	s.preamble = make([]byte, NAME_LEN, NAME_LEN+len(types))
+	binary.BigEndian.PutUint16(s.preamble, GOB_STREAM_FLAG)
+	s.preamble = append(s.preamble, types...)
+	s.dec = gob.NewDecoder(&s.in)
+	return s
 }
 
-// Route 消息路由,goroutine safe
-func (p *GobProtocol) Route(msg interface{}, userData interface{}) error {
-	msgType := reflect.TypeOf(msg)
-	if msgType == nil || msgType.Kind() != reflect.Ptr {
-		return errors.New("gob message pointer required")
+// newStreamEncoder 创建编码器并依次编码所有已注册消息的零值, 返回的前导数据包含全部类型描述
+func (p *GobProtocol) newStreamEncoder() (*gobStreamEncoder, []byte) {
+	names := make([]string, 0, len(p.msgInfo))
+	for name := range p.msgInfo {
+		names = append(names, name)
 	}
-	msgID := msgType.Elem().Name()
-	i, ok := p.msgInfo[msgID]
-	if !ok {
-		return fmt.Errorf("message %v not registered", msgID)
-	}
-	if i.msgHandler != nil {
-		i.msgHandler([]interface{}{msg, userData})
+	sort.Strings(names)
+
+	e := &gobStreamEncoder{p: p}
+	e.enc = gob.NewEncoder(&e.out)
+	var buf bytes.Buffer
+	for _, name := range names {
+		msg := reflect.New(p.msgInfo[name].msgType.Elem()).Interface()
+		if err := e.encode(&buf, msg); err != nil {
+			// 注册时已检查过
+			panic(fmt.Sprintf("gob stream preamble %v: %v", name, err))
+		}
 	}
-	return nil
+	return e, buf.Bytes()
 }
 
 func (p *GobProtocol) GetDecoder(r io.Reader) tcp.ProtDecoder {
-	return gob.NewDecoder(r)
+	return newGobDecoder(p, r)
 }
 
 func (p *GobProtocol) GetEncoder(w io.Writer) tcp.ProtEncoder {
-	return gob.NewEncoder(w)
+	return &gobEncoder{p: p, enc: gob.NewEncoder(w)}
 }
 
 // Unmarshal gob反序列化,goroutine safe
 func (p *GobProtocol) Unmarshal(data []byte) (interface{}, error) {
-	if len(data) < NAME_LEN {
-		return nil, errors.New("message too short")
-	}
-	n := binary.BigEndian.Uint16(data) + NAME_LEN
-	if len(data) < int(n) {
-		return nil, errors.New("message no name")
-	}
-
-	msgID := string(data[NAME_LEN:n])
-	inf, ok := p.msgInfo[msgID]
-	if !ok {
-		return nil, fmt.Errorf("message %v not registered", msgID)
+	inf, n, err := p.header(data)
+	if err != nil {
+		return nil, err
 	}
 
 	msg := reflect.New(inf.msgType.Elem()).Interface()
 	br := bytes.NewReader(data[n:])
-	dec := gob.NewDecoder(br)
-	err := dec.Decode(&msg)
-	return msg, err
+	if err := p.decode(gob.NewDecoder(br), msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
 }
 
 // UnmarshalType gob反序列化得到消息类型(MessageType),goroutine safe
 func (p *GobProtocol) UnmarshalType(data []byte) (reflect.Type, error) {
-	if len(data) < NAME_LEN {
-		return nil, errors.New("message too short")
+	inf, _, err := p.header(data)
+	if err != nil {
+		return nil, err
+	}
+	return inf.msgType.Elem(), nil
+}
+
+// header 解析不带流标志的名称头, 返回消息信息及 gob 数据的起始位置
+func (p *GobProtocol) header(data []byte) (*MsgInfo, int, error) {
+	n, stream, err := splitName(data)
+	if err != nil {
+		return nil, 0, err
 	}
-	n := binary.BigEndian.Uint16(data) + NAME_LEN
-	if len(data) < int(n) {
-		return nil, errors.New("message no name")
+	if stream {
+		return nil, 0, ErrGobStream
 	}
+	inf, err := p.lookup(string(data[NAME_LEN:n]))
+	return inf, n, err
+}
 
-	msgID := string(data[NAME_LEN:n])
-	inf, ok := p.msgInfo[msgID]
-	if !ok {
-		return nil, fmt.Errorf("message %v not registered", msgID)
+// splitName 返回名称头长度及是否为流帧
+func splitName(data []byte) (int, bool, error) {
+	if len(data) < NAME_LEN {
+		return 0, false, errors.New("message too short")
 	}
-	return inf.msgType.Elem(), nil
+	l := binary.BigEndian.Uint16(data)
+	n := int(l&^GOB_STREAM_FLAG) + NAME_LEN
+	if len(data) < n {
+		return 0, false, errors.New("message no name")
+	}
+	return n, l&GOB_STREAM_FLAG != 0, nil
 }
 
 // Marshal gob序列化,goroutine safe
 func (p *GobProtocol) Marshal(msg interface{}) ([]byte, error) {
-	msgType := reflect.TypeOf(msg)
-	if msgType == nil || msgType.Kind() != reflect.Ptr {
-		return nil, errors.New("gob message pointer required")
+	buf := bytes.NewBuffer(make([]byte, 0, 4096))
+	err := p.MarshalTo(buf, msg)
+	return buf.Bytes(), err
+}
+
+// MarshalTo gob序列化追加到 buf, 实现 tcp.BufferMarshaler, goroutine safe
+func (p *GobProtocol) MarshalTo(buf *bytes.Buffer, msg interface{}) error {
+	msgID, err := p.MsgID(msg)
+	if err != nil {
+		return err
 	}
-	msgID := msgType.Elem().Name()
-	if _, ok := p.msgInfo[msgID]; !ok {
-		return nil, fmt.Errorf("message %v not registered", msgID)
+
+	if p.stream {
+		p.sharedOnce.Do(func() {
+			p.shared, _ = p.newStreamEncoder()
+		})
+		return p.shared.marshalTo(buf, msgID, msg)
 	}
 
-	n := len(msgID)
-	buf := bytes.NewBuffer(make([]byte, 2, 4096))
 	// msgid
-	binary.BigEndian.PutUint16(buf.Bytes(), uint16(n))
+	var head [NAME_LEN]byte
+	binary.BigEndian.PutUint16(head[:], uint16(len(msgID)))
+	buf.Write(head[:])
 	buf.WriteString(msgID)
 	// data
-	enc := gob.NewEncoder(buf)
-	err := enc.Encode(&msg)
+	return p.encode(gob.NewEncoder(buf), msg)
+}
+
+// gobStreamEncoder 长期存在的 gob 编码器, 每次编码写入调用方的缓冲, goroutine safe;
+// gob 类型编号在进程内全局唯一, 发送过全部类型描述的编码器之间输出可互换
+type gobStreamEncoder struct {
+	p   *GobProtocol
+	mu  sync.Mutex
+	out bufWriter
+	enc *gob.Encoder
+}
+
+type bufWriter struct {
+	buf *bytes.Buffer
+}
+
+func (w *bufWriter) Write(b []byte) (int, error) {
+	return w.buf.Write(b)
+}
+
+func (e *gobStreamEncoder) encode(buf *bytes.Buffer, msg interface{}) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.out.buf = buf
+	err := e.p.encode(e.enc, msg)
+	e.out.buf = nil
+	return err
+}
+
+// marshalTo 写入带流标志的名称头及只含值的 gob 数据
+func (e *gobStreamEncoder) marshalTo(buf *bytes.Buffer, msgID string, msg interface{}) error {
+	var head [NAME_LEN]byte
+	binary.BigEndian.PutUint16(head[:], uint16(len(msgID))|GOB_STREAM_FLAG)
+	buf.Write(head[:])
+	buf.WriteString(msgID)
+	return e.encode(buf, msg)
+}
+
+// gobStream 单个连接的 gob 流, 实现 tcp.ProtocolStream:
+// 前导帧发送全部类型描述, 解码器在连接生命周期内保留对端的类型描述
+type gobStream struct {
+	p        *GobProtocol
+	enc      *gobStreamEncoder
+	preamble []byte
+	mu       sync.Mutex
+	in       bytes.Reader // 当前帧的 gob 数据
+	dec      *gob.Decoder
+}
+
+func (s *gobStream) Preamble() []byte {
+	return s.preamble
+}
+
+func (s *gobStream) Route(msg interface{}, userData interface{}) error {
+	return s.p.Route(msg, userData)
+}
+
+func (s *gobStream) MsgID(msg interface{}) (string, error) {
+	return s.p.MsgID(msg)
+}
+
+func (s *gobStream) GetDecoder(r io.Reader) tcp.ProtDecoder {
+	return s.p.GetDecoder(r)
+}
+
+func (s *gobStream) GetEncoder(w io.Writer) tcp.ProtEncoder {
+	return s.p.GetEncoder(w)
+}
+
+// Unmarshal 流帧由连接的解码器解码, 前导帧返回 nil; 不带流标志的帧按无状态格式解码
+func (s *gobStream) Unmarshal(data []byte) (interface{}, error) {
+	n, stream, err := splitName(data)
+	if err != nil {
+		return nil, err
+	}
+	if !stream {
+		return s.p.Unmarshal(data)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.in.Reset(data[n:])
+	if n == NAME_LEN {
+		// 前导帧: 读取类型描述, 丢弃零值
+		for s.in.Len() > 0 {
+			if err := s.dec.DecodeValue(reflect.Value{}); err != nil {
+				return nil, fmt.Errorf("gob stream preamble: %w", err)
+			}
+		}
+		return nil, nil
+	}
+
+	inf, err := s.p.lookup(string(data[NAME_LEN:n]))
+	if err != nil {
+		return nil, err
+	}
+	msg := reflect.New(inf.msgType.Elem()).Interface()
+	if err := s.p.decode(s.dec, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (s *gobStream) UnmarshalType(data []byte) (reflect.Type, error) {
+	n, stream, err := splitName(data)
+	if err != nil {
+		return nil, err
+	}
+	if !stream {
+		return s.p.UnmarshalType(data)
+	}
+	inf, err := s.p.lookup(string(data[NAME_LEN:n]))
+	if err != nil {
+		return nil, err
+	}
+	return inf.msgType.Elem(), nil
+}
+
+func (s *gobStream) Marshal(msg interface{}) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, 256))
+	err := s.MarshalTo(buf, msg)
 	return buf.Bytes(), err
 }
+
+// MarshalTo 实现 tcp.BufferMarshaler, 使用连接的编码器
+func (s *gobStream) MarshalTo(buf *bytes.Buffer, msg interface{}) error {
+	msgID, err := s.p.MsgID(msg)
+	if err != nil {
+		return err
+	}
+	return s.enc.marshalTo(buf, msgID, msg)
+}
@@ -0,0 +1,181 @@
+package protocol
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"reflect"
+	"unsafe"
+)
+
+// gobEnvelope 消息在 gob 中的编码类型: 由 reflect.StructOf 生成的无名结构体,
+// 嵌入的结构体按 encoding/json 的规则展开, 命名基础类型(如枚举)换成底层类型;
+// 未导出字段以同类型的空白字段 "_" 占位, gob 不编码; gob 类型描述中只有字段名与基础类型, 线上不出现 Go 类型名
+type gobEnvelope struct {
+	typ    reflect.Type
+	fields [][]int // 导出字段在消息中的索引路径
+	slots  []int   // 导出字段在信封中的序号
+	view   bool    // 信封与消息内存布局相同, 直接把消息内存视为信封, 不复制字段
+}
+
+var basicTypes = map[reflect.Kind]reflect.Type{
+	reflect.Bool:       reflect.TypeOf(false),
+	reflect.Int:        reflect.TypeOf(int(0)),
+	reflect.Int8:       reflect.TypeOf(int8(0)),
+	reflect.Int16:      reflect.TypeOf(int16(0)),
+	reflect.Int32:      reflect.TypeOf(int32(0)),
+	reflect.Int64:      reflect.TypeOf(int64(0)),
+	reflect.Uint:       reflect.TypeOf(uint(0)),
+	reflect.Uint8:      reflect.TypeOf(uint8(0)),
+	reflect.Uint16:     reflect.TypeOf(uint16(0)),
+	reflect.Uint32:     reflect.TypeOf(uint32(0)),
+	reflect.Uint64:     reflect.TypeOf(uint64(0)),
+	reflect.Float32:    reflect.TypeOf(float32(0)),
+	reflect.Float64:    reflect.TypeOf(float64(0)),
+	reflect.Complex64:  reflect.TypeOf(complex64(0)),
+	reflect.Complex128: reflect.TypeOf(complex128(0)),
+	reflect.String:     reflect.TypeOf(""),
+}
+
+// newGobEnvelope 为消息结构体 t 生成信封类型, 字段类型不受支持或展开后重名时返回错误
+func newGobEnvelope(t reflect.Type) (*gobEnvelope, error) {
+	e := &gobEnvelope{}
+	var sfs []reflect.StructField
+	seen := make(map[string]bool)
+	var offsets []uintptr
+	var walk func(t reflect.Type, index []int, base uintptr) error
+	walk = func(t reflect.Type, index []int, base uintptr) error {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			path := append(index[:len(index):len(index)], i)
+			if f.Anonymous && f.Type.Kind() == reflect.Struct {
+				if err := walk(f.Type, path, base+f.Offset); err != nil {
+					return err
+				}
+				continue
+			}
+			if f.PkgPath != "" {
+				sfs = append(sfs, reflect.StructField{Name: "_", PkgPath: f.PkgPath, Type: f.Type})
+				offsets = append(offsets, base+f.Offset)
+				continue
+			}
+			wt, err := gobWireType(f.Type)
+			if err != nil {
+				return fmt.Errorf("field %s: %w", f.Name, err)
+			}
+			if seen[f.Name] {
+				return fmt.Errorf("duplicate field %s", f.Name)
+			}
+			seen[f.Name] = true
+			e.fields = append(e.fields, path)
+			e.slots = append(e.slots, len(sfs))
+			sfs = append(sfs, reflect.StructField{Name: f.Name, Type: wt})
+			offsets = append(offsets, base+f.Offset)
+		}
+		return nil
+	}
+	if err := walk(t, nil, 0); err != nil {
+		return nil, err
+	}
+	e.typ = reflect.StructOf(sfs)
+	// 字段类型只换成同样表示的底层类型, 偏移一致即布局相同
+	e.view = e.typ.Size() <= t.Size()
+	for i, off := range offsets {
+		if e.typ.Field(i).Offset != off {
+			e.view = false
+		}
+	}
+	return e, nil
+}
+
+// gobWireType 字段在信封中的类型: 基础类型取底层类型, 切片、数组、map 须由无名基础类型组成
+func gobWireType(t reflect.Type) (reflect.Type, error) {
+	if bt, ok := basicTypes[t.Kind()]; ok {
+		return bt, nil
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		if t.Name() == "" && basicTypes[t.Elem().Kind()] == t.Elem() {
+			return t, nil
+		}
+	case reflect.Map:
+		if t.Name() == "" && basicTypes[t.Key().Kind()] == t.Key() && basicTypes[t.Elem().Kind()] == t.Elem() {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported gob field type %v", t)
+}
+
+// wrap 返回消息 msg(结构体指针)对应的信封值, 布局不同时复制字段
+func (e *gobEnvelope) wrap(msg reflect.Value) reflect.Value {
+	if e.view {
+		return reflect.NewAt(e.typ, unsafe.Pointer(msg.Pointer())).Elem()
+	}
+	src := msg.Elem()
+	env := reflect.New(e.typ).Elem()
+	for i, path := range e.fields {
+		f := env.Field(e.slots[i])
+		f.Set(src.FieldByIndex(path).Convert(f.Type()))
+	}
+	return env
+}
+
+// unwrap 把信封 env 的字段复制回消息 msg(结构体指针)
+func (e *gobEnvelope) unwrap(env, msg reflect.Value) {
+	dst := msg.Elem()
+	for i, path := range e.fields {
+		f := dst.FieldByIndex(path)
+		f.Set(env.Field(e.slots[i]).Convert(f.Type()))
+	}
+}
+
+// gobEncoder 按信封编码已注册的消息
+type gobEncoder struct {
+	p   *GobProtocol
+	enc *gob.Encoder
+}
+
+func (e *gobEncoder) Encode(msg interface{}) error {
+	return e.p.encode(e.enc, msg)
+}
+
+// gobDecoder 按信封解码已注册的消息
+type gobDecoder struct {
+	p   *GobProtocol
+	dec *gob.Decoder
+}
+
+func (d *gobDecoder) Decode(msg interface{}) error {
+	return d.p.decode(d.dec, msg)
+}
+
+func newGobDecoder(p *GobProtocol, r io.Reader) *gobDecoder {
+	return &gobDecoder{p: p, dec: gob.NewDecoder(r)}
+}
+
+// encode 已注册的消息按信封编码, 其余值直接编码
+func (p *GobProtocol) encode(enc *gob.Encoder, msg interface{}) error {
+	v := reflect.ValueOf(msg)
+	if e := p.envelopes[v.Type()]; e != nil {
+		return enc.EncodeValue(e.wrap(v))
+	}
+	return enc.Encode(msg)
+}
+
+// decode 已注册的消息按信封解码, 其余值直接解码
+func (p *GobProtocol) decode(dec *gob.Decoder, msg interface{}) error {
+	v := reflect.ValueOf(msg)
+	e := p.envelopes[v.Type()]
+	if e == nil {
+		return dec.Decode(msg)
+	}
+	if e.view {
+		return dec.DecodeValue(reflect.NewAt(e.typ, unsafe.Pointer(v.Pointer())))
+	}
+	env := reflect.New(e.typ)
+	if err := dec.DecodeValue(env); err != nil {
+		return err
+	}
+	e.unwrap(env.Elem(), v)
+	return nil
+}
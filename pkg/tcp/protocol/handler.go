@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// Session Route 的 userData, 处理函数通过它取得连接的 context
+type Session interface {
+	Context() context.Context
+}
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	sessionType = reflect.TypeOf((*Session)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// typedHandler 通过反射注册的处理函数 func(ctx context.Context, s S, msg *M) [error],
+// S 实现 Session, *M 为消息类型
+type typedHandler struct {
+	fn       reflect.Value
+	sessType reflect.Type
+	msgType  reflect.Type
+}
+
+// newTypedHandler 校验处理函数签名, 签名不符时返回错误
+func newTypedHandler(h interface{}) (*typedHandler, error) {
+	fn := reflect.ValueOf(h)
+	if h == nil || fn.Kind() != reflect.Func {
+		return nil, fmt.Errorf("handler %T is not a func", h)
+	}
+	ft := fn.Type()
+	if ft.NumIn() != 3 || ft.In(0) != contextType {
+		return nil, fmt.Errorf("handler %v: want func(context.Context, Session, *Msg)", ft)
+	}
+	if !ft.In(1).Implements(sessionType) {
+		return nil, fmt.Errorf("handler %v: %v does not implement Session", ft, ft.In(1))
+	}
+	msgType := ft.In(2)
+	if msgType.Kind() != reflect.Ptr || msgType.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("handler %v: message %v is not a struct pointer", ft, msgType)
+	}
+	switch {
+	case ft.NumOut() == 0:
+	case ft.NumOut() == 1 && ft.Out(0) == errorType:
+	default:
+		return nil, fmt.Errorf("handler %v: may only return error", ft)
+	}
+	return &typedHandler{fn: fn, sessType: ft.In(1), msgType: msgType}, nil
+}
+
+// call 调用处理函数, userData 类型与注册的 Session 不符时返回错误
+func (h *typedHandler) call(msg, userData interface{}) error {
+	sess, ok := userData.(Session)
+	if !ok || !reflect.TypeOf(userData).AssignableTo(h.sessType) {
+		return fmt.Errorf("session %T is not %v", userData, h.sessType)
+	}
+	ctx := sess.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	out := h.fn.Call([]reflect.Value{
+		reflect.ValueOf(&ctx).Elem(),
+		reflect.ValueOf(userData),
+		reflect.ValueOf(msg),
+	})
+	if len(out) == 1 && !out[0].IsNil() {
+		return out[0].Interface().(error)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+)
+
+// JSONProtocol 负载为 {"type":"类型名","data":{...}}, 便于其他语言脚本或 nc 调试
+type JSONProtocol struct {
+	registry
+}
+
+// jsonEnvelope JSON 负载外层
+type jsonEnvelope struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+func NewJSONProtocol() *JSONProtocol {
+	p := &JSONProtocol{}
+	p.init(nil)
+	return p
+}
+
+func (p *JSONProtocol) GetDecoder(r io.Reader) tcp.ProtDecoder {
+	return json.NewDecoder(r)
+}
+
+func (p *JSONProtocol) GetEncoder(w io.Writer) tcp.ProtEncoder {
+	return json.NewEncoder(w)
+}
+
+// Unmarshal json反序列化,goroutine safe
+func (p *JSONProtocol) Unmarshal(data []byte) (interface{}, error) {
+	var env jsonEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+	inf, err := p.lookupType(env.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := reflect.New(inf.msgType.Elem()).Interface()
+	if len(env.Data) == 0 {
+		return msg, nil
+	}
+	if err := json.Unmarshal(env.Data, msg); err != nil {
+		return nil, fmt.Errorf("message %v: %w", env.Type, err)
+	}
+	return msg, nil
+}
+
+// UnmarshalType json反序列化得到消息类型(MessageType),goroutine safe
+func (p *JSONProtocol) UnmarshalType(data []byte) (reflect.Type, error) {
+	var env struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+	inf, err := p.lookupType(env.Type)
+	if err != nil {
+		return nil, err
+	}
+	return inf.msgType.Elem(), nil
+}
+
+func (p *JSONProtocol) lookupType(msgID string) (*MsgInfo, error) {
+	if msgID == "" {
+		return nil, errors.New("message no type")
+	}
+	return p.lookup(msgID)
+}
+
+// Marshal json序列化,goroutine safe
+func (p *JSONProtocol) Marshal(msg interface{}) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, 512))
+	err := p.MarshalTo(buf, msg)
+	return buf.Bytes(), err
+}
+
+// MarshalTo json序列化追加到 buf, 实现 tcp.BufferMarshaler, goroutine safe
+func (p *JSONProtocol) MarshalTo(buf *bytes.Buffer, msg interface{}) error {
+	msgID, err := p.MsgID(msg)
+	if err != nil {
+		return err
+	}
+
+	buf.WriteString(`{"type":`)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(msgID); err != nil {
+		return err
+	}
+	buf.Truncate(buf.Len() - 1) // Encode 末尾的换行
+	buf.WriteString(`,"data":`)
+	if err := enc.Encode(msg); err != nil {
+		return err
+	}
+	buf.Truncate(buf.Len() - 1)
+	buf.WriteByte('}')
+	return nil
+}
@@ -0,0 +1,237 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+)
+
+// Protocol 可注册消息与处理函数的 tcp.Protocol, GobProtocol、JSONProtocol 均实现
+type Protocol interface {
+	tcp.Protocol
+	Register(msg interface{}) string
+	RegisterAndHandle(msg interface{}, h MsgHandler)
+	Handle(h interface{})
+	Use(mws ...tcp.RouteMiddleware)
+}
+
+// Codecs New 支持的编码格式名称
+var Codecs = []string{"gob", "gobstream", "json", "binary"}
+
+// New 按编码格式名称(gob/gobstream/json/binary)创建协议
+func New(codec string) (Protocol, error) {
+	switch codec {
+	case "gob":
+		return NewGobProtocol(), nil
+	case "gobstream":
+		return NewGobStreamProtocol(), nil
+	case "json":
+		return NewJSONProtocol(), nil
+	case "binary":
+		return NewBinaryProtocol(), nil
+	}
+	return nil, fmt.Errorf("unknown codec %q", codec)
+}
+
+// Identified 消息可选实现, 给出线上使用的消息标识(各编码格式的类型名称、binary 编号均由它得到);
+// 标识与 Go 类型名无关, 类型改名或不同包的同名类型不影响线上格式. 未实现时使用类型名
+type Identified interface {
+	WireID() string
+}
+
+// CheckWireIDs 检查一组消息(如客户端与服务端的全部消息)都声明了线上标识且互不重复
+func CheckWireIDs(msgs ...interface{}) error {
+	seen := make(map[string]reflect.Type)
+	for _, msg := range msgs {
+		msgType := reflect.TypeOf(msg)
+		im, ok := msg.(Identified)
+		if !ok {
+			return fmt.Errorf("message %v does not declare a wire id", msgType)
+		}
+		id := im.WireID()
+		if id == "" {
+			return fmt.Errorf("message %v has an empty wire id", msgType)
+		}
+		if other, ok := seen[id]; ok {
+			return fmt.Errorf("wire id %q used by both %v and %v", id, other, msgType)
+		}
+		seen[id] = msgType
+	}
+	return nil
+}
+
+// wireID 消息类型的线上标识
+func wireID(msgType reflect.Type) string {
+	if im, ok := reflect.New(msgType.Elem()).Interface().(Identified); ok {
+		return im.WireID()
+	}
+	return msgType.Elem().Name()
+}
+
+type MsgInfo struct {
+	msgType    reflect.Type
+	msgHandler MsgHandler
+	typed      *typedHandler
+}
+
+type MsgHandler func([]interface{})
+
+// registry 消息注册与路由, 由各编码格式的协议嵌入
+type registry struct {
+	msgInfo     map[string]*MsgInfo // 线上标识 -> 消息
+	ids         map[reflect.Type]string
+	middlewares []tcp.RouteMiddleware
+	route       tcp.RouteFunc                       // 组合中间件后的路由
+	sessType    reflect.Type                        // Handle 注册的处理函数使用的 Session 类型
+	onRegister  func(msgID string, msg interface{}) // 注册消息时通知编码器, 如 gob.Register
+}
+
+func (p *registry) init(onRegister func(msgID string, msg interface{})) {
+	p.msgInfo = make(map[string]*MsgInfo)
+	p.ids = make(map[reflect.Type]string)
+	p.route = p.dispatch
+	p.onRegister = onRegister
+}
+
+// Use 注册路由中间件, 先注册的先执行; 须在开始收发消息前调用
+func (p *registry) Use(mws ...tcp.RouteMiddleware) {
+	p.middlewares = append(p.middlewares, mws...)
+	p.route = tcp.ChainRoute(p.dispatch, p.middlewares...)
+}
+
+// RegisterAndHandle 注册消息和路由
+func (p *registry) RegisterAndHandle(msg interface{}, h MsgHandler) {
+	msgID := p.Register(msg)
+	inf, ok := p.msgInfo[msgID]
+	if ok {
+		inf.msgHandler = h
+	}
+}
+
+// Register 注册消息
+func (p *registry) Register(msg interface{}) string {
+	msgType := reflect.TypeOf(msg)
+	if msgType == nil || msgType.Kind() != reflect.Ptr {
+		log.Fatal("message pointer required")
+	}
+	if _, ok := p.ids[msgType]; ok {
+		log.Fatalf("message %v is already registered", msgType)
+	}
+	msgID := wireID(msgType)
+	if msgID == "" {
+		log.Fatalf("message %v: invalid wire id %q", msgType, msgID)
+	}
+	if inf, ok := p.msgInfo[msgID]; ok {
+		log.Fatalf("message %v: wire id %q already used by %v", msgType, msgID, inf.msgType)
+	}
+
+	if p.onRegister != nil {
+		p.onRegister(msgID, msg)
+	}
+
+	inf := new(MsgInfo)
+	inf.msgType = msgType
+	p.msgInfo[msgID] = inf
+	p.ids[msgType] = msgID
+	return msgID
+}
+
+// Handle 按处理函数签名 func(ctx context.Context, s S, msg *M) [error] 注册消息 M 及其路由,
+// ctx 为 s.Context(), 即连接关闭时取消的 context; 签名不符、各处理函数的 S 不一致或重复注册时启动即失败
+func (p *registry) Handle(h interface{}) {
+	th, err := newTypedHandler(h)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if p.sessType != nil && th.sessType != p.sessType {
+		log.Fatalf("handler %v: session %v, want %v", th.fn.Type(), th.sessType, p.sessType)
+	}
+	p.sessType = th.sessType
+
+	msgID, ok := p.ids[th.msgType]
+	if !ok {
+		msgID = p.Register(reflect.New(th.msgType.Elem()).Interface())
+	}
+	inf := p.msgInfo[msgID]
+	if inf.msgHandler != nil || inf.typed != nil {
+		log.Fatalf("message %v already has a handler", th.msgType)
+	}
+	inf.typed = th
+}
+
+// SetHandler 设置路由
+func (p *registry) SetHandler(msg interface{}, msgHandler MsgHandler) {
+	msgType := reflect.TypeOf(msg)
+	if msgType == nil || msgType.Kind() != reflect.Ptr {
+		log.Fatal("message pointer required")
+	}
+	msgID, ok := p.ids[msgType]
+	if !ok {
+		log.Fatalf("message %v not registered", msgType)
+	}
+
+	p.msgInfo[msgID].msgHandler = msgHandler
+}
+
+// MsgID 消息的线上标识, 实现 tcp.MsgIdentifier, goroutine safe
+func (p *registry) MsgID(msg interface{}) (string, error) {
+	msgType := reflect.TypeOf(msg)
+	if msgType == nil || msgType.Kind() != reflect.Ptr {
+		return "", errors.New("message pointer required")
+	}
+	msgID, ok := p.ids[msgType]
+	if !ok {
+		return "", fmt.Errorf("message %v not registered", msgType.Elem().Name())
+	}
+	return msgID, nil
+}
+
+// RegisteredMsg 已注册的消息
+type RegisteredMsg struct {
+	WireID string
+	Type   reflect.Type // 消息结构体类型(非指针)
+}
+
+// Messages 按线上标识排序的全部已注册消息, 可用于生成协议文档
+func (p *registry) Messages() []RegisteredMsg {
+	msgs := make([]RegisteredMsg, 0, len(p.msgInfo))
+	for id, inf := range p.msgInfo {
+		msgs = append(msgs, RegisteredMsg{WireID: id, Type: inf.msgType.Elem()})
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].WireID < msgs[j].WireID })
+	return msgs
+}
+
+// lookup 由消息标识得到注册信息
+func (p *registry) lookup(msgID string) (*MsgInfo, error) {
+	inf, ok := p.msgInfo[msgID]
+	if !ok {
+		return nil, fmt.Errorf("message %v not registered", msgID)
+	}
+	return inf, nil
+}
+
+// Route 消息路由, 依次经过中间件, goroutine safe
+func (p *registry) Route(msg interface{}, userData interface{}) error {
+	msgID, err := p.MsgID(msg)
+	if err != nil {
+		return err
+	}
+	return p.route(msgID, msg, userData)
+}
+
+// dispatch 调用注册的处理函数
+func (p *registry) dispatch(msgID string, msg interface{}, userData interface{}) error {
+	i := p.msgInfo[msgID]
+	if i.typed != nil {
+		return i.typed.call(msg, userData)
+	}
+	if i.msgHandler != nil {
+		i.msgHandler([]interface{}{msg, userData})
+	}
+	return nil
+}
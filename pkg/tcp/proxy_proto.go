@@ -0,0 +1,166 @@
+package tcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DEFAULT_PROXY_HEADER_TIMEOUT 读取 PROXY protocol 头的最长时间
+const DEFAULT_PROXY_HEADER_TIMEOUT = 3 * time.Second
+
+const (
+	proxyV1MaxLen = 107 // 含结尾 \r\n
+	proxyV2HdrLen = 16
+)
+
+var (
+	ErrProxyHeader = errors.New("invalid PROXY protocol header")
+
+	proxyV1Sig = []byte("PROXY ")
+	proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyHeader PROXY protocol 头中的地址, 健康检查(LOCAL、UNKNOWN)时为 nil
+type proxyHeader struct {
+	src net.Addr
+	dst net.Addr
+}
+
+// readProxyHeader 读取 PROXY protocol v1 或 v2 头, 按需逐段读取, 不会读入头之后的数据
+func readProxyHeader(r io.Reader) (*proxyHeader, error) {
+	var sig [proxyV2HdrLen]byte
+	if _, err := io.ReadFull(r, sig[:len(proxyV1Sig)]); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig[:len(proxyV1Sig)], proxyV1Sig) {
+		return readProxyV1(r)
+	}
+	if !bytes.Equal(sig[:len(proxyV1Sig)], proxyV2Sig[:len(proxyV1Sig)]) {
+		return nil, fmt.Errorf("%w: missing signature", ErrProxyHeader)
+	}
+	if _, err := io.ReadFull(r, sig[len(proxyV1Sig):]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(sig[:len(proxyV2Sig)], proxyV2Sig) {
+		return nil, fmt.Errorf("%w: missing signature", ErrProxyHeader)
+	}
+	return readProxyV2(r, sig[:])
+}
+
+// readProxyV1 文本格式: PROXY TCP4 src dst sport dport\r\n
+func readProxyV1(r io.Reader) (*proxyHeader, error) {
+	line := make([]byte, 0, proxyV1MaxLen)
+	line = append(line, proxyV1Sig...)
+	var b [1]byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, fmt.Errorf("%w: v1 header too long", ErrProxyHeader)
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &proxyHeader{}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrProxyHeader, line)
+	}
+	src, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	return &proxyHeader{src: src, dst: dst}, nil
+}
+
+func parseProxyAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("%w: address %s:%s", ErrProxyHeader, host, port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyV2 二进制格式: 12字节签名 | 版本与命令 | 地址族与协议 | 2字节长度 | 地址 | TLV
+func readProxyV2(r io.Reader, hdr []byte) (*proxyHeader, error) {
+	verCmd, fam := hdr[12], hdr[13]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("%w: version %d", ErrProxyHeader, verCmd>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch verCmd & 0x0f {
+	case 0x0: // LOCAL: 负载均衡器自身的连接, 如健康检查
+		return &proxyHeader{}, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("%w: command %d", ErrProxyHeader, verCmd&0x0f)
+	}
+
+	switch fam >> 4 {
+	case 0x1: // AF_INET
+		if len(body) < 12 {
+			return nil, fmt.Errorf("%w: short ipv4 address", ErrProxyHeader)
+		}
+		return &proxyHeader{
+			src: &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))},
+			dst: &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:]))},
+		}, nil
+	case 0x2: // AF_INET6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("%w: short ipv6 address", ErrProxyHeader)
+		}
+		return &proxyHeader{
+			src: &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))},
+			dst: &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:]))},
+		}, nil
+	}
+	// AF_UNSPEC、AF_UNIX 保留原地址
+	return &proxyHeader{}, nil
+}
+
+// acceptProxy 来自可信代理的连接先读取 PROXY protocol 头, 返回客户端真实地址; 非可信来源返回 nil
+func (server *TCPServer) acceptProxy(conn net.Conn) (*proxyHeader, error) {
+	if !server.opt.proxyProtocol {
+		return nil, nil
+	}
+	if !containsIP(server.opt.proxyTrusted, net.ParseIP(remoteIP(conn.RemoteAddr()))) {
+		return nil, nil
+	}
+
+	conn.SetReadDeadline(time.Now().Add(DEFAULT_PROXY_HEADER_TIMEOUT))
+	hdr, err := readProxyHeader(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return hdr, nil
+}
+
+// setProxy 记录代理转发的客户端地址
+func (c *TCPConn) setProxy(hdr *proxyHeader) {
+	if hdr == nil || hdr.src == nil {
+		return
+	}
+	c.proxyBy = c.rawConn.RemoteAddr()
+	c.remoteAddr = hdr.src
+	c.localAddr = hdr.dst
+}
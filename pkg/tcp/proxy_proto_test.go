@@ -0,0 +1,154 @@
+package tcp_test
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+)
+
+// addrHandler 回显消息, 并记录连接的客户端地址与代理地址
+type addrHandler struct {
+	echoHandler
+	addrs chan [2]string
+}
+
+func (h *addrHandler) OnConnect(c *tcp.TCPConn) bool {
+	via := ""
+	if p := c.ProxyAddr(); p != nil {
+		via = p.String()
+	}
+	h.addrs <- [2]string{c.RemoteAddr().String(), via}
+	return true
+}
+
+func proxyV1(src string) []byte {
+	return []byte("PROXY TCP4 " + src + " 10.0.0.1 4242 20000\r\n")
+}
+
+func proxyV2(src net.IP) []byte {
+	hdr := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	hdr = append(hdr, 0x21, 0x11, 0, 12)
+	hdr = append(hdr, src.To4()...)
+	hdr = append(hdr, 10, 0, 0, 1)
+	var ports [4]byte
+	binary.BigEndian.PutUint16(ports[:], 4242)
+	binary.BigEndian.PutUint16(ports[2:], 20000)
+	return append(hdr, ports[:]...)
+}
+
+func startProxyServer(t *testing.T, opts ...tcp.TCPOptionFn) (*addrHandler, string) {
+	t.Helper()
+	h := &addrHandler{addrs: make(chan [2]string, 4)}
+	_, addr := startServer(t, h, opts...)
+	return h, addr
+}
+
+// dialWithHeader 写入 header 后发送一条消息, 收到回显说明头之后的数据未被吞掉
+func dialWithHeader(t *testing.T, addr string, header []byte) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(3 * time.Second))
+	parser := newTestParser()
+	frame, err := parser.BuildPacketBuf(&echoMsg{Text: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(append(header, frame...)); err != nil {
+		t.Fatal(err)
+	}
+	p, err := parser.ReadPacket(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.(*echoMsg).Text; got != "hi" {
+		t.Fatalf("recv %q, want hi", got)
+	}
+	return c
+}
+
+func TestProxyProtocol(t *testing.T) {
+	for _, mode := range []struct {
+		name string
+		opts []tcp.TCPOptionFn
+	}{
+		{"goroutine", nil},
+		{"epoll", []tcp.TCPOptionFn{tcp.WithEpoll(1)}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			h, addr := startProxyServer(t, append(mode.opts, tcp.WithProxyProtocol("127.0.0.1"))...)
+			for _, header := range [][]byte{proxyV1("203.0.113.7"), proxyV2(net.IPv4(203, 0, 113, 7))} {
+				dialWithHeader(t, addr, header)
+				got := <-h.addrs
+				if got[0] != "203.0.113.7:4242" || got[1] == "" {
+					t.Fatalf("remote %s via %q, want 203.0.113.7:4242 via proxy", got[0], got[1])
+				}
+			}
+		})
+	}
+}
+
+func TestProxyProtocolUntrustedSource(t *testing.T) {
+	h, addr := startProxyServer(t, tcp.WithProxyProtocol("10.0.0.0/8"))
+
+	// 非可信来源不解析 PROXY 头, 按直连处理
+	dialWithHeader(t, addr, nil)
+	got := <-h.addrs
+	if host, _, _ := net.SplitHostPort(got[0]); host != "127.0.0.1" || got[1] != "" {
+		t.Fatalf("remote %s via %q, want direct 127.0.0.1", got[0], got[1])
+	}
+}
+
+func TestProxyProtocolPerIPLimit(t *testing.T) {
+	_, addr := startProxyServer(t, tcp.WithProxyProtocol("127.0.0.1"), tcp.WithMaxConnsPerIP(1))
+
+	// 同一代理转发的不同客户端分别计数
+	dialWithHeader(t, addr, proxyV1("198.51.100.1"))
+	dialWithHeader(t, addr, proxyV1("198.51.100.2"))
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write(proxyV1("198.51.100.1"))
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := newTestParser().ReadPacket(c); err == nil {
+		t.Fatal("second conn from same client ip not rejected")
+	}
+}
+
+// TestProxyProtocolCountsPendingHeader 尚未发送 PROXY 头的连接也占用全局名额
+func TestProxyProtocolCountsPendingHeader(t *testing.T) {
+	h, addr := startProxyServer(t, tcp.WithProxyProtocol("127.0.0.1"), tcp.WithMaxConns(1))
+
+	stalled, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write(proxyV1("198.51.100.1"))
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := newTestParser().ReadPacket(c); err == nil {
+		t.Fatal("conn accepted while the only slot is held by a pending PROXY header")
+	}
+
+	stalled.Close()
+	time.Sleep(50 * time.Millisecond)
+	dialWithHeader(t, addr, proxyV1("198.51.100.1"))
+	if got := <-h.addrs; got[0] != "198.51.100.1:4242" {
+		t.Fatalf("remote %s, want 198.51.100.1:4242", got[0])
+	}
+}
@@ -0,0 +1,161 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ThrottlePolicy 连接超出限速时的处理策略
+type ThrottlePolicy uint8
+
+const (
+	THROTTLE_DROP       ThrottlePolicy = iota // 丢弃超出限速的包
+	THROTTLE_DELAY                            // 暂停读取直到令牌足够, 由 TCP 流控反压对端
+	THROTTLE_DISCONNECT                       // 断开连接
+)
+
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// DEFAULT_THROTTLE_NOTICE_GAP 同一连接两次限速回调的最小间隔
+const DEFAULT_THROTTLE_NOTICE_GAP = time.Second
+
+func (p ThrottlePolicy) String() string {
+	switch p {
+	case THROTTLE_DROP:
+		return "drop"
+	case THROTTLE_DELAY:
+		return "delay"
+	case THROTTLE_DISCONNECT:
+		return "disconnect"
+	}
+	return fmt.Sprintf("ThrottlePolicy(%d)", uint8(p))
+}
+
+// ParseThrottlePolicy 由名称(drop/delay/disconnect)得到限速策略
+func ParseThrottlePolicy(name string) (ThrottlePolicy, error) {
+	for _, p := range []ThrottlePolicy{THROTTLE_DROP, THROTTLE_DELAY, THROTTLE_DISCONNECT} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return THROTTLE_DROP, fmt.Errorf("unknown throttle policy %q", name)
+}
+
+// RateLimit 每连接接收限速, 速率为0表示不限制该项, 突发为0时取1秒的速率
+type RateLimit struct {
+	PacketsPerSec float64
+	PacketBurst   int
+	BytesPerSec   float64
+	ByteBurst     int
+	Policy        ThrottlePolicy
+}
+
+// tokenBucket 令牌桶, 仅由 readLoop 使用, 非并发安全
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	b := float64(burst)
+	if b <= 0 {
+		b = rate
+	}
+	if b < 1 {
+		b = 1
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// allow 令牌足够时扣除并返回 true, 超过突发容量的请求按桶满处理
+func (b *tokenBucket) allow(n float64, now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.refill(now)
+	if n > b.burst {
+		n = b.burst
+	}
+	return b.tokens >= n
+}
+
+func (b *tokenBucket) take(n float64) {
+	if b != nil {
+		b.tokens -= n
+	}
+}
+
+// reserve 扣除令牌(可透支), 返回令牌补足所需的等待时间
+func (b *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimiter 包速率与字节速率两个令牌桶
+type rateLimiter struct {
+	packets    *tokenBucket
+	bytes      *tokenBucket
+	policy     ThrottlePolicy
+	lastNotice time.Time
+}
+
+func newRateLimiter(cfg *RateLimit) *rateLimiter {
+	if cfg == nil || (cfg.PacketsPerSec <= 0 && cfg.BytesPerSec <= 0) {
+		return nil
+	}
+	now := time.Now()
+	return &rateLimiter{
+		packets: newTokenBucket(cfg.PacketsPerSec, cfg.PacketBurst, now),
+		bytes:   newTokenBucket(cfg.BytesPerSec, cfg.ByteBurst, now),
+		policy:  cfg.Policy,
+	}
+}
+
+// limit 计入一个 size 字节的包, 返回是否放行以及放行前需等待的时间
+func (l *rateLimiter) limit(size int, now time.Time) (ok bool, wait time.Duration) {
+	n := float64(size)
+	if l.policy == THROTTLE_DELAY {
+		wait = l.packets.reserve(1, now)
+		if w := l.bytes.reserve(n, now); w > wait {
+			wait = w
+		}
+		return true, wait
+	}
+
+	if !l.packets.allow(1, now) || !l.bytes.allow(n, now) {
+		return false, 0
+	}
+	l.packets.take(1)
+	l.bytes.take(n)
+	return true, 0
+}
+
+// shouldNotice 限制限速回调频率
+func (l *rateLimiter) shouldNotice(now time.Time) bool {
+	if now.Sub(l.lastNotice) < DEFAULT_THROTTLE_NOTICE_GAP {
+		return false
+	}
+	l.lastNotice = now
+	return true
+}
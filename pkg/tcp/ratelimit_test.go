@@ -0,0 +1,111 @@
+package tcp_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+)
+
+// throttleHandler 回显消息, 被限速时通知对端
+type throttleHandler struct {
+	echoHandler
+	policies chan tcp.ThrottlePolicy
+}
+
+func (h *throttleHandler) OnThrottle(c *tcp.TCPConn, policy tcp.ThrottlePolicy) {
+	h.policies <- policy
+	c.AsyncSendPacket(&echoMsg{Text: "throttled"})
+}
+
+// floodHandler 连接后立即连续发送 n 条消息
+type floodHandler struct {
+	*recvHandler
+	n int
+}
+
+func (h *floodHandler) OnConnect(c *tcp.TCPConn) bool {
+	for i := 0; i < h.n; i++ {
+		c.AsyncSendPacket(&echoMsg{Text: fmt.Sprint("m", i)})
+	}
+	return true
+}
+
+func startThrottleServer(t *testing.T, limit tcp.RateLimit) (*throttleHandler, string) {
+	t.Helper()
+	h := &throttleHandler{policies: make(chan tcp.ThrottlePolicy, 16)}
+	_, addr := startServer(t, h, tcp.WithRateLimit(limit))
+	return h, addr
+}
+
+func startFloodClient(t *testing.T, addr string, n int) *floodHandler {
+	t.Helper()
+	h := &floodHandler{recvHandler: newRecvHandler(""), n: n}
+	h.recv = make(chan string, 2*n)
+	client := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newTestParser(), tcp.WithSendChanLimit(n)))
+	client.Start()
+	t.Cleanup(client.Close)
+	return h
+}
+
+func TestRateLimitDrop(t *testing.T) {
+	sh, addr := startThrottleServer(t, tcp.RateLimit{PacketsPerSec: 1, PacketBurst: 3, Policy: tcp.THROTTLE_DROP})
+	h := startFloodClient(t, addr, 10)
+
+	// 突发内的3条回显, 其余丢弃, 通知只发送一次
+	time.Sleep(300 * time.Millisecond)
+	echoed, notices := 0, 0
+	for len(h.recv) > 0 {
+		if <-h.recv == "throttled" {
+			notices++
+		} else {
+			echoed++
+		}
+	}
+	if echoed != 3 || notices != 1 {
+		t.Fatalf("echoed %d notices %d, want 3 and 1", echoed, notices)
+	}
+	if p := <-sh.policies; p != tcp.THROTTLE_DROP || len(sh.policies) != 0 {
+		t.Fatalf("throttle policy %v, notices %d", p, len(sh.policies)+1)
+	}
+}
+
+func TestRateLimitDelay(t *testing.T) {
+	_, addr := startThrottleServer(t, tcp.RateLimit{PacketsPerSec: 50, PacketBurst: 1, Policy: tcp.THROTTLE_DELAY})
+	start := time.Now()
+	h := startFloodClient(t, addr, 10)
+
+	for i := 0; i < 10; i++ {
+		got := <-h.recv
+		if got == "throttled" {
+			got = <-h.recv
+		}
+		if want := fmt.Sprint("m", i); got != want {
+			t.Fatalf("recv %q, want %q", got, want)
+		}
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Fatalf("10 packets at 50/s took %v, want delayed", d)
+	}
+}
+
+func TestRateLimitDisconnect(t *testing.T) {
+	_, addr := startThrottleServer(t, tcp.RateLimit{BytesPerSec: 10, ByteBurst: 100, Policy: tcp.THROTTLE_DISCONNECT})
+	h := startFloodClient(t, addr, 10)
+
+	select {
+	case <-h.closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("flooding client not disconnected")
+	}
+	var notified bool
+	for len(h.recv) > 0 {
+		if <-h.recv == "throttled" {
+			notified = true
+		}
+	}
+	if !notified {
+		t.Fatal("throttle notice not received before disconnect")
+	}
+}
@@ -0,0 +1,113 @@
+package tcp_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+	"github.com/jinnblue/chatroom-test/pkg/tcp/protocol"
+)
+
+// ctxHandler 记录连接的 context
+type ctxHandler struct {
+	echoHandler
+	ctxs chan context.Context
+}
+
+func (h *ctxHandler) OnConnect(c *tcp.TCPConn) bool {
+	h.ctxs <- c.Context()
+	return true
+}
+
+func TestConnContextCancelledOnClose(t *testing.T) {
+	for _, mode := range []struct {
+		name string
+		opts []tcp.TCPOptionFn
+	}{
+		{"goroutine", nil},
+		{"epoll", []tcp.TCPOptionFn{tcp.WithEpoll(1)}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			h := &ctxHandler{ctxs: make(chan context.Context, 1)}
+			_, addr := startServer(t, h, mode.opts...)
+
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := <-h.ctxs
+			if ctx.Err() != nil {
+				t.Fatal("context cancelled before close")
+			}
+			c.Close()
+			select {
+			case <-ctx.Done():
+			case <-time.After(3 * time.Second):
+				t.Fatal("context not cancelled after close")
+			}
+		})
+	}
+}
+
+type testSession struct {
+	ctx  context.Context
+	name string
+}
+
+func (s *testSession) Context() context.Context { return s.ctx }
+
+type otherSession struct {
+	testSession
+}
+
+type typedMsg struct {
+	tcp.Message
+	Text string
+}
+
+func TestTypedHandler(t *testing.T) {
+	prot := protocol.NewGobProtocol()
+	errBad := errors.New("bad")
+	var got []string
+	prot.Handle(func(ctx context.Context, s *testSession, msg *typedMsg) error {
+		if ctx != s.ctx {
+			t.Error("handler ctx is not session ctx")
+		}
+		if msg.Text == "bad" {
+			return errBad
+		}
+		got = append(got, s.name+":"+msg.Text)
+		return nil
+	})
+
+	// Handle 同时注册了消息类型
+	parser := tcp.NewHeaderPacketParser(prot)
+	frame, err := parser.BuildPacketBuf(&typedMsg{Text: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _, err := parser.DecodeFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testSession{ctx: context.Background(), name: "alice"}
+	if err := prot.Route(p, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := prot.Route(&typedMsg{Text: "bad"}, s); err != errBad {
+		t.Fatalf("route err %v, want handler error", err)
+	}
+	if err := prot.Route(&typedMsg{Text: "x"}, &otherSession{}); err == nil {
+		t.Fatal("route with wrong session type succeeded")
+	}
+	if err := prot.Route(&typedMsg{Text: "x"}, nil); err == nil {
+		t.Fatal("route with nil session succeeded")
+	}
+	if len(got) != 1 || got[0] != "alice:hi" {
+		t.Fatalf("handled %v, want [alice:hi]", got)
+	}
+}
@@ -0,0 +1,152 @@
+package tcp
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	SHARED_BUF_SIZE     = 4096      // 池中缓冲初始容量
+	MAX_SHARED_BUF_SIZE = 64 * 1024 // 超过该容量的缓冲不放回池中, 避免长期占用大块内存
+)
+
+// BufferMarshaler Protocol 可选实现, 直接序列化到调用方提供的缓冲, 省去中间 []byte
+type BufferMarshaler interface {
+	MarshalTo(buf *bytes.Buffer, msg interface{}) error
+}
+
+// SharedBufBuilder PacketParser 可选实现, 把带帧头的完整数据编码到池化的 SharedBuf
+type SharedBufBuilder interface {
+	BuildSharedBuf(msg Packet) (*SharedBuf, error)
+}
+
+// SharedBuf 引用计数的发送缓冲, 广播时编码一次后由所有接收者共享;
+// 每个持有者用完后 Release, 计数归零时放回池中
+type SharedBuf struct {
+	refs   int32
+	off    int
+	b      []byte
+	pooled bool
+
+	altOnce sync.Once // 压缩帧等变体只生成一次, 由协商了相同格式的接收者共享
+	alt     *SharedBuf
+	altErr  error
+}
+
+var sharedBufPool = sync.Pool{
+	New: func() interface{} {
+		return &SharedBuf{b: make([]byte, 0, SHARED_BUF_SIZE), pooled: true}
+	},
+}
+
+// getSharedBuf 从池中取出缓冲, 引用计数为1
+func getSharedBuf() *SharedBuf {
+	sb := sharedBufPool.Get().(*SharedBuf)
+	sb.refs = 1
+	return sb
+}
+
+// NewSharedBuf 包装已有数据, 不放回池中, 引用计数为1
+func NewSharedBuf(b []byte) *SharedBuf {
+	return &SharedBuf{refs: 1, b: b}
+}
+
+// Bytes 完整帧数据, Release 后不可再使用
+func (sb *SharedBuf) Bytes() []byte {
+	return sb.b[sb.off:]
+}
+
+func (sb *SharedBuf) Len() int {
+	return len(sb.b) - sb.off
+}
+
+// variant 返回由 build 从本帧生成的变体帧, 随本缓冲一起释放
+func (sb *SharedBuf) variant(build func(frame []byte) (*SharedBuf, error)) (*SharedBuf, error) {
+	sb.altOnce.Do(func() {
+		sb.alt, sb.altErr = build(sb.Bytes())
+	})
+	return sb.alt, sb.altErr
+}
+
+// Retain 增加一个持有者
+func (sb *SharedBuf) Retain() *SharedBuf {
+	atomic.AddInt32(&sb.refs, 1)
+	return sb
+}
+
+// Release 释放一个持有者, 最后一个持有者释放时放回池中
+func (sb *SharedBuf) Release() {
+	refs := atomic.AddInt32(&sb.refs, -1)
+	if refs > 0 {
+		return
+	}
+	if refs < 0 {
+		panic("tcp: SharedBuf released too many times")
+	}
+	if sb.alt != nil {
+		sb.alt.Release()
+		sb.alt = nil
+	}
+	sb.altOnce = sync.Once{}
+	sb.altErr = nil
+	if !sb.pooled || cap(sb.b) > MAX_SHARED_BUF_SIZE {
+		return
+	}
+	sb.off = 0
+	sb.b = sb.b[:0]
+	sharedBufPool.Put(sb)
+}
+
+// SharedFrames 同一消息按接收连接的 PacketParser 编码的帧, 广播给使用不同协议的连接时每种格式只编码一次;
+// 非 goroutine safe, 由广播方持有, 用完后 Release
+type SharedFrames struct {
+	msg    Packet
+	parser PacketParser // 首个格式, 多数广播只有一种
+	buf    *SharedBuf
+	others map[PacketParser]*SharedBuf
+}
+
+func NewSharedFrames(msg Packet) *SharedFrames {
+	return &SharedFrames{msg: msg}
+}
+
+// For 返回连接 c 所用格式的帧, 该格式首次出现时编码; 缓冲由 SharedFrames 持有, 调用方无需 Release
+func (f *SharedFrames) For(c *TCPConn) (*SharedBuf, error) {
+	return f.forParser(c.base)
+}
+
+func (f *SharedFrames) forParser(parser PacketParser) (*SharedBuf, error) {
+	if f.buf != nil && f.parser == parser {
+		return f.buf, nil
+	}
+	if sb, ok := f.others[parser]; ok {
+		return sb, nil
+	}
+
+	sb, err := buildSharedBuf(parser, f.msg)
+	if err != nil {
+		return nil, err
+	}
+	if f.buf == nil {
+		f.parser, f.buf = parser, sb
+		return sb, nil
+	}
+	if f.others == nil {
+		f.others = make(map[PacketParser]*SharedBuf)
+	}
+	f.others[parser] = sb
+	return sb, nil
+}
+
+// Release 释放各格式的帧
+func (f *SharedFrames) Release() {
+	if f.buf != nil {
+		f.buf.Release()
+		f.buf = nil
+	}
+	for parser, sb := range f.others {
+		sb.Release()
+		delete(f.others, parser)
+	}
+}
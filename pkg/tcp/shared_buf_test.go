@@ -0,0 +1,218 @@
+package tcp_test
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+)
+
+// sharedRelayHandler 收到消息后编码一次, 以共享缓冲广播给所有连接
+type sharedRelayHandler struct {
+	mu    sync.Mutex
+	conns []*tcp.TCPConn
+}
+
+func (h *sharedRelayHandler) OnConnect(c *tcp.TCPConn) bool {
+	h.mu.Lock()
+	h.conns = append(h.conns, c)
+	h.mu.Unlock()
+	return true
+}
+
+func (h *sharedRelayHandler) OnMessage(c *tcp.TCPConn, p tcp.Packet) bool {
+	if p.(*echoMsg).Text == "" {
+		// 忽略客户端连接时的空 hello
+		return true
+	}
+	sb, err := c.BuildSharedBuf(p)
+	if err != nil {
+		return false
+	}
+	defer sb.Release()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, conn := range h.conns {
+		conn.AsyncSendShared(sb)
+	}
+	return true
+}
+
+func (h *sharedRelayHandler) OnClose(c *tcp.TCPConn) {}
+
+func TestSharedBufBroadcast(t *testing.T) {
+	for _, header := range []tcp.FrameHeader{tcp.HEADER_UINT16, tcp.HEADER_VARINT} {
+		relay := &sharedRelayHandler{}
+		opt := tcp.NewTCPOption(relay, newTestParser(), tcp.WithFrameHeader(header))
+		srv := tcp.NewTCPServer("pipe", opt)
+
+		dial := func(addr string) (net.Conn, error) {
+			cliConn, srvConn := net.Pipe()
+			go srv.ServeConn(srvConn)
+			return cliConn, nil
+		}
+		var clients []*tcp.TCPClient
+		var users []*recvHandler
+		for i := 0; i < 3; i++ {
+			h := &recvHandler{recv: make(chan string, 16), closed: make(chan struct{})}
+			client := tcp.NewTCPClient("pipe", 1, tcp.NewTCPOption(h, newTestParser(),
+				tcp.WithDialer(dial), tcp.WithFrameHeader(header)))
+			client.Start()
+			clients = append(clients, client)
+			users = append(users, h)
+		}
+		for {
+			relay.mu.Lock()
+			n := len(relay.conns)
+			relay.mu.Unlock()
+			if n == len(users) {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		// 超过初始容量的消息同样可以共享
+		text := strings.Repeat("s", 10000)
+		relay.mu.Lock()
+		first := relay.conns[0]
+		relay.mu.Unlock()
+		relay.OnMessage(first, &echoMsg{Text: text})
+		for _, h := range users {
+			waitRecv(t, h, text)
+		}
+
+		for _, c := range clients {
+			c.Close()
+		}
+		srv.Close()
+	}
+}
+
+func TestSharedBufRelease(t *testing.T) {
+	sb := tcp.NewSharedBuf([]byte("abc"))
+	sb.Retain()
+	sb.Release()
+	if string(sb.Bytes()) != "abc" {
+		t.Fatal("buffer changed while still referenced")
+	}
+	sb.Release()
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("over release not detected")
+		}
+	}()
+	sb.Release()
+}
+
+func benchParser(b *testing.B) (*tcp.HeaderPacketParser, tcp.Packet) {
+	b.Helper()
+	return newTestParser(), &echoMsg{Text: strings.Repeat("chat ", 40)}
+}
+
+func BenchmarkBuildPacketBuf(b *testing.B) {
+	p, msg := benchParser(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.BuildPacketBuf(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBuildSharedBuf(b *testing.B) {
+	p, msg := benchParser(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sb, err := p.BuildSharedBuf(msg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		sb.Release()
+	}
+}
+
+func BenchmarkBuildSharedBufParallel(b *testing.B) {
+	p, msg := benchParser(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			sb, err := p.BuildSharedBuf(msg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			sb.Release()
+		}
+	})
+}
+
+// startBroadcastConns 启动 n 个服务端连接, 客户端只丢弃收到的数据
+func startBroadcastConns(b *testing.B, n int) []*tcp.TCPConn {
+	b.Helper()
+	relay := &sharedRelayHandler{}
+	opt := tcp.NewTCPOption(relay, newTestParser(),
+		tcp.WithSendOverflow(tcp.OVERFLOW_BLOCK, time.Minute))
+	srv := tcp.NewTCPServer("pipe", opt)
+	for i := 0; i < n; i++ {
+		cliConn, srvConn := net.Pipe()
+		b.Cleanup(func() { cliConn.Close() })
+		go io.Copy(io.Discard, cliConn)
+		go srv.ServeConn(srvConn)
+	}
+	// 先于客户端关闭
+	b.Cleanup(srv.Close)
+	for {
+		relay.mu.Lock()
+		conns := relay.conns
+		relay.mu.Unlock()
+		if len(conns) == n {
+			return conns
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// 广播给 N 个连接: 每个接收者各编码一次(BuildPacketBuf) 与 所有接收者共用一次编码(SharedFrames)
+// go test ./pkg/tcp -run XXX -bench Broadcast -benchmem
+func BenchmarkBroadcast(b *testing.B) {
+	const n = 100
+	b.Run("BuildPacketBuf", func(b *testing.B) {
+		conns := startBroadcastConns(b, n)
+		p, msg := benchParser(b)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, c := range conns {
+				buf, err := p.BuildPacketBuf(msg)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err = c.AsyncSendBuff(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("SharedFrames", func(b *testing.B) {
+		conns := startBroadcastConns(b, n)
+		_, msg := benchParser(b)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			f := tcp.NewSharedFrames(msg)
+			for _, c := range conns {
+				if err := c.AsyncSendFrames(f); err != nil {
+					b.Fatal(err)
+				}
+			}
+			f.Release()
+		}
+	})
+}
@@ -1,19 +1,33 @@
 package tcp
 
 import (
+	"crypto/tls"
+	"errors"
 	"log"
 	"net"
 	"sync"
 	"time"
 )
 
+const DEFAULT_DIAL_TIMEOUT = 5 * time.Second
+
+// DialFunc 建立到 addr 的传输层连接
+type DialFunc func(addr string) (net.Conn, error)
+
+// DialTCP 默认拨号方式, 开启 TCP keepalive
+func DialTCP(addr string) (net.Conn, error) {
+	d := net.Dialer{Timeout: DEFAULT_DIAL_TIMEOUT, KeepAlive: 15 * time.Second}
+	return d.Dial("tcp", addr)
+}
+
 type TCPClient struct {
 	Addr      string
 	ConnNum   int
 	opt       *tcpOption
 	conns     sync.Map //map[net.Conn]struct{}
 	wg        sync.WaitGroup
-	closeFlag bool
+	closeChan chan struct{}
+	closeOnce sync.Once
 }
 
 func NewTCPClient(addr string, num int, opt *tcpOption) *TCPClient {
@@ -31,7 +45,7 @@ func NewTCPClient(addr string, num int, opt *tcpOption) *TCPClient {
 		opt:       opt,
 		conns:     sync.Map{},
 		wg:        sync.WaitGroup{},
-		closeFlag: false,
+		closeChan: make(chan struct{}),
 	}
 }
 
@@ -42,62 +56,141 @@ func (client *TCPClient) Start() {
 	}
 }
 
-func (client *TCPClient) dial() *net.TCPConn {
+func (client *TCPClient) isClosed() bool {
+	select {
+	case <-client.closeChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep 等待 d, 客户端关闭时提前返回 false
+func (client *TCPClient) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-client.closeChan:
+		return false
+	}
+}
+
+func (client *TCPClient) dial(bo *backoff) net.Conn {
 	for {
-		tcpAddr, err := net.ResolveTCPAddr("tcp", client.Addr)
-		if err != nil {
-			return nil
-		}
-		conn, err := net.DialTCP("tcp", nil, tcpAddr)
-		if err == nil || client.closeFlag {
+		conn, err := client.opt.dialer(client.Addr)
+		if err == nil {
 			return conn
 		}
+		if client.isClosed() {
+			return nil
+		}
 
-		log.Printf("connect to %v error: %v\n", client.Addr, err)
-		time.Sleep(1 * time.Second)
-		continue
+		wait := bo.Next()
+		log.Printf("connect to %v error: %v, retry in %v\n", client.Addr, err, wait)
+		if !client.sleep(wait) {
+			return nil
+		}
 	}
 }
 
+// connect 建立连接并处理, 开启重连时断线后按指数退避重新建立连接
 func (client *TCPClient) connect() {
 	defer client.wg.Done()
 
-	conn := client.dial()
-	if conn == nil {
-		return
+	bo := newBackoff(client.opt.reconnectMin, client.opt.reconnectMax)
+	for {
+		conn := client.dial(bo)
+		if conn == nil {
+			return
+		}
+
+		start := time.Now()
+		err := client.serveConn(conn)
+		if client.isClosed() || !client.opt.reconnect {
+			return
+		}
+		var he *HandshakeError
+		if errors.As(err, &he) && !he.Retry {
+			return
+		}
+
+		// 连接保持超过最大退避时间视为稳定, 重新从最小间隔开始退避
+		if time.Since(start) > bo.max {
+			bo.Reset()
+		}
+		wait := bo.Next()
+		log.Printf("connection to %v lost, reconnect in %v\n", client.Addr, wait)
+		if !client.sleep(wait) {
+			return
+		}
 	}
-	conn.SetKeepAlive(true)
+}
 
-	if client.closeFlag {
+// serveConn 处理连接直到断开, 返回建立连接过程中的错误
+func (client *TCPClient) serveConn(conn net.Conn) error {
+	client.conns.Store(conn, struct{}{})
+	defer client.conns.Delete(conn)
+	if client.isClosed() {
 		conn.Close()
-		return
+		return nil
 	}
-	client.conns.Store(conn, struct{}{})
 
-	client.wg.Add(1)
-	go func() {
-		defer func() {
-			client.conns.Delete(conn)
-			client.wg.Done()
-		}()
-
-		tcpConn := newConn(conn, client.opt)
-		defer tcpConn.Close()
-		if !client.opt.handler.OnConnect(tcpConn) {
-			log.Printf("connect refuse: %v\n", conn.RemoteAddr().String())
-			tcpConn.Close()
-			return
+	var netConn net.Conn = conn
+	if client.opt.tlsConfig != nil {
+		tlsConn := tls.Client(conn, clientTLSConfig(client.opt.tlsConfig, client.Addr))
+		if err := tlsHandshake(tlsConn); err != nil {
+			log.Printf("tls handshake %v error: %v\n", client.Addr, err)
+			conn.Close()
+			return err
 		}
-		tcpConn.serve(&client.wg)
-	}()
+		netConn = tlsConn
+	}
+
+	var hs *Negotiated
+	if client.opt.handshake != nil {
+		var err error
+		if hs, err = dialHandshake(netConn, client.opt); err != nil {
+			log.Printf("handshake %v error: %v\n", client.Addr, err)
+			conn.Close()
+			client.handshakeFail(err)
+			return err
+		}
+	}
 
+	tcpConn := newConn(netConn, client.opt, hs)
+	if tcpConn.codec != nil && hs == nil {
+		tcpConn.codec.offer = true
+	}
+	defer tcpConn.Close()
+	if !tcpConn.onConnect() {
+		log.Printf("connect refuse: %v\n", conn.RemoteAddr().String())
+		tcpConn.Close()
+		return nil
+	}
+	tcpConn.serve(&client.wg)
+	return nil
+}
+
+// handshakeFail 握手被拒绝且不再重试时通知 Handler
+func (client *TCPClient) handshakeFail(err error) {
+	var he *HandshakeError
+	if !errors.As(err, &he) || (he.Retry && client.opt.reconnect) {
+		return
+	}
+	if h, ok := client.opt.handler.(HandshakeFailHandler); ok {
+		h.OnHandshakeFail(he)
+	}
 }
 
 func (client *TCPClient) Close() {
-	client.closeFlag = true
+	client.closeOnce.Do(func() {
+		close(client.closeChan)
+	})
 	client.conns.Range(
 		func(k, v interface{}) bool {
-			err := k.(*net.TCPConn).Close()
+			err := k.(net.Conn).Close()
 			if err != nil {
 				log.Printf("TCPClient conns close error: %v\n", err)
 			}
@@ -2,10 +2,13 @@ package tcp
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
 	"io"
 	"log"
 	"net"
+	"reflect"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -19,38 +22,99 @@ var (
 	ErrReadBlocking  = errors.New("read packet was blocking")
 )
 
-const DEFAULT_MAX_FLUSH_GAP = 200 * time.Millisecond
+const (
+	DEFAULT_FLUSH_LATENCY   = 10 * time.Millisecond // 持续有数据写入时的最大缓冲时间
+	DEFAULT_FLUSH_THRESHOLD = 32 * 1024             // 缓冲达到该大小立即写出
+)
 
 var globalIdx uint32 = 0
 
+type lingerConn interface {
+	SetLinger(sec int) error
+}
+
 type TCPConn struct {
+	dropped        uint64 // 发送队列溢出丢弃的消息数
 	OnlineIdx      uint32
 	opt            *tcpOption
-	rawConn        *net.TCPConn
+	base           PacketParser  // 编码格式的共享解析器, 握手时为协商选定的编码
+	parser         PacketParser  // 本连接的解析器, 协议支持连接级编解码流时为独立副本
+	negotiated     *Negotiated   // 握手协商结果, 未开启握手时为 nil
+	preamble       *SharedBuf    // 连接级编解码流的前导帧, 在其他帧之前写出
+	rawConn        net.Conn      // transport conn: tcp, tls, unix, pipe, websocket...
 	extraData      interface{}   // to save extra data
 	closeFlag      int32         // close flag
 	closeChan      chan struct{} // close chan
-	packetSendChan chan Packet   // packet send chan
-	buffSendChan   chan []byte   // send buff
-	packetRecvChan chan Packet   // packet recv chan
+	ctx            context.Context
+	cancel         context.CancelFunc // 连接关闭时取消 ctx
+	drainChan      chan struct{}      // graceful close chan
+	drainOnce      sync.Once
+	readDoneChan   chan struct{}   // readLoop exit chan
+	packetSendChan chan Packet     // packet send chan
+	buffSendChan   chan *SharedBuf // send buff, writeLoop 写出后 Release
+	packetRecvChan chan Packet     // packet recv chan
 	inBuf          *bufio.Reader
 	outBuf         *bufio.Writer
+	inCount        *countReader // 统计 inBuf 从连接读取的字节数
+	limiter        *rateLimiter // 接收限速, 未配置时为 nil
+	closeReason    atomic.Value // closeReason
+	ep             *epollConn   // epoll 模式下的收发状态, 此时不创建收发队列与读写协程
+	onClosed       func()       // epoll 模式下连接关闭后由服务端清理
+	remoteAddr     net.Addr     // PROXY protocol 给出的客户端地址
+	localAddr      net.Addr
+	proxyBy        net.Addr     // 转发连接的代理地址, 直连时为 nil
+	codec          *frameCodec  // 压缩帧协商状态, 未开启压缩时为 nil
+	calls          pendingCalls // Call 等待响应的请求
 }
 
-func newConn(conn *net.TCPConn, opt *tcpOption) *TCPConn {
-	return &TCPConn{
+// countReader 统计读取的字节数
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func newConn(conn net.Conn, opt *tcpOption, hs *Negotiated) *TCPConn {
+	inCount := &countReader{r: conn}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &TCPConn{
 		OnlineIdx:      atomic.AddUint32(&globalIdx, 1),
 		opt:            opt,
 		rawConn:        conn,
 		extraData:      nil,
 		closeFlag:      0,
 		closeChan:      make(chan struct{}),
+		ctx:            ctx,
+		cancel:         cancel,
+		drainChan:      make(chan struct{}),
+		readDoneChan:   make(chan struct{}),
 		packetSendChan: make(chan Packet, opt.sendChanCapLimit),
-		buffSendChan:   make(chan []byte, opt.sendChanCapLimit*100),
+		buffSendChan:   make(chan *SharedBuf, opt.sendChanCapLimit*100),
 		packetRecvChan: make(chan Packet, opt.recvChanCapLimit),
-		inBuf:          bufio.NewReaderSize(conn, 1024),
+		inBuf:          bufio.NewReaderSize(inCount, 1024),
 		outBuf:         bufio.NewWriterSize(conn, 40960),
+		inCount:        inCount,
+		limiter:        newRateLimiter(opt.rateLimit),
 	}
+	c.preamble = c.initCodec(hs)
+	return c
+}
+
+// initCodec 按握手结果选定连接的编码与压缩, 返回须最先写出的前导帧
+func (c *TCPConn) initCodec(hs *Negotiated) *SharedBuf {
+	c.base = c.opt.parser
+	if hs != nil {
+		c.base, c.negotiated = hs.parser, hs
+	}
+	parser, preamble := newStreamParser(c.base)
+	c.parser = parser
+	c.codec = newFrameCodec(c.opt, parser, hs)
+	return preamble
 }
 
 func (c *TCPConn) GetExtraData() interface{} {
@@ -61,24 +125,101 @@ func (c *TCPConn) SetExtraData(data interface{}) {
 	c.extraData = data
 }
 
-func (c *TCPConn) GetRawConn() *net.TCPConn {
+// Context 连接关闭时取消, 可用于控制处理消息时发起的异步操作
+func (c *TCPConn) Context() context.Context {
+	return c.ctx
+}
+
+func (c *TCPConn) GetRawConn() net.Conn {
 	return c.rawConn
 }
 
+// RemoteAddr 客户端地址, 经可信代理转发时为 PROXY protocol 头中的真实地址
+func (c *TCPConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.rawConn.RemoteAddr()
+}
+
+func (c *TCPConn) LocalAddr() net.Addr {
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.rawConn.LocalAddr()
+}
+
+// ProxyAddr 转发该连接的代理地址, 未经 PROXY protocol 转发时为 nil
+func (c *TCPConn) ProxyAddr() net.Addr {
+	return c.proxyBy
+}
+
+// TLSState 返回TLS连接状态(含对端证书), 非TLS连接 ok 为 false
+func (c *TCPConn) TLSState() (state tls.ConnectionState, ok bool) {
+	tlsConn, ok := c.rawConn.(*tls.Conn)
+	if !ok {
+		return state, false
+	}
+	return tlsConn.ConnectionState(), true
+}
+
+// Dropped 因发送队列溢出丢弃的消息数
+func (c *TCPConn) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+func (c *TCPConn) addDropped() {
+	atomic.AddUint64(&c.dropped, 1)
+}
+
+// CloseReason 连接被主动断开的原因(ErrSlowConsumer、ErrRateLimited), 其他情况为 nil
+func (c *TCPConn) CloseReason() error {
+	if r, ok := c.closeReason.Load().(closeReason); ok {
+		return r.err
+	}
+	return nil
+}
+
+func (c *TCPConn) setCloseReason(err error) {
+	if c.CloseReason() == nil {
+		c.closeReason.Store(closeReason{err: err})
+	}
+}
+
 func (c *TCPConn) Close() {
+	c.close(false)
+}
+
+// Drain 优雅关闭: 写出发送队列中已有的数据并 Flush 后再关闭连接, 不丢弃内核发送缓冲
+func (c *TCPConn) Drain() {
+	c.drainOnce.Do(func() {
+		close(c.drainChan)
+		if c.ep != nil {
+			c.epDrain()
+		}
+	})
+}
+
+func (c *TCPConn) close(graceful bool) {
 	if atomic.CompareAndSwapInt32(&c.closeFlag, 0, 1) {
+		// 收发队列不关闭, 各协程通过 closeChan 退出, 避免并发发送时 send on closed channel
 		close(c.closeChan)
-		close(c.packetSendChan)
-		close(c.buffSendChan)
-		close(c.packetRecvChan)
-		c.inBuf = nil
-		c.outBuf = nil
-		err := c.rawConn.SetLinger(0)
-		if (err != nil) && (!errors.Is(err, net.ErrClosed)) {
-			log.Printf("TCPConn.Close() SetLinger err: %v\n", err)
+		c.cancel()
+		// only tcp conn support linger, tls conn send close_notify instead
+		if l, ok := c.rawConn.(lingerConn); ok && !graceful {
+			err := l.SetLinger(0)
+			if (err != nil) && (!errors.Is(err, net.ErrClosed)) {
+				log.Printf("TCPConn.Close() SetLinger err: %v\n", err)
+			}
+		}
+		if c.ep != nil {
+			c.epClose()
 		}
 		c.rawConn.Close()
-		c.opt.handler.OnClose(c)
+		c.onClose()
+		if c.onClosed != nil {
+			c.onClosed()
+		}
 	}
 }
 
@@ -87,47 +228,145 @@ func (c *TCPConn) IsClosed() bool {
 }
 
 func (c *TCPConn) BuildMessageBuf(p Packet) (buf []byte, err error) {
-	return c.opt.parser.BuildPacketBuf(p)
+	return c.parser.BuildPacketBuf(p)
+}
+
+// BuildSharedBuf 编码为可在多个连接间共享的缓冲, 调用方持有一个引用, 用完后 Release
+func (c *TCPConn) BuildSharedBuf(p Packet) (*SharedBuf, error) {
+	return buildSharedBuf(c.parser, p)
+}
+
+func buildSharedBuf(parser PacketParser, p Packet) (*SharedBuf, error) {
+	if b, ok := parser.(SharedBufBuilder); ok {
+		return b.BuildSharedBuf(p)
+	}
+	buf, err := parser.BuildPacketBuf(p)
+	if err != nil {
+		return nil, err
+	}
+	return NewSharedBuf(buf), nil
 }
 
 func (c *TCPConn) AsyncSendPacket(p Packet) (err error) {
 	if c.IsClosed() {
 		return ErrConnClosing
 	}
-
-	defer func() {
-		if e := recover(); e != nil {
-			err = ErrConnClosing
+	if c.ep != nil {
+		sb, err := c.BuildSharedBuf(p)
+		if err != nil {
+			return err
 		}
-	}()
+		if err = c.epSend(sb); err != nil {
+			sb.Release()
+		}
+		return err
+	}
 
 	select {
 	case c.packetSendChan <- p:
 		return nil
-
+	case <-c.closeChan:
+		return ErrConnClosing
 	default:
-		return ErrWriteBlocking
 	}
+	return c.overflow(
+		func() bool {
+			select {
+			case c.packetSendChan <- p:
+				return true
+			default:
+				return false
+			}
+		},
+		func() bool {
+			select {
+			case <-c.packetSendChan:
+				return true
+			default:
+				return false
+			}
+		},
+		func(timeout <-chan time.Time) bool {
+			select {
+			case c.packetSendChan <- p:
+				return true
+			case <-timeout:
+			case <-c.closeChan:
+			}
+			return false
+		})
 }
 
 func (c *TCPConn) AsyncSendBuff(buf []byte) (err error) {
+	sb := NewSharedBuf(buf)
+	defer sb.Release()
+	return c.AsyncSendShared(sb)
+}
+
+// AsyncSendFrames 发送广播帧中本连接格式的那一帧, 调用方仍需释放 f
+func (c *TCPConn) AsyncSendFrames(f *SharedFrames) error {
 	if c.IsClosed() {
 		return ErrConnClosing
 	}
+	sb, err := f.For(c)
+	if err != nil {
+		return err
+	}
+	return c.AsyncSendShared(sb)
+}
 
-	defer func() {
-		if e := recover(); e != nil {
-			err = ErrConnClosing
-		}
-	}()
+// AsyncSendShared 发送共享缓冲, 入队时增加引用, 调用方仍需释放自己持有的引用
+func (c *TCPConn) AsyncSendShared(sb *SharedBuf) (err error) {
+	if c.IsClosed() {
+		return ErrConnClosing
+	}
 
+	sb.Retain()
+	if c.ep != nil {
+		if err = c.epSend(sb); err != nil {
+			sb.Release()
+		}
+		return err
+	}
 	select {
-	case c.buffSendChan <- buf:
+	case c.buffSendChan <- sb:
 		return nil
-
+	case <-c.closeChan:
+		sb.Release()
+		return ErrConnClosing
 	default:
-		return ErrWriteBlocking
 	}
+	err = c.overflow(
+		func() bool {
+			select {
+			case c.buffSendChan <- sb:
+				return true
+			default:
+				return false
+			}
+		},
+		func() bool {
+			select {
+			case old := <-c.buffSendChan:
+				old.Release()
+				return true
+			default:
+				return false
+			}
+		},
+		func(timeout <-chan time.Time) bool {
+			select {
+			case c.buffSendChan <- sb:
+				return true
+			case <-timeout:
+			case <-c.closeChan:
+			}
+			return false
+		})
+	if err != nil {
+		sb.Release()
+	}
+	return err
 }
 
 func (c *TCPConn) serve(wg *sync.WaitGroup) {
@@ -148,10 +387,11 @@ func (c *TCPConn) serve(wg *sync.WaitGroup) {
 
 func (c *TCPConn) readLoop() {
 	defer func() {
-		// if err := recover(); (err != nil) && (err != io.EOF) {
-		// 	log.Printf("TCPConn.readLoop() recover error:%v\n", err)
-		// }
-		c.Close()
+		if c.recoverPanic("readLoop", recover()) {
+			c.Close()
+		}
+		// handleLoop 处理完已收到的包后关闭连接
+		close(c.readDoneChan)
 	}()
 
 	for {
@@ -165,45 +405,182 @@ func (c *TCPConn) readLoop() {
 			return
 		}
 
+		// 空闲超时: 期间未收到任何数据(含心跳回复)则断开
+		if c.opt.idleTimeout > 0 {
+			c.rawConn.SetReadDeadline(time.Now().Add(c.opt.idleTimeout))
+		}
+
 		// p, err := c.opt.parser.ReadPacket(c.rawConn)
-		p, err := c.opt.parser.ReadBufPacket(c.inBuf)
+		consumed := c.consumed()
+		p, err := c.readPacket()
 		if err != nil {
-			if (err != io.EOF) && (!errors.Is(err, net.ErrClosed)) {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				log.Printf("TCPConn.readLoop() client:%d idle timeout %v\n", c.OnlineIdx, c.opt.idleTimeout)
+			} else if (err != io.EOF) && (!errors.Is(err, net.ErrClosed)) {
 				log.Printf("TCPConn.readLoop() err:%v\n", err)
 			}
 			return
 		}
 		if p == nil {
-			time.Sleep(10 * time.Millisecond)
+			if c.codec == nil {
+				time.Sleep(10 * time.Millisecond)
+			}
+			continue
+		}
+
+		if c.limiter != nil && !c.throttle(c.consumed()-consumed) {
+			continue
+		}
+		if c.autoPong(p) {
 			continue
 		}
 
 		if c.IsClosed() {
 			return
 		}
-		c.packetRecvChan <- p
+		select {
+		case c.packetRecvChan <- p:
+		case <-c.closeChan:
+			return
+		}
+	}
+}
+
+// readPacket 读取一个包, 开启压缩时按负载读取后解码, 协商帧返回 nil
+func (c *TCPConn) readPacket() (Packet, error) {
+	if c.codec == nil {
+		return c.parser.ReadBufPacket(c.inBuf)
+	}
+	payload, err := c.codec.parser.ReadPayload(c.inBuf)
+	if err != nil {
+		return nil, err
+	}
+	return c.codec.decode(c, payload)
+}
+
+// autoPong 开启 WithAutoPong 时直接回复心跳包, 返回 true 表示 p 已处理
+func (c *TCPConn) autoPong(p Packet) bool {
+	if c.opt.pongPacket == nil || reflect.TypeOf(p) != c.opt.pingType {
+		return false
+	}
+	if err := c.AsyncSendPacket(c.opt.pongPacket); err != nil && err != ErrConnClosing {
+		log.Printf("TCPConn client:%d auto pong err:%v\n", c.OnlineIdx, err)
+	}
+	return true
+}
+
+// consumed 已从连接读出并被解析的字节数
+func (c *TCPConn) consumed() int64 {
+	return c.inCount.n - int64(c.inBuf.Buffered())
+}
+
+// throttle 对收到的 size 字节的包限速, 返回 false 表示丢弃该包; 仅由 readLoop 调用
+func (c *TCPConn) throttle(size int64) bool {
+	now := time.Now()
+	ok, wait := c.limiter.limit(int(size), now)
+	if ok && wait <= 0 {
+		return true
+	}
+
+	if th, isTh := c.opt.handler.(ThrottleHandler); isTh && c.limiter.shouldNotice(now) {
+		th.OnThrottle(c, c.limiter.policy)
+	}
+
+	switch c.limiter.policy {
+	case THROTTLE_DELAY:
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			return true
+		case <-c.closeChan:
+			return false
+		}
+	case THROTTLE_DISCONNECT:
+		log.Printf("TCPConn client:%d rate limit exceeded, disconnect\n", c.OnlineIdx)
+		c.setCloseReason(ErrRateLimited)
+		// 写出限速通知后关闭, 不再处理后续数据
+		c.Drain()
+		<-c.closeChan
 	}
+	return false
 }
 
 func (c *TCPConn) writeLoop() {
 	defer func() {
-		// if err := recover(); (err != nil) && (err != io.EOF) {
-		// 	log.Printf("TCPConn.writeLoop() recover error:%v\n", err)
-		// }
+		c.recoverPanic("writeLoop", recover())
 		c.Close()
 	}()
 
-	var lastFlushTime int64 = 0
+	var heartbeat <-chan time.Time
+	if c.opt.heartbeatInterval > 0 && c.opt.heartbeatPacket != nil {
+		ticker := time.NewTicker(c.opt.heartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	// 合并写: 发送队列取空、缓冲超过阈值或最早一条未写出数据等待超过 flushLatency 时 Flush
+	flushTimer := time.NewTimer(c.opt.flushLatency)
+	stopFlushTimer(flushTimer)
+	defer flushTimer.Stop()
+	var flushDeadline <-chan time.Time
+
+	// 客户端开启压缩时先发送 offer, 收到服务端 ack 之前仍发送原格式的帧
+	if c.codec != nil && c.codec.offer {
+		if _, err := c.outBuf.Write(c.codec.ack.Bytes()); err != nil {
+			log.Printf("TCPConn.writeLoop() compress offer err:%v\n", err)
+			return
+		}
+	}
+	// 连接级编解码流先写出前导帧(如 gob 类型描述), 此后的帧依赖它解码
+	if c.preamble != nil {
+		err := c.writeShared(c.preamble)
+		c.preamble.Release()
+		c.preamble = nil
+		if err != nil {
+			log.Printf("TCPConn.writeLoop() preamble err:%v\n", err)
+			return
+		}
+	}
+
 	for {
+		expired := false
 		select {
 		case <-c.closeChan:
 			return
-		case buf := <-c.buffSendChan:
+		case <-flushDeadline:
+			flushDeadline = nil
+			expired = true
+		case <-heartbeat:
 			if c.IsClosed() {
 				return
 			}
 
-			if _, err := c.outBuf.Write(buf); err != nil {
+			if err := c.writePacket(c.opt.heartbeatPacket); err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("TCPConn.writeLoop() heartbeat err:%v\n", err)
+				}
+				return
+			}
+		case <-c.drainChan:
+			if err := c.flushPending(); err != nil {
+				if !errors.Is(err, net.ErrClosed) && !errors.Is(err, ErrConnClosing) {
+					log.Printf("TCPConn.writeLoop() drain err:%v\n", err)
+				}
+				return
+			}
+			c.close(true)
+			return
+		case sb := <-c.buffSendChan:
+			if c.IsClosed() {
+				sb.Release()
+				return
+			}
+
+			err := c.writeShared(sb)
+			sb.Release()
+			if err != nil {
 				if !errors.Is(err, net.ErrClosed) {
 					log.Printf("TCPConn.writeLoop() 1 err:%v\n", err)
 				}
@@ -216,7 +593,7 @@ func (c *TCPConn) writeLoop() {
 			}
 
 			// if _, err := c.opt.parser.WritePacket(c.rawConn, p); err != nil {
-			if _, err := c.opt.parser.WriteBufPacket(c.outBuf, p); err != nil {
+			if err := c.writePacket(p); err != nil {
 				if !errors.Is(err, net.ErrClosed) {
 					log.Printf("TCPConn.writeLoop() 2 err:%v\n", err)
 				}
@@ -224,23 +601,98 @@ func (c *TCPConn) writeLoop() {
 			}
 		}
 
-		now := time.Now().UnixNano()
-		if time.Duration(now-lastFlushTime) > DEFAULT_MAX_FLUSH_GAP {
-			if err := c.outBuf.Flush(); err != nil {
-				if !errors.Is(err, net.ErrClosed) {
-					log.Printf("TCPConn.writeLoop() 3 Flush err:%v\n", err)
-				}
-				return
+		if c.outBuf.Buffered() == 0 {
+			continue
+		}
+		pending := len(c.buffSendChan) > 0 || len(c.packetSendChan) > 0
+		if pending && !expired && c.outBuf.Buffered() < c.opt.flushThreshold {
+			// 队列中还有数据, 继续合并, 最多等待 flushLatency
+			if flushDeadline == nil {
+				flushTimer.Reset(c.opt.flushLatency)
+				flushDeadline = flushTimer.C
+			}
+			continue
+		}
+
+		if flushDeadline != nil {
+			stopFlushTimer(flushTimer)
+			flushDeadline = nil
+		}
+		if err := c.outBuf.Flush(); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("TCPConn.writeLoop() 3 Flush err:%v\n", err)
 			}
+			return
 		}
 	}
 }
 
+// stopFlushTimer 停止定时器并清空已触发的事件, 以便安全 Reset
+func stopFlushTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
+
+// flushPending 写出发送队列中剩余的数据, 仅由 writeLoop 调用
+func (c *TCPConn) flushPending() error {
+	for {
+		if c.IsClosed() {
+			return ErrConnClosing
+		}
+		select {
+		case sb := <-c.buffSendChan:
+			err := c.writeShared(sb)
+			sb.Release()
+			if err != nil {
+				return err
+			}
+		case p := <-c.packetSendChan:
+			if err := c.writePacket(p); err != nil {
+				return err
+			}
+		default:
+			return c.outBuf.Flush()
+		}
+	}
+}
+
+// writePacket 编码并写入 outBuf, 仅由 writeLoop 调用
+func (c *TCPConn) writePacket(p Packet) error {
+	if !c.codec.flaggedOut() {
+		_, err := c.parser.WriteBufPacket(c.outBuf, p)
+		return err
+	}
+	sb, err := c.BuildSharedBuf(p)
+	if err != nil {
+		return err
+	}
+	defer sb.Release()
+	return c.writeShared(sb)
+}
+
+// writeShared 写入共享缓冲, 协商压缩后写入其带标志字节的变体, 仅由 writeLoop 调用
+func (c *TCPConn) writeShared(sb *SharedBuf) error {
+	frame, err := c.codec.outFrame(sb)
+	if err != nil {
+		return err
+	}
+	if _, err = c.outBuf.Write(frame.Bytes()); err != nil {
+		return err
+	}
+	if c.codec != nil && sb == c.codec.ack {
+		// 写出协商回复后, 后续帧带标志字节
+		c.codec.setFlaggedOut()
+	}
+	return nil
+}
+
 func (c *TCPConn) handleLoop() {
 	defer func() {
-		// if err := recover(); (err != nil) && (err != io.EOF) {
-		// 	log.Printf("TCPConn.handleLoop() recover error:%v\n", err)
-		// }
+		c.recoverPanic("handleLoop", recover())
 		c.Close()
 	}()
 
@@ -250,9 +702,21 @@ func (c *TCPConn) handleLoop() {
 			return
 
 		case p := <-c.packetRecvChan:
-			if !c.opt.handler.OnMessage(c, p) {
+			if !c.handleMessage(p) {
 				return
 			}
+
+		case <-c.readDoneChan:
+			for {
+				select {
+				case p := <-c.packetRecvChan:
+					if !c.handleMessage(p) {
+						return
+					}
+				default:
+					return
+				}
+			}
 		}
 	}
 }
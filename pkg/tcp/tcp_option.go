@@ -2,6 +2,8 @@ package tcp
 
 import (
 	"bufio"
+	"compress/flate"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +11,8 @@ import (
 	"log"
 	"net"
 	"reflect"
+	"runtime"
+	"time"
 )
 
 type ProtDecoder interface {
@@ -29,6 +33,28 @@ type Protocol interface {
 	GetEncoder(w io.Writer) ProtEncoder
 }
 
+// StreamProtocol Protocol 可选实现, 为每个连接创建有状态的编解码流, 返回 nil 表示不使用
+type StreamProtocol interface {
+	NewStream() ProtocolStream
+}
+
+// ProtocolStream 单个连接的编解码流, Preamble 为连接建立后最先发送的负载
+type ProtocolStream interface {
+	Protocol
+	Preamble() []byte
+}
+
+// StreamParser PacketParser 可选实现, 为每个连接创建独立的解析器; preamble 非 nil 时须在其他帧之前发送
+type StreamParser interface {
+	NewStream() (parser PacketParser, preamble *SharedBuf)
+}
+
+// TypePrefixed Protocol 可选实现, 负载以 2字节名称长度|名称 开头且 GetDecoder 可直接从流中解码消息体,
+// HeaderPacketParser 据此在缓冲已含整帧时跳过拷贝
+type TypePrefixed interface {
+	TypePrefixed()
+}
+
 type Packet interface {
 	fmt.Stringer
 	// String() string
@@ -42,12 +68,41 @@ type PacketParser interface {
 	BuildPacketBuf(msg Packet) ([]byte, error)
 }
 
+// FrameConfigurable 支持通过 WithFrameHeader/WithMaxFrameSize 调整帧格式的 PacketParser
+type FrameConfigurable interface {
+	Header() FrameHeader
+	WithFrame(header FrameHeader, maxFrameSize int) PacketParser
+}
+
+// FrameDecoder PacketParser 可选实现, 从已读到的数据中解析一帧, 供 epoll 模式使用;
+// 数据不足一帧时 n 返回 0
+type FrameDecoder interface {
+	DecodeFrame(data []byte) (p Packet, n int, err error)
+}
+
 type Handler interface {
 	OnConnect(*TCPConn) bool
 	OnMessage(*TCPConn, Packet) bool
 	OnClose(*TCPConn)
 }
 
+// ThrottleHandler Handler 可选实现, 连接触发接收限速时回调(每秒至多一次), 可用于通知对端
+type ThrottleHandler interface {
+	OnThrottle(c *TCPConn, policy ThrottlePolicy)
+}
+
+// RejectHandler Handler 可选实现, 服务端因连接数超限拒绝连接时回调, 返回的包在关闭前写给对端;
+// 全局名额在读取 PROXY 头之前检查, 单 IP 名额在得到真实地址后检查, 均在 TLS 握手之前; TLS 连接被拒绝时直接关闭, 不回调.
+// 开启握手而对端首帧不是 hello(未握手的旧客户端)时以 ErrNoHandshake 回调, 通知按服务端编码写出, 旧客户端可以解码
+type RejectHandler interface {
+	OnReject(conn net.Conn, reason error) Packet
+}
+
+// HandshakeFailHandler Handler 可选实现, 客户端握手被服务端拒绝且不再重连时回调
+type HandshakeFailHandler interface {
+	OnHandshakeFail(err *HandshakeError)
+}
+
 type MessageType uint8
 
 const (
@@ -55,7 +110,10 @@ const (
 	CLIENT_TO_SERVER
 )
 
-type Message struct{}
+// Message 消息基类, ReqSeq 为请求序号, 由 Call 设置、ReplyTo 带回并标记 REQ_SEQ_RESPONSE, 其余消息为 0
+type Message struct {
+	ReqSeq uint32 `json:",omitempty"`
+}
 
 func (m *Message) String() string {
 	bytes, err := json.Marshal(m)
@@ -75,6 +133,47 @@ type tcpOption struct {
 	parser           PacketParser
 	sendChanCapLimit int
 	recvChanCapLimit int
+	tlsConfig        *tls.Config
+	dialer           DialFunc
+
+	heartbeatInterval time.Duration
+	heartbeatPacket   Packet
+	idleTimeout       time.Duration
+	pingType          reflect.Type // 自动回复的心跳包类型, 未开启时为 nil
+	pongPacket        Packet
+
+	reconnect    bool
+	reconnectMin time.Duration
+	reconnectMax time.Duration
+
+	rateLimit *RateLimit
+
+	flushLatency   time.Duration
+	flushThreshold int
+
+	overflowPolicy  OverflowPolicy
+	overflowTimeout time.Duration
+
+	maxConns      int
+	maxConnsPerIP int
+	allowlist     []*net.IPNet
+
+	frameSet       bool
+	frameHeaderSet bool
+	frameHeader    FrameHeader
+	maxFrameSize   int
+	epollPollers   int
+	middlewares    []Middleware
+	proxyProtocol  bool
+	proxyTrusted   []*net.IPNet
+
+	compress          bool
+	compressLevel     int
+	compressThreshold int
+
+	handshake *Handshake
+
+	onMessage MessageHandler // 组合中间件后的 OnMessage, 无中间件时为 nil
 }
 
 type TCPOptionFn func(opt *tcpOption)
@@ -100,9 +199,69 @@ func NewTCPOption(h Handler, p PacketParser, opts ...TCPOptionFn) *tcpOption {
 	if option.sendChanCapLimit <= 0 {
 		option.sendChanCapLimit = DEFAULT_SEND_CHAN_LIMIT
 	}
-	if option.sendChanCapLimit <= 0 {
+	if option.recvChanCapLimit <= 0 {
 		option.recvChanCapLimit = DEFAULT_RECV_CHAN_LIMIT
 	}
+	if option.dialer == nil {
+		option.dialer = DialTCP
+	}
+	if option.flushLatency <= 0 {
+		option.flushLatency = DEFAULT_FLUSH_LATENCY
+	}
+	if option.flushThreshold <= 0 {
+		option.flushThreshold = DEFAULT_FLUSH_THRESHOLD
+	}
+	if option.overflowTimeout <= 0 {
+		option.overflowTimeout = DEFAULT_OVERFLOW_BLOCK_TIMEOUT
+	}
+	orig := option.parser
+	if option.frameSet {
+		fc, ok := option.parser.(FrameConfigurable)
+		if !ok {
+			log.Fatalln("PacketParser p does not support frame options")
+		}
+		if !option.frameHeaderSet {
+			option.frameHeader = fc.Header()
+		}
+		option.parser = fc.WithFrame(option.frameHeader, option.maxFrameSize)
+	}
+
+	if option.compress {
+		if _, ok := option.parser.(PayloadParser); !ok {
+			log.Fatalln("PacketParser p does not support compression")
+		}
+	}
+
+	if hs := option.handshake; hs != nil {
+		if _, ok := option.parser.(PayloadParser); !ok {
+			log.Fatalln("PacketParser p does not support handshake")
+		}
+		// 可协商的编码与默认解析器使用相同的帧格式
+		codecs := make([]Codec, len(hs.Codecs))
+		for i, c := range hs.Codecs {
+			switch {
+			case c.Parser == orig:
+				c.Parser = option.parser
+			case option.frameSet:
+				fc, ok := c.Parser.(FrameConfigurable)
+				if !ok {
+					log.Fatalf("codec %s does not support frame options\n", c.Name)
+				}
+				c.Parser = fc.WithFrame(option.frameHeader, option.maxFrameSize)
+			}
+			if _, ok := c.Parser.(PayloadParser); option.compress && !ok {
+				log.Fatalf("codec %s does not support compression\n", c.Name)
+			}
+			codecs[i] = c
+		}
+		hs.Codecs = codecs
+	}
+
+	if len(option.middlewares) > 0 {
+		option.onMessage = Chain(func(c *TCPConn, msgID string, p Packet) bool {
+			return h.OnMessage(c, p)
+		}, option.middlewares...)
+	}
 
 	return option
 }
@@ -119,6 +278,194 @@ func WithRecvChanLimit(limit int) TCPOptionFn {
 	}
 }
 
+// WithTLSConfig 启用TLS, 服务端需配置证书, 配置 ClientCAs 时可要求客户端证书
+func WithTLSConfig(cfg *tls.Config) TCPOptionFn {
+	return func(opt *tcpOption) {
+		opt.tlsConfig = cfg
+	}
+}
+
+// WithHeartbeat 每隔 interval 向对端发送心跳包 ping, 对端收到后应回复使本端读超时刷新
+func WithHeartbeat(interval time.Duration, ping Packet) TCPOptionFn {
+	return func(opt *tcpOption) {
+		opt.heartbeatInterval = interval
+		opt.heartbeatPacket = ping
+	}
+}
+
+// WithIdleTimeout 超过 timeout 未收到对端任何数据则关闭连接
+func WithIdleTimeout(timeout time.Duration) TCPOptionFn {
+	return func(opt *tcpOption) {
+		opt.idleTimeout = timeout
+	}
+}
+
+// WithAutoPong 收到与 ping 同类型的心跳包时由读取协程直接回复 pong, 不交给 Handler;
+// Handler 阻塞(如等待用户输入)时也不会被对端判定空闲
+func WithAutoPong(ping, pong Packet) TCPOptionFn {
+	return func(opt *tcpOption) {
+		opt.pingType = reflect.TypeOf(ping)
+		opt.pongPacket = pong
+	}
+}
+
+// WithReconnect 客户端断线后自动重连, 重连间隔从 min 开始指数退避(带抖动)直到 max
+func WithReconnect(min, max time.Duration) TCPOptionFn {
+	return func(opt *tcpOption) {
+		opt.reconnect = true
+		opt.reconnectMin = min
+		opt.reconnectMax = max
+	}
+}
+
+// WithDialer 客户端自定义拨号(unix socket、net.Pipe、websocket 等)
+func WithDialer(d DialFunc) TCPOptionFn {
+	return func(opt *tcpOption) {
+		opt.dialer = d
+	}
+}
+
+// WithRateLimit 每连接接收限速(包/秒、字节/秒, 可突发), 超出时按 limit.Policy 处理
+func WithRateLimit(limit RateLimit) TCPOptionFn {
+	return func(opt *tcpOption) {
+		opt.rateLimit = &limit
+	}
+}
+
+// WithFlush 合并写参数: 发送队列持续有数据时最多缓冲 maxLatency, 缓冲达到 threshold 字节立即写出;
+// 队列取空时总是立即写出
+func WithFlush(maxLatency time.Duration, threshold int) TCPOptionFn {
+	return func(opt *tcpOption) {
+		opt.flushLatency = maxLatency
+		opt.flushThreshold = threshold
+	}
+}
+
+// WithSendOverflow 发送队列已满时的处理策略, timeout 仅用于 OVERFLOW_BLOCK
+func WithSendOverflow(policy OverflowPolicy, timeout time.Duration) TCPOptionFn {
+	return func(opt *tcpOption) {
+		opt.overflowPolicy = policy
+		opt.overflowTimeout = timeout
+	}
+}
+
+// WithMaxConns 服务端最大并发连接数, 超出的连接被拒绝
+func WithMaxConns(n int) TCPOptionFn {
+	return func(opt *tcpOption) {
+		opt.maxConns = n
+	}
+}
+
+// WithMaxConnsPerIP 服务端单个远端 IP 的最大并发连接数
+func WithMaxConnsPerIP(n int) TCPOptionFn {
+	return func(opt *tcpOption) {
+		opt.maxConnsPerIP = n
+	}
+}
+
+// WithAllowlist 白名单(IP 或 CIDR)内的地址不受连接数限制, 用于压测机等可信主机
+func WithAllowlist(entries ...string) TCPOptionFn {
+	return func(opt *tcpOption) {
+		nets, err := ParseAllowlist(entries...)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		opt.allowlist = append(opt.allowlist, nets...)
+	}
+}
+
+// WithProxyProtocol 服务端位于四层负载均衡之后时, 读取 PROXY protocol v1/v2 头得到客户端真实地址;
+// trusted 为可信代理的 IP 或 CIDR, 只解析来自这些地址的连接, 不可为空; 否则任何客户端都能伪造来源地址绕过单 IP 限制
+func WithProxyProtocol(trusted ...string) TCPOptionFn {
+	return func(opt *tcpOption) {
+		nets, err := parseIPNets("proxy", trusted...)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if len(nets) == 0 {
+			log.Fatalln("proxy protocol requires trusted proxy ip or cidr")
+		}
+		opt.proxyProtocol = true
+		opt.proxyTrusted = append(opt.proxyTrusted, nets...)
+	}
+}
+
+// WithFrameHeader 选择帧长度头格式, 通信双方必须一致
+func WithFrameHeader(header FrameHeader) TCPOptionFn {
+	return func(opt *tcpOption) {
+		opt.frameSet = true
+		opt.frameHeaderSet = true
+		opt.frameHeader = header
+	}
+}
+
+// WithMaxFrameSize 限制单帧最大长度, 读取时超过限制直接断开, 防止伪造长度耗尽内存
+func WithMaxFrameSize(size int) TCPOptionFn {
+	return func(opt *tcpOption) {
+		opt.frameSet = true
+		opt.maxFrameSize = size
+	}
+}
+
+// WithEpoll 服务端使用 epoll 模式(仅 linux): pollers 个事件循环处理所有连接的读写,
+// 连接不再各自占用读写协程与缓冲, 仅在有消息待处理时启动处理协程; TLS 等无法取得 fd 的连接不受影响
+func WithEpoll(pollers int) TCPOptionFn {
+	return func(opt *tcpOption) {
+		if pollers <= 0 {
+			pollers = runtime.NumCPU()
+		}
+		opt.epollPollers = pollers
+	}
+}
+
+// WithMiddleware 在 Handler.OnMessage 外依次包装中间件, 可多次调用, 先注册的先执行
+func WithMiddleware(mws ...Middleware) TCPOptionFn {
+	return func(opt *tcpOption) {
+		opt.middlewares = append(opt.middlewares, mws...)
+	}
+}
+
+// WithCompression 开启压缩帧: 客户端连接后发起协商, 服务端仅对协商过的连接使用压缩帧, 旧客户端不受影响;
+// 负载不小于 threshold 字节时按 level(compress/flate 级别)压缩, threshold<=0 时使用默认值
+func WithCompression(level, threshold int) TCPOptionFn {
+	return func(opt *tcpOption) {
+		if level < flate.HuffmanOnly || level > flate.BestCompression {
+			log.Fatalf("invalid compression level %d\n", level)
+		}
+		if threshold <= 0 {
+			threshold = DEFAULT_COMPRESS_THRESHOLD
+		}
+		opt.compress = true
+		opt.compressLevel = level
+		opt.compressThreshold = threshold
+	}
+}
+
+// WithHandshake 连接建立后先交换 hello 帧协商协议版本、编码、压缩与功能位, 两端须同时开启;
+// 开启后压缩由握手协商, 不再发送空负载协商帧
+func WithHandshake(hs Handshake) TCPOptionFn {
+	return func(opt *tcpOption) {
+		if hs.Version == 0 || len(hs.Codecs) == 0 {
+			log.Fatalln("handshake requires Version and Codecs")
+		}
+		for _, c := range hs.Codecs {
+			if c.Name == "" || c.Parser == nil {
+				log.Fatalln("handshake codec requires Name and Parser")
+			}
+		}
+		if hs.MinVersion == 0 {
+			hs.MinVersion = hs.Version
+		}
+		if hs.MinVersion > hs.Version {
+			log.Fatalf("handshake MinVersion %d > Version %d\n", hs.MinVersion, hs.Version)
+		}
+		if hs.Timeout <= 0 {
+			hs.Timeout = DEFAULT_HANDSHAKE_TIMEOUT
+		}
+		opt.handshake = &hs
+	}
+}
+
 var (
 	ErrTCPOptionNil = errors.New("tcpOption can not be nil")
 	ErrHandlerIsNil = errors.New("tcpOption.handler can not be nil")
@@ -2,36 +2,330 @@ package tcp
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"math"
 	"net"
 	"reflect"
 )
 
+// FrameHeader 帧长度头格式
+type FrameHeader uint8
+
+const (
+	HEADER_UINT16 FrameHeader = iota // 2字节大端长度, 默认
+	HEADER_UINT32                    // 4字节大端长度
+	HEADER_VARINT                    // uvarint 变长长度
+)
+
+func (h FrameHeader) String() string {
+	switch h {
+	case HEADER_UINT16:
+		return "uint16"
+	case HEADER_UINT32:
+		return "uint32"
+	case HEADER_VARINT:
+		return "varint"
+	}
+	return fmt.Sprintf("FrameHeader(%d)", uint8(h))
+}
+
+// ParseFrameHeader 由名称(uint16/uint32/varint)得到帧长度头格式
+func ParseFrameHeader(name string) (FrameHeader, error) {
+	for _, h := range []FrameHeader{HEADER_UINT16, HEADER_UINT32, HEADER_VARINT} {
+		if h.String() == name {
+			return h, nil
+		}
+	}
+	return HEADER_UINT16, fmt.Errorf("unknown frame header %q", name)
+}
+
+const (
+	LEN_BYTES              = 2
+	DEFAULT_MAX_FRAME_SIZE = 4 << 20 // 4字节或变长长度头时默认最大帧长度
+)
+
+var (
+	ErrMsgTooLong    = errors.New("message too long")
+	ErrFrameTooLarge = errors.New("frame too large")
+	ErrFrameMismatch = errors.New("payload does not match frame length")
+)
+
 // ------------------
 // |  len  |  data	|
 // --2byte-----------
+// 长度头可选 2字节、4字节或 uvarint, 读取时长度超过 maxFrame 直接返回错误
 type HeaderPacketParser struct {
-	Proc Protocol
+	Proc     Protocol
+	header   FrameHeader
+	maxFrame int
 }
 
-const LEN_BYTES = 2
-
 func NewHeaderPacketParser(prot Protocol) *HeaderPacketParser {
 	return &HeaderPacketParser{
-		Proc: prot,
+		Proc:     prot,
+		header:   HEADER_UINT16,
+		maxFrame: math.MaxUint16,
+	}
+}
+
+// NewFramePacketParser 指定长度头格式与最大帧长度, maxFrameSize<=0 时使用长度头允许的默认值
+func NewFramePacketParser(prot Protocol, header FrameHeader, maxFrameSize int) *HeaderPacketParser {
+	limit := DEFAULT_MAX_FRAME_SIZE
+	switch header {
+	case HEADER_UINT16:
+		limit = math.MaxUint16
+	case HEADER_UINT32, HEADER_VARINT:
+	default:
+		panic(fmt.Sprintf("NewFramePacketParser: unknown %v", header))
+	}
+	if maxFrameSize <= 0 {
+		maxFrameSize = limit
+	}
+	if header == HEADER_UINT16 && maxFrameSize > limit {
+		maxFrameSize = limit
+	}
+	if maxFrameSize > math.MaxInt32 {
+		maxFrameSize = math.MaxInt32
+	}
+	return &HeaderPacketParser{
+		Proc:     prot,
+		header:   header,
+		maxFrame: maxFrameSize,
+	}
+}
+
+// WithFrame 实现 FrameConfigurable, 返回使用新帧格式的副本
+func (p *HeaderPacketParser) WithFrame(header FrameHeader, maxFrameSize int) PacketParser {
+	return NewFramePacketParser(p.Proc, header, maxFrameSize)
+}
+
+// NewStream 实现 StreamParser, 协议支持连接级编解码流时返回绑定新流的副本及带帧头的前导帧
+func (p *HeaderPacketParser) NewStream() (PacketParser, *SharedBuf) {
+	sp, ok := p.Proc.(StreamProtocol)
+	if !ok {
+		return p, nil
+	}
+	stream := sp.NewStream()
+	if stream == nil {
+		return p, nil
+	}
+	np := &HeaderPacketParser{Proc: stream, header: p.header, maxFrame: p.maxFrame}
+	preamble, err := np.BuildFrameBuf(func(buf *bytes.Buffer) error {
+		buf.Write(stream.Preamble())
+		return nil
+	})
+	if err != nil {
+		panic(fmt.Sprintf("HeaderPacketParser.NewStream: preamble %v", err))
+	}
+	return np, preamble
+}
+
+// newStreamParser 连接使用的解析器及须最先发送的前导帧
+func newStreamParser(parser PacketParser) (PacketParser, *SharedBuf) {
+	if sp, ok := parser.(StreamParser); ok {
+		return sp.NewStream()
+	}
+	return parser, nil
+}
+
+// MsgID 实现 MsgIdentifier, 由协议给出消息标识
+func (p *HeaderPacketParser) MsgID(msg interface{}) (string, error) {
+	if mi, ok := p.Proc.(MsgIdentifier); ok {
+		return mi.MsgID(msg)
+	}
+	return TypeName(msg), nil
+}
+
+func (p *HeaderPacketParser) Header() FrameHeader {
+	return p.header
+}
+
+func (p *HeaderPacketParser) MaxFrameSize() int {
+	return p.maxFrame
+}
+
+// byteReader 为 net.Conn 等提供逐字节读取, 用于解析 uvarint 长度
+type byteReader struct {
+	io.Reader
+	b [1]byte
+}
+
+func (r *byteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(r.Reader, r.b[:]); err != nil {
+		return 0, err
+	}
+	return r.b[0], nil
+}
+
+// readLen 读取长度头并校验最大帧长度
+func (p *HeaderPacketParser) readLen(r io.Reader) (int, error) {
+	var msgLen uint64
+	switch p.header {
+	case HEADER_UINT32:
+		var buf [4]byte
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return 0, err
+		}
+		msgLen = uint64(binary.BigEndian.Uint32(buf[:]))
+	case HEADER_VARINT:
+		br, ok := r.(io.ByteReader)
+		if !ok {
+			br = &byteReader{Reader: r}
+		}
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return 0, err
+			}
+			return 0, fmt.Errorf("read frame len: %w", err)
+		}
+		msgLen = n
+	default:
+		var buf [LEN_BYTES]byte
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return 0, err
+		}
+		msgLen = uint64(binary.BigEndian.Uint16(buf[:]))
+	}
+
+	if msgLen > uint64(p.maxFrame) {
+		return 0, fmt.Errorf("%w: %d > %d", ErrFrameTooLarge, msgLen, p.maxFrame)
+	}
+	return int(msgLen), nil
+}
+
+// headerLen 长度头字节数
+func (p *HeaderPacketParser) headerLen(msgLen int) int {
+	switch p.header {
+	case HEADER_UINT32:
+		return 4
+	case HEADER_VARINT:
+		var buf [binary.MaxVarintLen64]byte
+		return binary.PutUvarint(buf[:], uint64(msgLen))
+	}
+	return LEN_BYTES
+}
+
+// putLen 写入长度头, buf 至少 headerLen(msgLen) 字节
+func (p *HeaderPacketParser) putLen(buf []byte, msgLen int) int {
+	switch p.header {
+	case HEADER_UINT32:
+		binary.BigEndian.PutUint32(buf, uint32(msgLen))
+		return 4
+	case HEADER_VARINT:
+		return binary.PutUvarint(buf, uint64(msgLen))
+	}
+	binary.BigEndian.PutUint16(buf, uint16(msgLen))
+	return LEN_BYTES
+}
+
+// frame 序列化消息并加上长度头
+func (p *HeaderPacketParser) frame(msg Packet) ([]byte, error) {
+	data, err := p.Proc.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	// check len
+	msgLen := len(data)
+	if msgLen > p.maxFrame {
+		return nil, ErrMsgTooLong
+	}
+
+	n := p.headerLen(msgLen)
+	msgData := make([]byte, n+msgLen)
+	// write len
+	p.putLen(msgData, msgLen)
+	// write data
+	copy(msgData[n:], data)
+	return msgData, nil
+}
+
+// DecodeFrame 实现 FrameDecoder, 返回解析出的包及其占用的字节数(含长度头)
+func (p *HeaderPacketParser) DecodeFrame(data []byte) (Packet, int, error) {
+	payload, n, err := p.SplitFrame(data)
+	if err != nil || n == 0 {
+		return nil, 0, err
+	}
+	msg, err := p.DecodePayload(payload)
+	if err != nil {
+		return nil, 0, err
 	}
+	return msg, n, nil
+}
+
+// SplitFrame 实现 PayloadParser, 从已读到的数据中切出一帧负载; 数据不足一帧时 n 返回 0
+func (p *HeaderPacketParser) SplitFrame(data []byte) (payload []byte, n int, err error) {
+	var msgLen uint64
+	hl := 0
+	switch p.header {
+	case HEADER_UINT32:
+		if len(data) < 4 {
+			return nil, 0, nil
+		}
+		msgLen, hl = uint64(binary.BigEndian.Uint32(data)), 4
+	case HEADER_VARINT:
+		v, k := binary.Uvarint(data)
+		if k == 0 {
+			return nil, 0, nil
+		}
+		if k < 0 {
+			return nil, 0, errors.New("read frame len: varint overflow")
+		}
+		msgLen, hl = v, k
+	default:
+		if len(data) < LEN_BYTES {
+			return nil, 0, nil
+		}
+		msgLen, hl = uint64(binary.BigEndian.Uint16(data)), LEN_BYTES
+	}
+
+	if msgLen > uint64(p.maxFrame) {
+		return nil, 0, fmt.Errorf("%w: %d > %d", ErrFrameTooLarge, msgLen, p.maxFrame)
+	}
+	end := hl + int(msgLen)
+	if len(data) < end {
+		return nil, 0, nil
+	}
+	return data[hl:end], end, nil
+}
+
+// ReadPayload 实现 PayloadParser, 读取一帧负载(不含长度头), 不会读取帧之后的数据
+func (p *HeaderPacketParser) ReadPayload(r io.Reader) ([]byte, error) {
+	msgLen, err := p.readLen(r)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, msgLen)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// DecodePayload 实现 PayloadParser, 反序列化一帧负载
+func (p *HeaderPacketParser) DecodePayload(payload []byte) (Packet, error) {
+	if len(payload) == 0 {
+		// 未开启压缩时忽略客户端的压缩协商帧
+		return nil, nil
+	}
+	msg, err := p.Proc.Unmarshal(payload)
+	if err != nil || msg == nil {
+		return nil, err
+	}
+	return msg.(Packet), nil
 }
 
 func (p *HeaderPacketParser) ReadPacket(conn net.Conn) (Packet, error) {
 	// read len
-	bufMsgLen := make([]byte, LEN_BYTES)
-	if _, err := io.ReadFull(conn, bufMsgLen); err != nil {
+	msgLen, err := p.readLen(conn)
+	if err != nil {
 		return nil, err
 	}
-	msgLen := binary.BigEndian.Uint16(bufMsgLen)
 
 	// read data
 	msgData := make([]byte, msgLen)
@@ -48,55 +342,79 @@ func (p *HeaderPacketParser) ReadPacket(conn net.Conn) (Packet, error) {
 }
 
 func (p *HeaderPacketParser) WritePacket(conn net.Conn, msg Packet) (int, error) {
-	data, err := p.Proc.Marshal(msg)
+	msgData, err := p.frame(msg)
 	if err != nil {
 		return 0, err
 	}
+	return conn.Write(msgData)
+}
 
-	// check len
-	msgLen := len(data)
-	if msgLen > math.MaxUint16 {
-		return 0, errors.New("message too long")
-	}
+func (p *HeaderPacketParser) BuildPacketBuf(msg Packet) ([]byte, error) {
+	return p.frame(msg)
+}
 
-	msgData := make([]byte, LEN_BYTES+msgLen)
-	// write len
-	binary.BigEndian.PutUint16(msgData, uint16(msgLen))
-	// write data
-	copy(msgData[LEN_BYTES:], data)
+// maxHeaderLen 长度头最大字节数, maxFrame 不超过 MaxInt32 时 uvarint 最多5字节
+func (p *HeaderPacketParser) maxHeaderLen() int {
+	switch p.header {
+	case HEADER_UINT32:
+		return 4
+	case HEADER_VARINT:
+		return binary.MaxVarintLen32
+	}
+	return LEN_BYTES
+}
 
-	return conn.Write(msgData)
+// BuildSharedBuf 实现 SharedBufBuilder, 预留长度头后直接序列化到池化缓冲, 再回填长度头
+func (p *HeaderPacketParser) BuildSharedBuf(msg Packet) (*SharedBuf, error) {
+	return p.BuildFrameBuf(func(buf *bytes.Buffer) error {
+		if bm, ok := p.Proc.(BufferMarshaler); ok {
+			return bm.MarshalTo(buf, msg)
+		}
+		data, err := p.Proc.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		return nil
+	})
 }
 
-func (p *HeaderPacketParser) BuildPacketBuf(msg Packet) ([]byte, error) {
-	data, err := p.Proc.Marshal(msg)
-	if err != nil {
+// BuildFrameBuf 实现 PayloadParser, 预留长度头后由 fill 写入负载, 再回填长度头
+func (p *HeaderPacketParser) BuildFrameBuf(fill func(buf *bytes.Buffer) error) (*SharedBuf, error) {
+	sb := getSharedBuf()
+	hl := p.maxHeaderLen()
+	buf := bytes.NewBuffer(sb.b[:hl])
+	if err := fill(buf); err != nil {
+		sb.Release()
 		return nil, err
 	}
+	sb.b = buf.Bytes()
 
 	// check len
-	msgLen := len(data)
-	if msgLen > math.MaxUint16 {
-		return nil, errors.New("message too long")
+	msgLen := len(sb.b) - hl
+	if msgLen > p.maxFrame {
+		sb.Release()
+		return nil, ErrMsgTooLong
 	}
 
-	msgData := make([]byte, LEN_BYTES+msgLen)
-	// write len
-	binary.BigEndian.PutUint16(msgData, uint16(msgLen))
-	// write data
-	copy(msgData[LEN_BYTES:], data)
-	return msgData, nil
+	// 长度头紧贴数据, 变长头时前部留空
+	sb.off = hl - p.headerLen(msgLen)
+	p.putLen(sb.b[sb.off:], msgLen)
+	return sb, nil
 }
 
 func (p *HeaderPacketParser) ReadBufPacket(inBuf *bufio.Reader) (Packet, error) {
 	// read len
-	bufMsgLen := make([]byte, LEN_BYTES)
-	if _, err := io.ReadFull(inBuf, bufMsgLen); err != nil {
+	msgLen, err := p.readLen(inBuf)
+	if err != nil {
 		return nil, err
 	}
-	msgLen := binary.BigEndian.Uint16(bufMsgLen)
+	if msgLen == 0 {
+		// 未开启压缩时忽略客户端的压缩协商帧
+		return nil, nil
+	}
 
-	if inBuf.Buffered() < int(msgLen) {
+	if _, ok := p.Proc.(TypePrefixed); !ok || inBuf.Buffered() < msgLen {
 		// read data
 		msgData := make([]byte, msgLen)
 		if _, err := io.ReadFull(inBuf, msgData); err != nil {
@@ -105,31 +423,38 @@ func (p *HeaderPacketParser) ReadBufPacket(inBuf *bufio.Reader) (Packet, error)
 
 		//unmarshal
 		msg, err := p.Proc.Unmarshal(msgData)
-		if err != nil {
+		if err != nil || msg == nil {
 			return nil, err
 		}
 		return msg.(Packet), err
 	}
 
-	//read data msgID len
-	buffID, _ := inBuf.Peek(LEN_BYTES)
-	msgIDLen := binary.BigEndian.Uint16(buffID)
-	n := int(LEN_BYTES + msgIDLen)
-	msgData, _ := inBuf.Peek(n)
+	// 整帧已在缓冲中, 直接在缓冲上解码, 解码不得越过帧尾
+	frame, _ := inBuf.Peek(msgLen)
+	defer inBuf.Discard(msgLen)
+	if msgLen < LEN_BYTES {
+		return nil, ErrFrameMismatch
+	}
+	n := LEN_BYTES + int(binary.BigEndian.Uint16(frame))
+	if n > msgLen {
+		return nil, ErrFrameMismatch
+	}
 	//get data msgType
-	msgType, err := p.Proc.UnmarshalType(msgData)
+	msgType, err := p.Proc.UnmarshalType(frame[:n])
 	if err != nil {
-		inBuf.Discard(int(msgLen))
 		return nil, err
 	}
-	//move to Packet head
-	inBuf.Discard(n)
 
 	//decode data to Packet
+	body := bytes.NewReader(frame[n:])
 	msg := reflect.New(msgType).Interface()
-	dec := p.Proc.GetDecoder(inBuf)
-	err = dec.Decode(&msg)
-	return msg.(Packet), err
+	if err := p.Proc.GetDecoder(body).Decode(msg); err != nil {
+		return nil, err
+	}
+	if body.Len() != 0 {
+		return nil, ErrFrameMismatch
+	}
+	return msg.(Packet), nil
 }
 
 func (p *HeaderPacketParser) WriteBufPacket(outBuf *bufio.Writer, msg Packet) (int, error) {
@@ -139,16 +464,15 @@ func (p *HeaderPacketParser) WriteBufPacket(outBuf *bufio.Writer, msg Packet) (i
 	}
 
 	// check len
-	if len(data) > math.MaxUint16 {
-		return 0, errors.New("message too long")
+	msgLen := len(data)
+	if msgLen > p.maxFrame {
+		return 0, ErrMsgTooLong
 	}
-	msgLen := uint16(len(data))
 
 	// write len
-	if err := outBuf.WriteByte(byte(msgLen >> 8)); err != nil {
-		return 0, err
-	}
-	if err := outBuf.WriteByte(byte(msgLen)); err != nil {
+	var head [binary.MaxVarintLen64]byte
+	n := p.putLen(head[:], msgLen)
+	if _, err := outBuf.Write(head[:n]); err != nil {
 		return 0, err
 	}
 	// write data
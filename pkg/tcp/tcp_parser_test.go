@@ -0,0 +1,111 @@
+package tcp_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+)
+
+func TestFrameHeaderRoundTrip(t *testing.T) {
+	newTestParser()
+	long := strings.Repeat("x", 100000)
+	for _, h := range []tcp.FrameHeader{tcp.HEADER_UINT16, tcp.HEADER_UINT32, tcp.HEADER_VARINT} {
+		p := tcp.NewFramePacketParser(testProt, h, 0)
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		texts := []string{"short", long}
+		for _, text := range texts {
+			_, err := p.WriteBufPacket(w, &echoMsg{Text: text})
+			if h == tcp.HEADER_UINT16 && text == long {
+				if !errors.Is(err, tcp.ErrMsgTooLong) {
+					t.Fatalf("%v: write long err %v, want ErrMsgTooLong", h, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%v: write err %v", h, err)
+			}
+		}
+		w.Flush()
+
+		r := bufio.NewReaderSize(&buf, 1024)
+		for _, text := range texts {
+			if h == tcp.HEADER_UINT16 && text == long {
+				continue
+			}
+			pkt, err := p.ReadBufPacket(r)
+			if err != nil {
+				t.Fatalf("%v: read err %v", h, err)
+			}
+			if got := pkt.(*echoMsg).Text; got != text {
+				t.Fatalf("%v: read %d bytes, want %d", h, len(got), len(text))
+			}
+		}
+	}
+}
+
+func TestMaxFrameSizeOnRead(t *testing.T) {
+	newTestParser()
+	p := tcp.NewFramePacketParser(testProt, tcp.HEADER_UINT32, 1024)
+
+	// 伪造的超长长度在分配内存前被拒绝
+	var head [4]byte
+	binary.BigEndian.PutUint32(head[:], 1<<30)
+	_, err := p.ReadBufPacket(bufio.NewReader(bytes.NewReader(head[:])))
+	if !errors.Is(err, tcp.ErrFrameTooLarge) {
+		t.Fatalf("read err %v, want ErrFrameTooLarge", err)
+	}
+
+	cliConn, srvConn := net.Pipe()
+	defer cliConn.Close()
+	go func() {
+		defer srvConn.Close()
+		p.WritePacket(srvConn, &echoMsg{Text: strings.Repeat("y", 2048)})
+	}()
+	if _, err := p.ReadPacket(cliConn); err == nil {
+		t.Fatal("oversize packet accepted")
+	}
+}
+
+func TestFrameShorterThanPayload(t *testing.T) {
+	newTestParser()
+	p := tcp.NewFramePacketParser(testProt, tcp.HEADER_UINT32, 100)
+	payload, err := testProt.Marshal(&echoMsg{Text: strings.Repeat("w", 5000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 长度头只声明 10 字节, 其后跟着完整的大消息
+	var buf bytes.Buffer
+	var head [4]byte
+	binary.BigEndian.PutUint32(head[:], 10)
+	buf.Write(head[:])
+	buf.Write(payload)
+	r := bufio.NewReaderSize(&buf, 8192)
+	if pkt, err := p.ReadBufPacket(r); err == nil {
+		t.Fatalf("decoded %d bytes past frame end", len(pkt.(*echoMsg).Text))
+	}
+	// 无论解码结果如何, 只消耗长度头声明的字节
+	if got, want := r.Buffered(), len(payload)-10; got != want {
+		t.Fatalf("buffered %d after bad frame, want %d", got, want)
+	}
+}
+
+func TestVarintFrameEcho(t *testing.T) {
+	opts := []tcp.TCPOptionFn{tcp.WithFrameHeader(tcp.HEADER_VARINT), tcp.WithMaxFrameSize(1 << 20)}
+	_, _, addr := startTestServer(t, opts...)
+
+	long := strings.Repeat("z", 200000)
+	h := newRecvHandler(long)
+	client := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newTestParser(), opts...))
+	client.Start()
+	defer client.Close()
+
+	waitRecv(t, h, long)
+}
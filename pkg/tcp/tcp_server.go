@@ -1,19 +1,30 @@
 package tcp
 
 import (
+	"crypto/tls"
+	"errors"
 	"log"
 	"net"
 	"sync"
 	"time"
 )
 
+var (
+	ErrShutdownTimeout  = errors.New("tcp server shutdown timeout")
+	ErrEpollUnsupported = errors.New("epoll is not supported on this platform")
+	ErrEpollParser      = errors.New("epoll mode requires a FrameDecoder parser")
+)
+
 type TCPServer struct {
 	Addr    string
 	opt     *tcpOption
-	ln      net.TCPListener
-	conns   sync.Map // map[net.Conn]struct{}
+	lnMu    sync.Mutex
+	lns     map[net.Listener]struct{}
+	conns   sync.Map // map[net.Conn]*TCPConn
 	wgLn    sync.WaitGroup
 	wgConns sync.WaitGroup
+	limiter *connLimiter // 连接数限制, 未配置时为 nil
+	pollers *pollerGroup // epoll 模式, 未启用或不支持时为 nil
 }
 
 func NewTCPServer(addr string, opt *tcpOption) *TCPServer {
@@ -21,18 +32,24 @@ func NewTCPServer(addr string, opt *tcpOption) *TCPServer {
 		log.Fatal("*tcpOption opt can not be nil")
 	}
 	srv := &TCPServer{
-		Addr: addr,
-		opt:  opt,
+		Addr:    addr,
+		opt:     opt,
+		lns:     make(map[net.Listener]struct{}),
+		limiter: newConnLimiter(opt),
+	}
+	if opt.epollPollers > 0 {
+		pollers, err := newPollerGroup(opt.epollPollers, opt)
+		if err != nil {
+			log.Printf("epoll disabled, fallback to goroutine per conn: %v\n", err)
+		} else {
+			srv.pollers = pollers
+		}
 	}
 	return srv
 }
 
 func (srv *TCPServer) ListenAndServe() error {
-	tcpAddr, err := net.ResolveTCPAddr("tcp", srv.Addr)
-	if err != nil {
-		return err
-	}
-	ln, err := net.ListenTCP("tcp", tcpAddr)
+	ln, err := net.Listen("tcp", srv.Addr)
 	if err != nil {
 		return err
 	}
@@ -40,15 +57,22 @@ func (srv *TCPServer) ListenAndServe() error {
 	return srv.Serve(ln)
 }
 
-func (server *TCPServer) Serve(ln *net.TCPListener) error {
-	server.ln = *ln
-
+// Serve 在任意 net.Listener 上接受连接(tcp、unix、websocket 等), 可对多个 listener 并发调用
+func (server *TCPServer) Serve(ln net.Listener) error {
+	server.lnMu.Lock()
+	server.lns[ln] = struct{}{}
 	server.wgLn.Add(1)
-	defer server.wgLn.Done()
+	server.lnMu.Unlock()
+	defer func() {
+		server.lnMu.Lock()
+		delete(server.lns, ln)
+		server.lnMu.Unlock()
+		server.wgLn.Done()
+	}()
 
 	var tempDelay time.Duration
 	for {
-		conn, err := ln.AcceptTCP()
+		conn, err := ln.Accept()
 		if err != nil {
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				if tempDelay == 0 {
@@ -67,34 +91,188 @@ func (server *TCPServer) Serve(ln *net.TCPListener) error {
 		}
 		tempDelay = 0
 
-		server.conns.Store(conn, struct{}{})
-
 		//handle tcpConn
 		server.wgConns.Add(1)
 		go func() {
-			defer func() {
-				server.conns.Delete(conn)
-				server.wgConns.Done()
-			}()
-
-			tcpConn := newConn(conn, server.opt)
-			defer tcpConn.Close()
-			if !server.opt.handler.OnConnect(tcpConn) {
-				log.Printf("connect refuse: %v", conn.RemoteAddr().String())
-				tcpConn.Close()
-				return
-			}
-			tcpConn.serve(&server.wgConns)
+			defer server.wgConns.Done()
+			server.serveConn(conn)
 		}()
 	}
 }
 
-func (server *TCPServer) Close() {
-	server.ln.Close()
+// ServeConn 处理一个已建立的连接(如 net.Pipe), 阻塞直到连接关闭
+func (server *TCPServer) ServeConn(conn net.Conn) {
+	server.wgConns.Add(1)
+	defer server.wgConns.Done()
+	server.serveConn(conn)
+}
+
+func (server *TCPServer) serveConn(conn net.Conn) {
+	rawConn := conn
+	server.conns.Store(rawConn, (*TCPConn)(nil))
+	polled := false // 交给 poller 的连接在关闭时清理
+	defer func() {
+		if !polled {
+			server.conns.Delete(rawConn)
+		}
+	}()
+
+	// 读取 PROXY 头之前占用全局名额, 迟迟不发送 PROXY 头或不完成 TLS 握手的连接同样计入连接数限制
+	var slot *connSlot
+	var err error
+	if server.limiter != nil {
+		known := conn.RemoteAddr()
+		if server.opt.proxyProtocol {
+			known = nil
+		}
+		if slot, err = server.limiter.acquire(known); err != nil {
+			log.Printf("reject %v: %v\n", conn.RemoteAddr(), err)
+			server.reject(conn, err)
+			return
+		}
+	}
+
+	// PROXY protocol 头位于 TLS 握手之前
+	proxy, err := server.acceptProxy(conn)
+	if err != nil {
+		log.Printf("proxy protocol %v error: %v\n", conn.RemoteAddr().String(), err)
+		slot.release()
+		conn.Close()
+		return
+	}
+	remote := conn.RemoteAddr()
+	if proxy != nil && proxy.src != nil {
+		remote = proxy.src
+	}
+	// 得到真实地址后计入单 IP 名额
+	if slot != nil {
+		if err = slot.bind(remote); err != nil {
+			log.Printf("reject %v: %v\n", remote, err)
+			server.reject(conn, err)
+			return
+		}
+	}
+
+	if server.opt.tlsConfig != nil {
+		tlsConn := tls.Server(conn, server.opt.tlsConfig)
+		if err := tlsHandshake(tlsConn); err != nil {
+			log.Printf("tls handshake %v error: %v\n", conn.RemoteAddr().String(), err)
+			slot.release()
+			conn.Close()
+			return
+		}
+		conn = tlsConn
+	}
+
+	var hs *Negotiated
+	if server.opt.handshake != nil {
+		if hs, err = acceptHandshake(conn, server.opt); err != nil {
+			log.Printf("handshake %v error: %v\n", remote, err)
+			slot.release()
+			if errors.Is(err, ErrNoHandshake) {
+				// 旧客户端读不懂 hello 回复, 改为发送 Handler 给出的通知
+				server.notify(conn, err)
+			}
+			conn.Close()
+			return
+		}
+	}
+
+	// TLS 连接及 websocket、pipe 等无法取得 fd 的连接仍使用独立协程
+	if server.pollers != nil && conn == rawConn {
+		if tcpConn := server.pollers.newConn(conn, server.opt, hs); tcpConn != nil {
+			tcpConn.setProxy(proxy)
+			polled = true
+			server.servePolled(rawConn, tcpConn, slot)
+			return
+		}
+	}
+	defer slot.release()
+
+	tcpConn := newConn(conn, server.opt, hs)
+	tcpConn.setProxy(proxy)
+	server.conns.Store(rawConn, tcpConn)
+	defer tcpConn.Close()
+	if !tcpConn.onConnect() {
+		log.Printf("connect refuse: %v", tcpConn.RemoteAddr().String())
+		tcpConn.Close()
+		return
+	}
+	tcpConn.serve(&server.wgConns)
+}
+
+// servePolled 注册到 poller 后立即返回, 连接关闭时释放连接数并通知 wgConns
+func (server *TCPServer) servePolled(rawConn net.Conn, tcpConn *TCPConn, slot *connSlot) {
+	server.wgConns.Add(1)
+	tcpConn.onClosed = func() {
+		server.conns.Delete(rawConn)
+		slot.release()
+		server.wgConns.Done()
+	}
+	server.conns.Store(rawConn, tcpConn)
+	if !tcpConn.onConnect() {
+		log.Printf("connect refuse: %v", tcpConn.RemoteAddr().String())
+		tcpConn.Close()
+		return
+	}
+	if err := server.pollers.add(tcpConn); err != nil {
+		if err != ErrConnClosing {
+			log.Printf("epoll add %v error: %v\n", tcpConn.RemoteAddr(), err)
+		}
+		tcpConn.Close()
+	}
+}
+
+// StopAccept 关闭所有 listener 停止接受新连接, 已建立的连接不受影响
+func (server *TCPServer) StopAccept() {
+	server.lnMu.Lock()
+	for ln := range server.lns {
+		ln.Close()
+	}
+	server.lnMu.Unlock()
 	server.wgLn.Wait()
+}
+
+// Shutdown 优雅关闭: 停止接受新连接, 写出每个连接发送队列中的数据后关闭,
+// 超过 timeout 仍未完成的连接被强制关闭并返回 ErrShutdownTimeout
+func (server *TCPServer) Shutdown(timeout time.Duration) error {
+	server.StopAccept()
 
 	server.conns.Range(
 		func(k, v interface{}) bool {
+			if c, ok := v.(*TCPConn); ok && c != nil {
+				c.Drain()
+			} else {
+				k.(net.Conn).Close()
+			}
+			return true
+		})
+
+	done := make(chan struct{})
+	go func() {
+		server.wgConns.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		server.Close()
+		return ErrShutdownTimeout
+	}
+}
+
+func (server *TCPServer) Close() {
+	server.StopAccept()
+
+	server.conns.Range(
+		func(k, v interface{}) bool {
+			// epoll 模式的连接关闭 fd 不会产生事件, 需经 TCPConn 关闭
+			if c, ok := v.(*TCPConn); ok && c != nil && c.ep != nil {
+				c.Close()
+				return true
+			}
 			err := k.(net.Conn).Close()
 			if err != nil {
 				log.Printf("TCPServer conns close error: %v\n", err)
@@ -102,4 +280,7 @@ func (server *TCPServer) Close() {
 			return true
 		})
 	server.wgConns.Wait()
+	if server.pollers != nil {
+		server.pollers.close()
+	}
 }
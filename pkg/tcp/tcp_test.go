@@ -0,0 +1,402 @@
+package tcp_test
+
+import (
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+	"github.com/jinnblue/chatroom-test/pkg/tcp/protocol"
+	"github.com/jinnblue/chatroom-test/pkg/websocket"
+)
+
+type echoMsg struct {
+	tcp.Message
+	Text string
+}
+
+// pingMsg 自动回复测试用的心跳包
+type pingMsg struct {
+	tcp.Message
+}
+
+var (
+	testProt     *protocol.GobProtocol
+	testProtOnce sync.Once
+)
+
+func newTestParser() *tcp.HeaderPacketParser {
+	testProtOnce.Do(func() {
+		testProt = protocol.NewGobProtocol()
+		testProt.Register(&echoMsg{})
+		testProt.Register(&pingMsg{})
+	})
+	return tcp.NewHeaderPacketParser(testProt)
+}
+
+// echoHandler 服务端原样回显收到的消息
+type echoHandler struct {
+	connects int32
+}
+
+func (h *echoHandler) OnConnect(c *tcp.TCPConn) bool {
+	atomic.AddInt32(&h.connects, 1)
+	return true
+}
+
+func (h *echoHandler) OnMessage(c *tcp.TCPConn, p tcp.Packet) bool {
+	return c.AsyncSendPacket(tcp.ReplyTo(p, p)) == nil
+}
+
+func (h *echoHandler) OnClose(c *tcp.TCPConn) {}
+
+// recvHandler 客户端连接后发送 hello, 并把收到的消息投递到 recv
+type recvHandler struct {
+	hello  string
+	recv   chan string
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newRecvHandler(hello string) *recvHandler {
+	return &recvHandler{
+		hello:  hello,
+		recv:   make(chan string, 16),
+		closed: make(chan struct{}),
+	}
+}
+
+func (h *recvHandler) OnConnect(c *tcp.TCPConn) bool {
+	return c.AsyncSendPacket(&echoMsg{Text: h.hello}) == nil
+}
+
+func (h *recvHandler) OnMessage(c *tcp.TCPConn, p tcp.Packet) bool {
+	h.recv <- p.(*echoMsg).Text
+	return true
+}
+
+func (h *recvHandler) OnClose(c *tcp.TCPConn) {
+	h.once.Do(func() { close(h.closed) })
+}
+
+// startServer 在本地随机端口启动使用 h 的服务端, 测试结束时关闭
+func startServer(t *testing.T, h tcp.Handler, opts ...tcp.TCPOptionFn) (*tcp.TCPServer, string) {
+	t.Helper()
+	return startParserServer(t, h, newTestParser(), opts...)
+}
+
+// startParserServer 同 startServer, 使用指定的编码
+func startParserServer(t *testing.T, h tcp.Handler, parser tcp.PacketParser, opts ...tcp.TCPOptionFn) (*tcp.TCPServer, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := tcp.NewTCPServer(ln.Addr().String(), tcp.NewTCPOption(h, parser, opts...))
+	go srv.Serve(ln)
+	t.Cleanup(srv.Close)
+	return srv, ln.Addr().String()
+}
+
+func startTestServer(t *testing.T, opts ...tcp.TCPOptionFn) (*tcp.TCPServer, *echoHandler, string) {
+	t.Helper()
+	h := &echoHandler{}
+	srv, addr := startServer(t, h, opts...)
+	return srv, h, addr
+}
+
+func waitRecv(t *testing.T, h *recvHandler, want string) {
+	t.Helper()
+	select {
+	case got := <-h.recv:
+		if got != want {
+			t.Fatalf("recv %q, want %q", got, want)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("wait %q timeout", want)
+	}
+}
+
+func TestServeConnPipe(t *testing.T) {
+	srv := tcp.NewTCPServer("pipe", tcp.NewTCPOption(&echoHandler{}, newTestParser()))
+	defer srv.Close()
+
+	h := newRecvHandler("hello pipe")
+	dial := func(addr string) (net.Conn, error) {
+		cliConn, srvConn := net.Pipe()
+		go srv.ServeConn(srvConn)
+		return cliConn, nil
+	}
+	client := tcp.NewTCPClient("pipe", 1, tcp.NewTCPOption(h, newTestParser(), tcp.WithDialer(dial)))
+	client.Start()
+	defer client.Close()
+
+	waitRecv(t, h, "hello pipe")
+}
+
+func TestServeUnixListener(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "chat.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skip("unix socket not supported:", err)
+	}
+	srv := tcp.NewTCPServer(sock, tcp.NewTCPOption(&echoHandler{}, newTestParser()))
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	h := newRecvHandler("hello unix")
+	dial := func(addr string) (net.Conn, error) {
+		return net.Dial("unix", addr)
+	}
+	client := tcp.NewTCPClient(sock, 1, tcp.NewTCPOption(h, newTestParser(), tcp.WithDialer(dial)))
+	client.Start()
+	defer client.Close()
+
+	waitRecv(t, h, "hello unix")
+}
+
+// relayHandler 把收到的消息转发给所有其他连接, 模拟聊天室广播
+type relayHandler struct {
+	conns sync.Map // map[*tcp.TCPConn]struct{}
+}
+
+func (h *relayHandler) OnConnect(c *tcp.TCPConn) bool {
+	h.conns.Store(c, struct{}{})
+	return true
+}
+
+func (h *relayHandler) OnMessage(c *tcp.TCPConn, p tcp.Packet) bool {
+	h.conns.Range(func(k, v interface{}) bool {
+		if k != c {
+			k.(*tcp.TCPConn).AsyncSendPacket(p)
+		}
+		return true
+	})
+	return true
+}
+
+func (h *relayHandler) OnClose(c *tcp.TCPConn) {
+	h.conns.Delete(c)
+}
+
+func TestWebSocketAndTCPShareHandler(t *testing.T) {
+	relay := &relayHandler{}
+	opt := tcp.NewTCPOption(relay, newTestParser())
+
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsLn, err := websocket.Listen("127.0.0.1:0", "/chat", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := tcp.NewTCPServer("", opt)
+	go srv.Serve(tcpLn)
+	go srv.Serve(wsLn)
+	defer srv.Close()
+
+	tcpUser := &recvHandler{recv: make(chan string, 16), closed: make(chan struct{})}
+	tcpClient := tcp.NewTCPClient(tcpLn.Addr().String(), 1, tcp.NewTCPOption(tcpUser, newTestParser()))
+	tcpClient.Start()
+	defer tcpClient.Close()
+	for i := 0; ; i++ {
+		n := 0
+		relay.conns.Range(func(k, v interface{}) bool { n++; return true })
+		if n == 1 {
+			break
+		}
+		if i > 300 {
+			t.Fatal("tcp user not connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	wsUser := newRecvHandler("hello from websocket")
+	wsDial := func(addr string) (net.Conn, error) {
+		return websocket.Dial(addr, nil)
+	}
+	wsClient := tcp.NewTCPClient("ws://"+wsLn.Addr().String()+"/chat", 1, tcp.NewTCPOption(wsUser, newTestParser(), tcp.WithDialer(wsDial)))
+	wsClient.Start()
+	defer wsClient.Close()
+
+	waitRecv(t, tcpUser, "hello from websocket")
+}
+
+// pongHandler 收到 ping 时回复 pong
+type pongHandler struct {
+	*recvHandler
+}
+
+func (h *pongHandler) OnMessage(c *tcp.TCPConn, p tcp.Packet) bool {
+	if p.(*echoMsg).Text == "ping" {
+		c.AsyncSendPacket(&echoMsg{Text: "pong"})
+	}
+	return h.recvHandler.OnMessage(c, p)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	_, _, addr := startTestServer(t, tcp.WithIdleTimeout(200*time.Millisecond))
+
+	h := newRecvHandler("only once")
+	client := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newTestParser()))
+	client.Start()
+	defer client.Close()
+	waitRecv(t, h, "only once")
+
+	select {
+	case <-h.closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("silent client not closed by idle timeout")
+	}
+}
+
+func TestHeartbeatKeepAlive(t *testing.T) {
+	_, _, addr := startTestServer(t,
+		tcp.WithHeartbeat(50*time.Millisecond, &echoMsg{Text: "ping"}),
+		tcp.WithIdleTimeout(200*time.Millisecond))
+
+	h := &pongHandler{newRecvHandler("hello")}
+	client := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newTestParser()))
+	client.Start()
+	defer client.Close()
+	waitRecv(t, h.recvHandler, "hello")
+
+	// 持续回复心跳, 超过空闲超时仍保持连接
+	deadline := time.After(600 * time.Millisecond)
+	for {
+		select {
+		case <-h.closed:
+			t.Fatal("client answering heartbeat was closed")
+		case <-h.recv:
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// holdHandler 收到的消息记入 recv, 处理第一条消息时阻塞到 release 关闭
+type holdHandler struct {
+	recv    chan string
+	release chan struct{}
+	closed  chan struct{}
+}
+
+func (h *holdHandler) OnConnect(c *tcp.TCPConn) bool { return true }
+
+func (h *holdHandler) OnMessage(c *tcp.TCPConn, p tcp.Packet) bool {
+	h.recv <- p.(*echoMsg).Text
+	<-h.release
+	return true
+}
+
+func (h *holdHandler) OnClose(c *tcp.TCPConn) { close(h.closed) }
+
+// TestAutoPong 客户端 Handler 阻塞时由读取协程回复心跳, 不被服务端空闲超时断开
+func TestAutoPong(t *testing.T) {
+	srvH := newRecvHandler("hold")
+	_, addr := startServer(t, srvH,
+		tcp.WithHeartbeat(50*time.Millisecond, &pingMsg{}),
+		tcp.WithIdleTimeout(200*time.Millisecond))
+
+	h := &holdHandler{recv: make(chan string, 8), release: make(chan struct{}), closed: make(chan struct{})}
+	client := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newTestParser(),
+		tcp.WithAutoPong(&pingMsg{}, &echoMsg{Text: "pong"})))
+	client.Start()
+	defer client.Close()
+	defer close(h.release)
+
+	deadline := time.After(600 * time.Millisecond)
+	pongs := 0
+	for {
+		select {
+		case <-srvH.closed:
+			t.Fatal("client with blocked handler was closed")
+		case <-h.closed:
+			t.Fatal("client closed")
+		case got := <-srvH.recv:
+			if got != "pong" {
+				t.Fatalf("server recv %q, want pong", got)
+			}
+			pongs++
+		case <-deadline:
+			if pongs == 0 {
+				t.Fatal("no pong received")
+			}
+			return
+		}
+	}
+}
+
+// burstHandler 收到消息后排队 n 条回复, 不等待写出
+type burstHandler struct {
+	n      int
+	queued chan struct{}
+}
+
+func (h *burstHandler) OnConnect(c *tcp.TCPConn) bool { return true }
+
+func (h *burstHandler) OnMessage(c *tcp.TCPConn, p tcp.Packet) bool {
+	for i := 0; i < h.n; i++ {
+		c.AsyncSendPacket(&echoMsg{Text: "burst"})
+	}
+	close(h.queued)
+	return true
+}
+
+func (h *burstHandler) OnClose(c *tcp.TCPConn) {}
+
+func TestShutdownDrain(t *testing.T) {
+	bh := &burstHandler{n: 50, queued: make(chan struct{})}
+	srv, addr := startServer(t, bh, tcp.WithSendChanLimit(bh.n))
+
+	h := newRecvHandler("go")
+	h.recv = make(chan string, bh.n)
+	client := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newTestParser()))
+	client.Start()
+	defer client.Close()
+
+	<-bh.queued
+	if err := srv.Shutdown(3 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-h.closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("client not closed after shutdown")
+	}
+	if n := len(h.recv); n != bh.n {
+		t.Fatalf("recv %d packets before close, want %d", n, bh.n)
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	srv := tcp.NewTCPServer("pipe", tcp.NewTCPOption(&echoHandler{}, newTestParser()))
+	defer srv.Close()
+
+	// 第一次拨号得到的连接随即被对端关闭, 之后的连接正常处理
+	var dials int32
+	dial := func(addr string) (net.Conn, error) {
+		cliConn, srvConn := net.Pipe()
+		if atomic.AddInt32(&dials, 1) == 1 {
+			srvConn.Close()
+		} else {
+			go srv.ServeConn(srvConn)
+		}
+		return cliConn, nil
+	}
+	h := newRecvHandler("hello again")
+	opt := tcp.NewTCPOption(h, newTestParser(),
+		tcp.WithDialer(dial), tcp.WithReconnect(10*time.Millisecond, 50*time.Millisecond))
+	client := tcp.NewTCPClient("pipe", 1, opt)
+	client.Start()
+	defer client.Close()
+
+	waitRecv(t, h, "hello again")
+	if n := atomic.LoadInt32(&dials); n < 2 {
+		t.Fatalf("dials %d, want >= 2", n)
+	}
+}
@@ -0,0 +1,152 @@
+package tcp_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+)
+
+type testCerts struct {
+	caFile, serverCert, serverKey, clientCert, clientKey string
+}
+
+// genTestCerts 生成自签名CA, 以及由其签发的服务端、客户端证书
+func genTestCerts(t *testing.T) *testCerts {
+	t.Helper()
+	dir := t.TempDir()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "chatroom test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	issue := func(serial int64, name string, usage x509.ExtKeyUsage) (string, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certFile := writePEM(t, dir, name+".crt", "CERTIFICATE", der)
+		keyFile := writePEM(t, dir, name+".key", "EC PRIVATE KEY", keyDER)
+		return certFile, keyFile
+	}
+
+	c := &testCerts{caFile: writePEM(t, dir, "ca.crt", "CERTIFICATE", caDER)}
+	c.serverCert, c.serverKey = issue(2, "server", x509.ExtKeyUsageServerAuth)
+	c.clientCert, c.clientKey = issue(3, "client", x509.ExtKeyUsageClientAuth)
+	return c
+}
+
+func writePEM(t *testing.T, dir, name, typ string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTLSEcho(t *testing.T) {
+	certs := genTestCerts(t)
+	srvCfg, err := tcp.NewServerTLSConfig(certs.serverCert, certs.serverKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, addr := startTestServer(t, tcp.WithTLSConfig(srvCfg))
+
+	cliCfg, err := tcp.NewClientTLSConfig(certs.caFile, "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newRecvHandler("hello tls")
+	client := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newTestParser(), tcp.WithTLSConfig(cliCfg)))
+	client.Start()
+	defer client.Close()
+
+	waitRecv(t, h, "hello tls")
+}
+
+func TestMutualTLS(t *testing.T) {
+	certs := genTestCerts(t)
+	srvCfg, err := tcp.NewServerTLSConfig(certs.serverCert, certs.serverKey, certs.caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, srvHandler, addr := startTestServer(t, tcp.WithTLSConfig(srvCfg))
+
+	// 出示客户端证书
+	cliCfg, err := tcp.NewClientTLSConfig(certs.caFile, certs.clientCert, certs.clientKey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newRecvHandler("hello mtls")
+	client := tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newTestParser(), tcp.WithTLSConfig(cliCfg)))
+	client.Start()
+	waitRecv(t, h, "hello mtls")
+	client.Close()
+	if n := atomic.LoadInt32(&srvHandler.connects); n != 1 {
+		t.Fatalf("server connects %d, want 1", n)
+	}
+
+	// 未出示客户端证书, 服务端拒绝
+	noCertCfg, err := tcp.NewClientTLSConfig(certs.caFile, "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = newRecvHandler("no cert")
+	client = tcp.NewTCPClient(addr, 1, tcp.NewTCPOption(h, newTestParser(), tcp.WithTLSConfig(noCertCfg)))
+	client.Start()
+	defer client.Close()
+	select {
+	case <-h.closed:
+	case txt := <-h.recv:
+		t.Fatalf("client without cert recv %q", txt)
+	case <-time.After(3 * time.Second):
+		t.Fatal("client without cert not closed")
+	}
+	if n := atomic.LoadInt32(&srvHandler.connects); n != 1 {
+		t.Fatalf("server connects %d, want 1", n)
+	}
+}
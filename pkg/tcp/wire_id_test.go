@@ -0,0 +1,87 @@
+package tcp_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/jinnblue/chatroom-test/pkg/tcp"
+	"github.com/jinnblue/chatroom-test/pkg/tcp/protocol"
+)
+
+// loginV1 与 renamedLogin 模拟消息类型改名前后的两端, 线上标识相同
+type loginV1 struct {
+	tcp.Message
+	Name string
+}
+
+func (*loginV1) WireID() string                                 { return "test.login" }
+func (m *loginV1) MarshalBinaryTo(w *protocol.BinaryWriter)     { w.Str(m.Name) }
+func (m *loginV1) UnmarshalBinaryFrom(r *protocol.BinaryReader) { m.Name = r.Str() }
+
+type renamedLogin struct {
+	tcp.Message
+	Name string
+}
+
+func (*renamedLogin) WireID() string                                 { return "test.login" }
+func (m *renamedLogin) MarshalBinaryTo(w *protocol.BinaryWriter)     { w.Str(m.Name) }
+func (m *renamedLogin) UnmarshalBinaryFrom(r *protocol.BinaryReader) { m.Name = r.Str() }
+
+func newWireParser(t *testing.T, codec string, msg interface{}) *tcp.HeaderPacketParser {
+	prot, err := protocol.New(codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := prot.Register(msg); id != "test.login" {
+		t.Fatalf("registered as %q", id)
+	}
+	return tcp.NewHeaderPacketParser(prot)
+}
+
+func TestWireIDRename(t *testing.T) {
+	for _, codec := range protocol.Codecs {
+		send, preamble := newWireParser(t, codec, &loginV1{}).NewStream()
+		recv, _ := newWireParser(t, codec, &renamedLogin{}).NewStream()
+		dec := recv.(tcp.FrameDecoder)
+		if preamble != nil {
+			if _, _, err := dec.DecodeFrame(preamble.Bytes()); err != nil {
+				t.Fatalf("%s: preamble %v", codec, err)
+			}
+			preamble.Release()
+		}
+
+		frame, err := send.BuildPacketBuf(&loginV1{Message: tcp.Message{ReqSeq: 7}, Name: "bob"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(frame, []byte("test.login")) && codec != "binary" {
+			t.Fatalf("%s: frame % x without wire id", codec, frame)
+		}
+		// gob 的类型描述带结构体名, 但解码不检查; 其余格式不含 Go 类型名与包路径
+		if bytes.Contains(frame, []byte("tcp_test")) || codec != "gob" && bytes.Contains(frame, []byte("loginV1")) {
+			t.Fatalf("%s: frame %q leaks go type name", codec, frame)
+		}
+		p, _, err := dec.DecodeFrame(frame)
+		if err != nil {
+			t.Fatalf("%s: %v", codec, err)
+		}
+		got, ok := p.(*renamedLogin)
+		if !ok || got.Name != "bob" || got.ReqSeq != 7 {
+			t.Fatalf("%s: decoded %#v", codec, p)
+		}
+	}
+}
+
+func TestCheckWireIDs(t *testing.T) {
+	if err := protocol.CheckWireIDs(&loginV1{}); err != nil {
+		t.Fatal(err)
+	}
+	err := protocol.CheckWireIDs(&loginV1{}, &renamedLogin{})
+	if err == nil || !strings.Contains(err.Error(), `wire id "test.login" used by both`) {
+		t.Fatalf("duplicate: %v", err)
+	}
+	if err := protocol.CheckWireIDs(&loginV1{}, &echoMsg{}); err == nil {
+		t.Fatal("message without wire id accepted")
+	}
+}
@@ -0,0 +1,271 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// frame opcode, RFC 6455 5.2
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+const (
+	finBit  = 0x80
+	maskBit = 0x80
+
+	maxControlPayload = 125
+	closeNormal       = 1000
+	closeProtocolErr  = 1002
+	closeWriteTimeout = time.Second
+)
+
+var (
+	ErrProtocol       = errors.New("websocket: protocol error")
+	ErrBadHandshake   = errors.New("websocket: bad handshake")
+	ErrBadOrigin      = errors.New("websocket: origin not allowed")
+	ErrListenerClosed = errors.New("websocket: listener closed")
+)
+
+// Conn 把 websocket 二进制消息适配为字节流的 net.Conn,
+// 写入的每段数据作为一个 binary frame 发出, 读取时按序拼接所有数据帧
+type Conn struct {
+	conn     net.Conn
+	br       *bufio.Reader
+	isClient bool // 客户端发送的帧必须加掩码
+
+	readMu  sync.Mutex
+	remain  int64 // 当前数据帧未读的负载长度
+	masked  bool
+	maskKey [4]byte
+	maskPos int
+
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+	closeSent bool
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, isClient bool) *Conn {
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+	return &Conn{
+		conn:     conn,
+		br:       br,
+		isClient: isClient,
+	}
+}
+
+// UnderlyingConn 返回底层传输连接
+func (c *Conn) UnderlyingConn() net.Conn {
+	return c.conn
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for c.remain == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(p)) > c.remain {
+		p = p[:c.remain]
+	}
+	n, err := c.br.Read(p)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			p[i] ^= c.maskKey[c.maskPos&3]
+			c.maskPos++
+		}
+	}
+	c.remain -= int64(n)
+	return n, err
+}
+
+// nextFrame 读取下一个帧头, 控制帧在此处理, 数据帧记录负载长度留给 Read
+func (c *Conn) nextFrame() error {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return err
+	}
+	if head[0]&0x70 != 0 {
+		return c.failProtocol()
+	}
+	opcode := head[0] & 0x0f
+	masked := head[1]&maskBit != 0
+	if masked == c.isClient {
+		// 客户端发来的帧必须加掩码, 服务端发来的帧不能加掩码
+		return c.failProtocol()
+	}
+
+	length := int64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+		if length < 0 {
+			return c.failProtocol()
+		}
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, key[:]); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case opContinuation, opText, opBinary:
+		c.remain = length
+		c.masked = masked
+		c.maskKey = key
+		c.maskPos = 0
+		return nil
+	case opClose, opPing, opPong:
+	default:
+		return c.failProtocol()
+	}
+
+	// control frame
+	if head[0]&finBit == 0 || length > maxControlPayload {
+		return c.failProtocol()
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= key[i&3]
+		}
+	}
+
+	switch opcode {
+	case opPing:
+		return c.writeFrame(opPong, payload)
+	case opClose:
+		c.sendClose(closeNormal)
+		return io.EOF
+	}
+	return nil
+}
+
+func (c *Conn) failProtocol() error {
+	c.sendClose(closeProtocolErr)
+	return ErrProtocol
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(opBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	var head [14]byte
+	head[0] = finBit | opcode
+	n := 2
+	switch length := len(payload); {
+	case length <= 125:
+		head[1] = byte(length)
+	case length <= 0xffff:
+		head[1] = 126
+		binary.BigEndian.PutUint16(head[2:], uint16(length))
+		n += 2
+	default:
+		head[1] = 127
+		binary.BigEndian.PutUint64(head[2:], uint64(length))
+		n += 8
+	}
+
+	frame := make([]byte, 0, n+4+len(payload))
+	if c.isClient {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		head[1] |= maskBit
+		copy(head[n:], key[:])
+		n += 4
+		frame = append(frame, head[:n]...)
+		for i, b := range payload {
+			frame = append(frame, b^key[i&3])
+		}
+	} else {
+		frame = append(frame, head[:n]...)
+		frame = append(frame, payload...)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func (c *Conn) sendClose(code uint16) {
+	var payload [2]byte
+	binary.BigEndian.PutUint16(payload[:], code)
+	c.conn.SetWriteDeadline(time.Now().Add(closeWriteTimeout))
+	c.writeFrame(opClose, payload[:])
+}
+
+// Close 发送 close 帧后关闭底层连接
+func (c *Conn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		c.sendClose(closeNormal)
+		err = c.conn.Close()
+	})
+	return err
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,192 @@
+package websocket
+
+import (
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// acceptKey 计算 Sec-WebSocket-Accept, RFC 6455 4.2.2
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkOrigin 浏览器发起的连接带 Origin 头, 须与请求的 Host 同源或在 origins 中,
+// 防止任意网页借访问者的网络位置跨站连接; origins 的元素为完整 Origin(如 https://example.com)
+// 或主机名(含端口), "*" 表示不检查. 未带 Origin 的非浏览器客户端不受限制
+func checkOrigin(r *http.Request, origins []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, o := range origins {
+		if o == "*" || strings.EqualFold(o, origin) || strings.EqualFold(o, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Upgrade 把 http 请求升级为 websocket 连接; 默认只接受同源或未带 Origin 的请求, origins 为额外允许的来源
+func Upgrade(w http.ResponseWriter, r *http.Request, origins ...string) (*Conn, error) {
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, ErrBadHandshake
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+	if !checkOrigin(r, origins) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return nil, ErrBadOrigin
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("websocket: response does not implement http.Hijacker")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newConn(conn, brw.Reader, false), nil
+}
+
+// Listener 以 net.Listener 的形式提供 websocket 连接, 可直接交给 tcp.TCPServer.Serve
+type Listener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	srv       *http.Server
+	origins   []string // 同源之外允许的 Origin
+}
+
+// NewListener 创建 Listener, 通过 ServeHTTP 挂载到已有的 http 服务; origins 见 Upgrade
+func NewListener(addr net.Addr, origins ...string) *Listener {
+	return &Listener{
+		addr:    addr,
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+		origins: origins,
+	}
+}
+
+// Listen 在 addr 上启动 http 服务, 把 path 上的 websocket 连接交给 Listener; tlsCfg 非空时为 wss,
+// origins 见 Upgrade
+func Listen(addr, path string, tlsCfg *tls.Config, origins ...string) (*Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsCfg != nil {
+		ln = tls.NewListener(ln, tlsCfg)
+	}
+
+	wl := NewListener(ln.Addr(), origins...)
+	mux := http.NewServeMux()
+	mux.Handle(path, wl)
+	wl.srv = &http.Server{Handler: mux}
+	go func() {
+		if err := wl.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			wl.Close()
+		}
+	}()
+	return wl, nil
+}
+
+func (l *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-l.done:
+		http.Error(w, "server closed", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+
+	conn, err := Upgrade(w, r, l.origins...)
+	if err != nil {
+		return
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		if l.srv != nil {
+			err = l.srv.Close()
+		}
+	})
+	return err
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *Listener) String() string {
+	return fmt.Sprintf("websocket listener on %v", l.addr)
+}
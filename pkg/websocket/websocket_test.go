@@ -0,0 +1,202 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startEchoListener(t *testing.T) *Listener {
+	t.Helper()
+	ln, err := Listen("127.0.0.1:0", "/chat", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestEcho(t *testing.T) {
+	ln := startEchoListener(t)
+	conn, err := Dial("ws://"+ln.Addr().String()+"/chat", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 覆盖 7bit、16bit、64bit 三种负载长度
+	chunks := [][]byte{
+		[]byte("hello"),
+		bytes.Repeat([]byte{'a'}, 300),
+		bytes.Repeat([]byte{'b'}, 70000),
+	}
+	var want []byte
+	for _, c := range chunks {
+		if _, err := conn.Write(c); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, c...)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("echo data mismatch")
+	}
+}
+
+func TestPingAndClose(t *testing.T) {
+	ln := startEchoListener(t)
+	nc, err := Dial("ws://"+ln.Addr().String()+"/chat", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := nc.(*Conn)
+	defer conn.Close()
+
+	// 服务端收到 ping 自动回复 pong, 客户端 Read 时跳过 pong
+	if err := conn.writeFrame(opPing, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "data" {
+		t.Fatalf("read %q err %v", buf, err)
+	}
+
+	// 服务端收到 close 帧后回复 close, 客户端读到 EOF
+	conn.sendClose(closeNormal)
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Fatalf("read after close err %v, want EOF", err)
+	}
+}
+
+func TestUnmaskedClientFrameRejected(t *testing.T) {
+	ln := startEchoListener(t)
+	nc, err := Dial("ws://"+ln.Addr().String()+"/chat", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := nc.(*Conn)
+	defer conn.Close()
+
+	// 伪装成服务端发送不带掩码的帧
+	conn.isClient = false
+	conn.Write([]byte("bad"))
+	conn.isClient = true
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := conn.Read(make([]byte, 8)); err != io.EOF {
+		t.Fatalf("read err %v, want EOF", err)
+	}
+}
+
+func TestUpgradeRequired(t *testing.T) {
+	ln := startEchoListener(t)
+	resp, err := http.Get("http://" + ln.Addr().String() + "/chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", resp.StatusCode)
+	}
+
+	_, err = Dial("ws://"+ln.Addr().String()+"/none", nil)
+	if err == nil || !strings.Contains(err.Error(), "bad handshake") {
+		t.Fatalf("dial unknown path err %v", err)
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	ln := NewListener(&net.TCPAddr{})
+	ln.Close()
+	if _, err := ln.Accept(); err != ErrListenerClosed {
+		t.Fatalf("accept err %v, want ErrListenerClosed", err)
+	}
+}
+
+// upgradeStatus 以指定 Origin 发起升级请求, 返回响应状态码
+func upgradeStatus(t *testing.T, addr, origin string) int {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/chat", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	if err := req.Write(c); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(c), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestOriginCheck(t *testing.T) {
+	ln, err := Listen("127.0.0.1:0", "/chat", nil, "https://chat.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	addr := ln.Addr().String()
+
+	for _, tc := range []struct {
+		origin string
+		status int
+	}{
+		{"", http.StatusSwitchingProtocols},                         // 非浏览器客户端
+		{"http://" + addr, http.StatusSwitchingProtocols},           // 同源
+		{"https://chat.example.com", http.StatusSwitchingProtocols}, // 允许的来源
+		{"https://evil.example.com", http.StatusForbidden},          // 跨站
+		{"null", http.StatusForbidden},
+	} {
+		if got := upgradeStatus(t, addr, tc.origin); got != tc.status {
+			t.Errorf("origin %q status %d, want %d", tc.origin, got, tc.status)
+		}
+	}
+}